@@ -0,0 +1,210 @@
+package AnchorHashing
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// AnchorHash supports removing arbitrary buckets, not just the last one, and
+// only ever moves the keys of the bucket that changed. It works over a fixed
+// set of capacity buckets (the anchor), some of which are working. A key
+// hashes into the anchor and, while it lands on a removed bucket, rehashes
+// into the buckets that were still working when that one was removed.
+// https://arxiv.org/pdf/1812.09674.pdf
+type AnchorHash struct {
+	// anchor is zero for working buckets. For removed buckets it is the
+	// number of working buckets just after the removal.
+	anchor []int32
+	// next is, for a removed bucket, the bucket that took over its place in
+	// the working set
+	next []int32
+	// working lists the working buckets in its first size entries, and
+	// position is the index of each bucket in working
+	working  []int32
+	position []int32
+	// removed is a stack of removed buckets, most recent last
+	removed []int32
+	size    int
+}
+
+// New makes a new AnchorHash with buckets working buckets out of capacity.
+// capacity is the most buckets that can ever be working at once and will be
+// raised to buckets if it is smaller.
+func New(buckets int, capacity int) *AnchorHash {
+	if capacity < buckets {
+		capacity = buckets
+	}
+	ah := &AnchorHash{
+		anchor:   make([]int32, capacity, capacity),
+		next:     make([]int32, capacity, capacity),
+		working:  make([]int32, capacity, capacity),
+		position: make([]int32, capacity, capacity),
+		removed:  make([]int32, 0, capacity),
+		size:     buckets,
+	}
+	for b := 0; b < capacity; b++ {
+		ah.next[b] = int32(b)
+		ah.working[b] = int32(b)
+		ah.position[b] = int32(b)
+	}
+	for b := capacity - 1; b >= buckets; b-- {
+		ah.removed = append(ah.removed, int32(b))
+		ah.anchor[b] = int32(b)
+	}
+	return ah
+}
+
+// MapBucket returns the target bucket for a given object hash
+func (ah *AnchorHash) MapBucket(location uint64) int {
+	var lb [8]byte
+	binary.LittleEndian.PutUint64(lb[:], location)
+
+	b := int32(location % uint64(len(ah.anchor)))
+	for ah.anchor[b] > 0 {
+		// rehash into the buckets that were working when b was removed,
+		// following replacements for any removed before b
+		h := int32(xxhash.Checksum64S(lb[:], uint64(b)) % uint64(ah.anchor[b]))
+		for ah.anchor[h] >= ah.anchor[b] {
+			h = ah.next[h]
+		}
+		b = h
+	}
+	return int(b)
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (ah *AnchorHash) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = ah.MapBucket(location)
+	}
+}
+
+// Add brings back the most recently removed bucket and returns it, or -1 if
+// every bucket in the anchor is already working
+func (ah *AnchorHash) Add() int {
+	if len(ah.removed) == 0 {
+		return -1
+	}
+	b := ah.removed[len(ah.removed)-1]
+	ah.removed = ah.removed[:len(ah.removed)-1]
+
+	ah.anchor[b] = 0
+	ah.position[ah.working[ah.size]] = int32(ah.size)
+	ah.working[ah.position[b]] = b
+	ah.next[b] = b
+	ah.size++
+	return int(b)
+}
+
+// Remove takes a working bucket out of service. Only keys that were mapped to
+// it move. It reports false if the bucket was not working or is the last one.
+func (ah *AnchorHash) Remove(bucket int) bool {
+	if bucket < 0 || bucket >= len(ah.anchor) || ah.anchor[bucket] > 0 || ah.size <= 1 {
+		return false
+	}
+	b := int32(bucket)
+	ah.removed = append(ah.removed, b)
+	ah.size--
+	ah.anchor[b] = int32(ah.size)
+
+	last := ah.working[ah.size]
+	ah.working[ah.position[b]] = last
+	ah.next[b] = last
+	ah.position[last] = ah.position[b]
+	return true
+}
+
+// Working returns the number of working buckets
+func (ah *AnchorHash) Working() int {
+	return ah.size
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. Removing a bucket only moves its keys, and adding one back only takes
+// its keys back, so the change is minimal in both directions.
+func (ah *AnchorHash) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
+}
+
+// Name tells you who we are
+func (ah *AnchorHash) Name() string {
+	return fmt.Sprintf("AnchorHash[%d/%d]", ah.size, len(ah.anchor))
+}
+
+// SnapshotKind identifies AnchorHash snapshots
+const SnapshotKind = "AnchorHash"
+
+const snapshotVersion = 1
+
+type anchorState struct {
+	Capacity int     `json:"capacity"`
+	Removed  []int32 `json:"removed"`
+}
+
+// restore rebuilds an AnchorHash from its capacity and removal stack. Add
+// undoes Remove exactly, so the rest of the state only depends on which
+// buckets are removed and in what order, and replaying those removals on a
+// full anchor gets it back.
+func (ah *AnchorHash) restore(state anchorState) error {
+	if state.Capacity > Snapshot.MaxBuckets {
+		return fmt.Errorf("snapshot capacity %d is over %d", state.Capacity, Snapshot.MaxBuckets)
+	}
+	if state.Capacity < 1 || len(state.Removed) >= state.Capacity {
+		return fmt.Errorf("snapshot has %d of %d buckets removed", len(state.Removed), state.Capacity)
+	}
+	restored := New(state.Capacity, state.Capacity)
+	for _, b := range state.Removed {
+		if !restored.Remove(int(b)) {
+			return fmt.Errorf("snapshot cannot remove bucket %d", b)
+		}
+	}
+	*ah = *restored
+	return nil
+}
+
+// MarshalBinary encodes the AnchorHash as a versioned snapshot
+func (ah *AnchorHash) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(len(ah.anchor))
+	e.Uint64(uint64(len(ah.removed)))
+	for _, b := range ah.removed {
+		e.Int(int(b))
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the AnchorHash with the one in a snapshot
+func (ah *AnchorHash) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := anchorState{Capacity: d.Int()}
+	state.Removed = make([]int32, d.Len(1))
+	for ix := range state.Removed {
+		state.Removed[ix] = int32(d.Int())
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return ah.restore(state)
+}
+
+// MarshalJSON encodes the AnchorHash as a versioned snapshot
+func (ah *AnchorHash) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, anchorState{len(ah.anchor), ah.removed})
+}
+
+// UnmarshalJSON replaces the AnchorHash with the one in a snapshot
+func (ah *AnchorHash) UnmarshalJSON(data []byte) error {
+	state := anchorState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return ah.restore(state)
+}
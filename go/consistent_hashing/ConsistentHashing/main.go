@@ -1,43 +1,149 @@
 package ConsistentHashing
 
 import (
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"math"
+	"math/bits"
 	"sort"
+	"strconv"
 
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
 	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/RingIndex"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
 )
 
 // BucketPlace is the location of a bucket on the ring
 type BucketPlace struct {
-	Place  uint64
-	Bucket int
+	Place  uint64 `json:"place"`
+	Bucket int    `json:"bucket"`
 }
 
-// ConsistentHashRing is just a collection of BucketPlace(s), sorted by place
+// ConsistentHashRing is just a collection of BucketPlace(s), sorted by place.
+// Rings made by the constructors or restored from snapshots also keep an
+// index of the places to speed up lookups. A ring put together by hand is
+// searched without one until Reindex is called. The index is not kept in
+// step with Buckets, so after changing Buckets in any way call Reindex.
 type ConsistentHashRing struct {
 	Buckets  []BucketPlace
 	Replicas int
+	index    *RingIndex.Index
+	// buckets is how many buckets have points, for Name
+	buckets int
 }
 
 // New makes a new ring given a set of buckets and replicas.
 // buckets should be a positive, non-zero number
 // replicas will default to 200 if less than or equal to zero
 func New(buckets int, replicas int) *ConsistentHashRing {
+	return NewWithMembership(Membership.Range(buckets), replicas)
+}
+
+// NewWithMembership makes a new ring over any set of buckets. A bucket's
+// points only depend on its id, so this is the ring of the highest member
+// with everyone else's points taken out.
+func NewWithMembership(members Membership.Membership, replicas int) *ConsistentHashRing {
 	if replicas <= 0 {
-		replicas = buckets * buckets
+		replicas = len(members) * len(members)
 	}
-	ring := make([]BucketPlace, buckets*replicas, buckets*replicas)
-	for b := 0; b < buckets; b++ {
+	ring := make([]BucketPlace, len(members)*replicas, len(members)*replicas)
+	for ix, b := range members {
+		// the rth point is the bucket hashed r+1 times, so each point is one
+		// more hash of the one before
+		place := uint64(b)
 		for r := 0; r < replicas; r++ {
-			place := ObjectHasher.PlaceUInt64N(uint64(b), r+1)
-			ring[(b*replicas)+r] = BucketPlace{place, b}
+			place = ObjectHasher.PlaceUInt64N(place, 1)
+			ring[(ix*replicas)+r] = BucketPlace{place, b}
 		}
 	}
 	sort.Slice(ring, func(i, j int) bool {
 		return ring[i].Place < ring[j].Place
 	})
-	return &ConsistentHashRing{ring, replicas}
+	return newRing(ring, replicas)
+}
+
+// newRing makes a ring of sorted points, with its index
+func newRing(points []BucketPlace, replicas int) *ConsistentHashRing {
+	ring := &ConsistentHashRing{Buckets: points, Replicas: replicas}
+	ring.Reindex()
+	return ring
+}
+
+// Reindex builds the ring's lookup index from its points, and counts the
+// buckets they belong to. The index costs 8 bytes a point and a little over 2
+// more for its table, on top of the 16 of the points themselves, and takes a
+// lookup from a binary search over the whole ring to a search of one or two
+// places.
+func (ring *ConsistentHashRing) Reindex() {
+	rr := ring.Buckets
+	seen := map[int]bool{}
+	for _, p := range rr {
+		seen[p.Bucket] = true
+	}
+	ring.buckets = len(seen)
+	ring.index = RingIndex.Build(len(rr), func(ix int) uint64 { return rr[ix].Place })
+}
+
+// search returns the position of the first point at or after location, or
+// the number of points if there is none
+func (ring *ConsistentHashRing) search(location uint64) int {
+	rr := ring.Buckets
+	return ring.index.Find(location, len(rr), func(ix int) uint64 { return rr[ix].Place })
+}
+
+// KetamaServer is a memcached server as libketama describes it: its address,
+// as "host:port", and its weight
+type KetamaServer struct {
+	Addr   string
+	Weight int
+}
+
+// NewKetama makes a ring with the same points libketama would, so keys hashed
+// with KetamaHash land on the same servers as they do for memcached clients
+// using it. Buckets are indexes into servers. Each server gets 40 MD5 digests
+// of "host:port-i" per average weight, and each digest makes 4 points, so
+// with equal weights that is 160 points per server. libketama works out the
+// digest count in float32, which is copied here since it can round down.
+// Servers without weight get no points, and it fails if that leaves none.
+// Points on the same place keep the order of servers, where libketama leaves
+// it to qsort.
+func NewKetama(servers []KetamaServer) (*ConsistentHashRing, error) {
+	total := 0
+	for _, s := range servers {
+		if s.Weight > 0 {
+			total += s.Weight
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("none of the %d ketama servers has any weight", len(servers))
+	}
+	ring := []BucketPlace{}
+	for b, s := range servers {
+		if s.Weight <= 0 {
+			continue
+		}
+		pct := float32(s.Weight) / float32(total)
+		digests := int(math.Floor(float64(float32(float64(pct) * 40.0 * float64(len(servers))))))
+		for k := 0; k < digests; k++ {
+			digest := md5.Sum([]byte(s.Addr + "-" + strconv.Itoa(k)))
+			for h := 0; h < 4; h++ {
+				ring = append(ring, BucketPlace{uint64(binary.LittleEndian.Uint32(digest[h*4:])), b})
+			}
+		}
+	}
+	sort.SliceStable(ring, func(i, j int) bool {
+		return ring[i].Place < ring[j].Place
+	})
+	return newRing(ring, 160), nil
+}
+
+// KetamaHash is where libketama puts a key on its ring: the first 4 bytes of
+// the key's MD5 digest, little-endian
+func KetamaHash(key string) uint64 {
+	digest := md5.Sum([]byte(key))
+	return uint64(binary.LittleEndian.Uint32(digest[:]))
 }
 
 // MapBucket will return the correct bucket for the provided hash value
@@ -45,24 +151,264 @@ func New(buckets int, replicas int) *ConsistentHashRing {
 // given location
 func (ring *ConsistentHashRing) MapBucket(location uint64) int {
 	rr := ring.Buckets
-	i := sort.Search(
-		len(rr),
-		func(i int) bool { return rr[i].Place >= location },
-	)
+	i := ring.search(location)
 	if i >= len(rr) {
 		return rr[0].Bucket
 	}
 	return rr[i].Bucket
 }
 
-// ExpectedMoveRate returns the rate (0-1) at which members are expected to move
-func (ring *ConsistentHashRing) ExpectedMoveRate(otherSize int) float64 {
-	buckets := 1 + (len(ring.Buckets) / ring.Replicas)
-	otherSize++
-	return math.Abs(float64(otherSize-buckets)) / float64(buckets)
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations. An indexed ring far too big to stay cached
+// puts the locations in order first and walks them along the ring, so the
+// places and table are read front to back rather than all over. Putting them
+// in order costs about as much as an indexed lookup into a cached ring, so
+// smaller rings and small batches are searched one at a time.
+func (ring *ConsistentHashRing) MapBatch(locations []uint64, out []int) {
+	if ring.index == nil || len(ring.Buckets) < mergePoints || len(locations) < mergeLocations {
+		for ix, location := range locations {
+			out[ix] = ring.MapBucket(location)
+		}
+		return
+	}
+	ring.mergeBatch(locations, out)
+}
+
+// mergePoints and mergeLocations are the smallest ring and batch for which
+// MapBatch sorts its locations. Below about 4M points, sorting costs more
+// than it saves.
+const (
+	mergePoints    = 1 << 22
+	mergeLocations = 256
+)
+
+// mergeBatch is MapBatch for an indexed ring, walking the locations in order.
+// Each search starts from the location's slot or where the one before it
+// ended, whichever is later.
+func (ring *ConsistentHashRing) mergeBatch(locations []uint64, out []int) {
+	rr := ring.Buckets
+	pos := 0
+	for _, ix := range sortedOrder(locations) {
+		pos = ring.index.SearchFrom(locations[ix], pos)
+		if pos < len(rr) {
+			out[ix] = rr[pos].Bucket
+		} else {
+			out[ix] = rr[0].Bucket
+		}
+	}
+}
+
+// sortedOrder returns the indexes of locations in order of location. Hashes
+// are spread evenly, so counting them into about one slot each by their top
+// bits leaves almost nothing for the insertion sort that finishes each slot.
+// A slot that fills up anyway, such as when every location is the same, is
+// sorted properly instead.
+func sortedOrder(locations []uint64) []int32 {
+	shift := uint(64 - bits.Len(uint(len(locations))))
+	starts := make([]int32, (1<<(64-shift))+1)
+	for _, location := range locations {
+		starts[(location>>shift)+1]++
+	}
+	for slot := 1; slot < len(starts); slot++ {
+		starts[slot] += starts[slot-1]
+	}
+	order := make([]int32, len(locations), len(locations))
+	next := append([]int32{}, starts...)
+	for ix, location := range locations {
+		slot := location >> shift
+		order[next[slot]] = int32(ix)
+		next[slot]++
+	}
+	for slot := 0; slot+1 < len(starts); slot++ {
+		part := order[starts[slot]:starts[slot+1]]
+		if len(part) > 16 {
+			sort.Slice(part, func(i, j int) bool { return locations[part[i]] < locations[part[j]] })
+			continue
+		}
+		for i := 1; i < len(part); i++ {
+			for j := i; j > 0 && locations[part[j]] < locations[part[j-1]]; j-- {
+				part[j], part[j-1] = part[j-1], part[j]
+			}
+		}
+	}
+	return order
 }
 
-// Name tells you who we are
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. A bucket's points do not depend on the other members, so a key stays
+// when the next point on the ring of both memberships together belongs to a
+// bucket in both.
+func (ring *ConsistentHashRing) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
+}
+
+// Name tells you who we are. The bucket count is taken from the points when
+// the ring is indexed, since weighted rings do not give every bucket Replicas
+// of them.
 func (ring *ConsistentHashRing) Name() string {
-	return fmt.Sprintf("ConsistentHashRing[%d, %d]", len(ring.Buckets)/ring.Replicas, ring.Replicas)
+	return fmt.Sprintf("ConsistentHashRing[%d, %d]", ring.buckets, ring.Replicas)
+}
+
+// Range is the half-open interval [Start, End) of the 64-bit location space.
+// An End of 0 stands for 2^64, so the zero Range is the whole space and a
+// range running to the top of the space does not need to wrap.
+type Range struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// OwnedRange is a Range and the bucket that keys in it map to
+type OwnedRange struct {
+	Range
+	Bucket int
+}
+
+// Contains tells whether a location is in the range
+func (r Range) Contains(location uint64) bool {
+	return location >= r.Start && (r.End == 0 || location < r.End)
+}
+
+// Fraction returns the share (0-1) of the location space in the range
+func (r Range) Fraction() float64 {
+	if r.End == 0 && r.Start == 0 {
+		return 1
+	}
+	return float64(r.End-r.Start) / (1 << 64)
+}
+
+// Owners splits a range by the buckets that own its parts, in order. A point
+// owns the locations after the point before it, up to and including its own
+// place, and the first point also owns the locations after the last one.
+// Neighboring parts with the same owner are joined.
+func (ring *ConsistentHashRing) Owners(r Range) []OwnedRange {
+	rr := ring.Buckets
+	owned := []OwnedRange{}
+	if len(rr) == 0 || (r.End != 0 && r.End <= r.Start) {
+		return owned
+	}
+	last := r.End - 1
+	i := ring.search(r.Start)
+	for start := r.Start; ; i++ {
+		bucket, end := rr[0].Bucket, uint64(math.MaxUint64)
+		if i < len(rr) {
+			bucket, end = rr[i].Bucket, rr[i].Place
+		}
+		if end < start {
+			// a point sharing its place with the one before owns nothing
+			continue
+		}
+		if end > last {
+			end = last
+		}
+		if n := len(owned); n > 0 && owned[n-1].Bucket == bucket {
+			owned[n-1].End = end + 1
+		} else {
+			owned = append(owned, OwnedRange{Range{start, end + 1}, bucket})
+		}
+		if end == last {
+			return owned
+		}
+		start = end + 1
+	}
+}
+
+// Owner returns the bucket that owns all of a range. It is false if the range
+// is split between buckets or is empty.
+func (ring *ConsistentHashRing) Owner(r Range) (int, bool) {
+	owned := ring.Owners(r)
+	if len(owned) != 1 {
+		return -1, false
+	}
+	return owned[0].Bucket, true
+}
+
+// Ranges lists the ranges a bucket owns, in order
+func (ring *ConsistentHashRing) Ranges(bucket int) []Range {
+	ranges := []Range{}
+	for _, o := range ring.Owners(Range{}) {
+		if o.Bucket == bucket {
+			ranges = append(ranges, o.Range)
+		}
+	}
+	return ranges
+}
+
+// Ownership returns the share (0-1) of the ring each bucket owns
+func (ring *ConsistentHashRing) Ownership() map[int]float64 {
+	shares := map[int]float64{}
+	for _, o := range ring.Owners(Range{}) {
+		shares[o.Bucket] += o.Fraction()
+	}
+	return shares
+}
+
+// SnapshotKind identifies ConsistentHashRing snapshots
+const SnapshotKind = "ConsistentHashRing"
+
+const snapshotVersion = 1
+
+type ringState struct {
+	Replicas int           `json:"replicas"`
+	Points   []BucketPlace `json:"points"`
+}
+
+// restore checks and installs decoded fields. Lookups binary search the
+// points, so they have to be sorted.
+func (ring *ConsistentHashRing) restore(points []BucketPlace, replicas int) error {
+	if len(points) == 0 || replicas < 1 {
+		return fmt.Errorf("snapshot has %d points and replicas %d", len(points), replicas)
+	}
+	for ix, p := range points {
+		if ix > 0 && p.Place < points[ix-1].Place {
+			return fmt.Errorf("snapshot points are not sorted at %d", ix)
+		}
+		if p.Bucket < 0 {
+			return fmt.Errorf("snapshot point %d has bucket %d", ix, p.Bucket)
+		}
+	}
+	*ring = *newRing(points, replicas)
+	return nil
+}
+
+// MarshalBinary encodes the ring as a versioned snapshot
+func (ring *ConsistentHashRing) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(ring.Replicas)
+	e.Uint64(uint64(len(ring.Buckets)))
+	for _, p := range ring.Buckets {
+		e.Uint64(p.Place)
+		e.Int(p.Bucket)
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the ring with the one in a snapshot
+func (ring *ConsistentHashRing) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	replicas := d.Int()
+	points := make([]BucketPlace, d.Len(2))
+	for ix := range points {
+		points[ix] = BucketPlace{d.Uint64(), d.Int()}
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return ring.restore(points, replicas)
+}
+
+// MarshalJSON encodes the ring as a versioned snapshot
+func (ring *ConsistentHashRing) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, ringState{ring.Replicas, ring.Buckets})
+}
+
+// UnmarshalJSON replaces the ring with the one in a snapshot
+func (ring *ConsistentHashRing) UnmarshalJSON(data []byte) error {
+	state := ringState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return ring.restore(state.Points, state.Replicas)
 }
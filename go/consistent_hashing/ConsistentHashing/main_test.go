@@ -0,0 +1,488 @@
+package ConsistentHashing
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+)
+
+const replicas = 200
+
+func TestNewIsSorted(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		ring := New(size, replicas)
+		if len(ring.Buckets) != size*replicas {
+			t.Fatalf("size %d: %d points, expected %d", size, len(ring.Buckets), size*replicas)
+		}
+		for ix := 1; ix < len(ring.Buckets); ix++ {
+			if ring.Buckets[ix-1].Place > ring.Buckets[ix].Place {
+				t.Fatalf("size %d: point %d is out of order", size, ix)
+			}
+		}
+	}
+}
+
+func TestMapBucketDeterministic(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Same(t, New(size, replicas), New(size, replicas), MapperTest.Locations(1000))
+	}
+}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Range(t, New(size, replicas), size)
+	}
+}
+
+func TestMinimalDisruption(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Growth(t, New(size, replicas), New(size+1, replicas), size, 0.05)
+	}
+}
+
+// ringOf is NewWithMembership checked against a bigger ring with the other
+// buckets' points taken out
+func ringOf(t *testing.T, members Membership.Membership) *ConsistentHashRing {
+	full := New(members[len(members)-1]+1, replicas)
+	points := []BucketPlace{}
+	for _, p := range full.Buckets {
+		if members.Contains(p.Bucket) {
+			points = append(points, p)
+		}
+	}
+	ring := NewWithMembership(members, replicas)
+	if fmt.Sprint(ring.Buckets) != fmt.Sprint(points) {
+		t.Fatalf("%v: ring differs from the filtered full ring", members)
+	}
+	return ring
+}
+
+func TestExpectedMoveRate(t *testing.T) {
+	from := Membership.Range(10)
+	for _, to := range []Membership.Membership{
+		from.Without(4),
+		from.Without(4).With(12),
+		from.Without(1, 2, 3).With(10, 11, 12),
+	} {
+		a, b := ringOf(t, from), ringOf(t, to)
+		locs := MapperTest.Locations(20000)
+		moved := 0
+		for _, location := range locs {
+			if a.MapBucket(location) != b.MapBucket(location) {
+				moved++
+			}
+		}
+		expected := a.ExpectedMoveRate(from, to)
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.02 {
+			t.Errorf("%v: %0.4f moved, expected %0.4f", to, actual, expected)
+		}
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range MapperTest.Sizes {
+		ring := New(size, replicas)
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ring.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.SnapshotRoundTrip(t, New(size, replicas), func() MapperTest.Snapshotter { return &ConsistentHashRing{} })
+	}
+}
+
+// TestRanges checks that the owned ranges tile the location space and agree
+// with MapBucket
+func TestRanges(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		ring := New(size, replicas)
+		all := ring.Owners(Range{})
+		total := 0.0
+		for _, o := range all {
+			total += o.Fraction()
+		}
+		if all[0].Start != 0 || all[len(all)-1].End != 0 {
+			t.Fatalf("size %d: ranges run from %x to %x", size, all[0].Start, all[len(all)-1].End)
+		}
+		for ix := 1; ix < len(all); ix++ {
+			if all[ix].Start != all[ix-1].End {
+				t.Fatalf("size %d: gap or overlap between %+v and %+v", size, all[ix-1], all[ix])
+			}
+		}
+		if math.Abs(total-1) > 1e-9 {
+			t.Errorf("size %d: ranges cover %v of the ring", size, total)
+		}
+
+		for _, location := range MapperTest.Locations(5000) {
+			ix := sort.Search(len(all), func(i int) bool { return all[i].End == 0 || all[i].End > location })
+			if !all[ix].Contains(location) || all[ix].Bucket != ring.MapBucket(location) {
+				t.Fatalf("size %d: %x is in %+v but maps to %d", size, location, all[ix], ring.MapBucket(location))
+			}
+		}
+
+		// Ranges is the same, one bucket at a time
+		for b := 0; b < size; b += 1 + size/10 {
+			ix := 0
+			for _, r := range ring.Ranges(b) {
+				for all[ix].Bucket != b {
+					ix++
+				}
+				if all[ix].Range != r {
+					t.Fatalf("size %d: bucket %d owns %+v, expected %+v", size, b, r, all[ix].Range)
+				}
+				ix++
+			}
+		}
+	}
+}
+
+// TestRangesEdges uses points at both ends of the space and a shared place
+func TestRangesEdges(t *testing.T) {
+	ring := &ConsistentHashRing{Buckets: []BucketPlace{{0, 1}, {10, 2}, {10, 3}, {math.MaxUint64, 4}}, Replicas: 1}
+	expected := []OwnedRange{{Range{0, 1}, 1}, {Range{1, 11}, 2}, {Range{11, 0}, 4}}
+	if owned := ring.Owners(Range{}); fmt.Sprint(owned) != fmt.Sprint(expected) {
+		t.Errorf("owners %v, expected %v", owned, expected)
+	}
+	if ranges := ring.Ranges(3); len(ranges) != 0 {
+		t.Errorf("shadowed point owns %v", ranges)
+	}
+
+	// the first point owns the wrap, which is split at the top of the space
+	ring = &ConsistentHashRing{Buckets: []BucketPlace{{100, 1}, {200, 2}}, Replicas: 1}
+	expected = []OwnedRange{{Range{0, 101}, 1}, {Range{101, 201}, 2}, {Range{201, 0}, 1}}
+	if owned := ring.Owners(Range{}); fmt.Sprint(owned) != fmt.Sprint(expected) {
+		t.Errorf("owners %v, expected %v", owned, expected)
+	}
+	if ranges := ring.Ranges(1); len(ranges) != 2 || ranges[0] != (Range{0, 101}) || ranges[1] != (Range{201, 0}) {
+		t.Errorf("bucket 1 owns %v", ranges)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	ring := &ConsistentHashRing{Buckets: []BucketPlace{{100, 1}, {200, 2}, {300, 2}}, Replicas: 1}
+	for _, tc := range []struct {
+		r      Range
+		bucket int
+		ok     bool
+	}{
+		{Range{0, 101}, 1, true},
+		{Range{50, 60}, 1, true},
+		{Range{101, 301}, 2, true},
+		{Range{150, 250}, 2, true},
+		{Range{301, 0}, 1, true},
+		{Range{100, 102}, -1, false},
+		{Range{250, 350}, -1, false},
+		{Range{}, -1, false},
+		{Range{7, 7}, -1, false},
+	} {
+		if bucket, ok := ring.Owner(tc.r); bucket != tc.bucket || ok != tc.ok {
+			t.Errorf("%+v owned by %d, %v, expected %d, %v", tc.r, bucket, ok, tc.bucket, tc.ok)
+		}
+	}
+	if owned := ring.Owners(Range{250, 350}); fmt.Sprint(owned) != fmt.Sprint([]OwnedRange{{Range{250, 301}, 2}, {Range{301, 350}, 1}}) {
+		t.Errorf("unexpected owners %v", owned)
+	}
+}
+
+// TestOwnership checks the shares of the ring against the keys each bucket
+// gets, and that a new bucket's ranges only come from the others' old ones
+func TestOwnership(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		ring := New(size, replicas)
+		shares := ring.Ownership()
+		counts := map[int]int{}
+		locs := MapperTest.Locations(20000)
+		for _, location := range locs {
+			counts[ring.MapBucket(location)]++
+		}
+		for b := 0; b < size; b++ {
+			if actual := float64(counts[b]) / float64(len(locs)); math.Abs(actual-shares[b]) > 0.01 {
+				t.Errorf("size %d: bucket %d owns %0.4f, but gets %0.4f of keys", size, b, shares[b], actual)
+			}
+		}
+
+		grown := New(size+1, replicas)
+		streamed := 0.0
+		for _, r := range grown.Ranges(size) {
+			for _, o := range ring.Owners(r) {
+				if o.Bucket == size {
+					t.Fatalf("size %d: new bucket already owns %+v", size, o)
+				}
+				streamed += o.Fraction()
+			}
+		}
+		if math.Abs(streamed-grown.Ownership()[size]) > 1e-9 {
+			t.Errorf("size %d: streamed %v, new bucket owns %v", size, streamed, grown.Ownership()[size])
+		}
+	}
+}
+
+// ketamaServers are the memcached servers of libcouchbase's memd_4node test
+// config, in the sorted order libcouchbase builds its continuum from, and
+// ketamaKeys is the server it expects for each of Key_0 through Key_1023,
+// from the memd_4node.exp.json that goes with it (as carried in gocbcore's
+// testdata). That continuum is libketama's with equal weights.
+var ketamaServers = []KetamaServer{
+	{"10.0.0.195:12000", 1}, {"localhost:12002", 1}, {"localhost:12004", 1}, {"localhost:12006", 1},
+}
+
+const ketamaKeys = "" +
+	"0332211123201032330131301031132000110023211000310233103101131110" +
+	"3110022220102323011312033311003220332310202020222333333120103301" +
+	"1013030313221132310333122100032321031023230232000231300330331231" +
+	"0303301213323312110021001302001220230122302000002210020012332323" +
+	"2223033331021101202203132130132032103313120203320230301223002300" +
+	"2211121123320112011133123233210332311223223120332203002311302331" +
+	"1031210101303333221032003303031232033213023131012122111031103203" +
+	"2133130331323231022133323223110212200312100321310232310113020231" +
+	"1123322002333012010110231133212302330220301003120332210023013232" +
+	"1300311310321330100230210210000031233300133002013123331002122003" +
+	"2122022310131300102130131230323330230020311100000132023322333032" +
+	"0210333213233002023113223112330120132201233232133330222130230032" +
+	"3223213003330100231232310200332033020322212301133020103003133223" +
+	"1302131120223223012330220303230132103222233313001201100122303200" +
+	"3212330310001233111202331103310301032113323322332322321203220313" +
+	"2333302020210302102312132121223023132320312212030202020232013022"
+
+func TestKetama(t *testing.T) {
+	ring, err := NewKetama(ketamaServers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.Buckets) != 160*len(ketamaServers) {
+		t.Errorf("%d points, expected %d", len(ring.Buckets), 160*len(ketamaServers))
+	}
+	for ix, expected := range ketamaKeys {
+		key := fmt.Sprintf("Key_%d", ix)
+		if actual := ring.MapBucket(KetamaHash(key)); actual != int(expected-'0') {
+			t.Errorf("%s on %d, expected %c", key, actual, expected)
+		}
+	}
+}
+
+// Neither libketama nor libcouchbase publishes expectations for weighted
+// servers, so these come from a Python transcription of ketama.c's
+// ketama_create_continuum, which rounds through float32 with struct where
+// the C code does. The same transcription gives every one of the 1024
+// memd_4node expectations above. Weights only change how many digests each
+// server gets. 21 of 40 over 3 servers is a case where float32 rounds the
+// count down, to 62 digests rather than 63.
+var ketamaWeighted = []struct {
+	servers     []KetamaServer
+	points      []int
+	first, last []BucketPlace
+	keys        string // the server for Key_0 through Key_63
+}{
+	{
+		servers: []KetamaServer{{"10.0.0.195:12000", 4}, {"localhost:12002", 2}, {"localhost:12004", 1}, {"localhost:12006", 1}},
+		points:  []int{320, 160, 80, 80},
+		first:   []BucketPlace{{1406573, 2}, {19163149, 0}, {40483458, 2}},
+		last:    []BucketPlace{{4273034170, 2}, {4290171528, 0}},
+		keys:    "0332211123000030100100001031102000010020011000010203101100100010",
+	},
+	{
+		servers: []KetamaServer{{"10.0.0.195:12000", 21}, {"localhost:12002", 12}, {"localhost:12004", 7}},
+		points:  []int{248, 144, 84},
+		first:   []BucketPlace{{1406573, 2}, {19163149, 0}, {40483458, 2}},
+		last:    []BucketPlace{{4273034170, 2}, {4290171528, 0}},
+		keys:    "0102211122000010100100001001102000110020011000010201101101120010",
+	},
+	{
+		servers: []KetamaServer{{"10.0.1.1:11211", 600}, {"10.0.1.2:11211", 300}, {"10.0.1.3:11211", 200}, {"cache.example.com:11211", 50}},
+		points:  []int{332, 164, 108, 24},
+		first:   []BucketPlace{{4826654, 1}, {5627423, 0}, {10171922, 0}},
+		last:    []BucketPlace{{4277557028, 3}, {4284233799, 1}},
+		keys:    "3002201120200123000001020111202022010001000001000022020211200000",
+	},
+}
+
+func TestKetamaWeighted(t *testing.T) {
+	for _, tc := range ketamaWeighted {
+		ring, err := NewKetama(tc.servers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points := make([]int, len(tc.servers), len(tc.servers))
+		for _, p := range ring.Buckets {
+			points[p.Bucket]++
+		}
+		if fmt.Sprint(points) != fmt.Sprint(tc.points) {
+			t.Errorf("%v: %v points, expected %v", tc.servers, points, tc.points)
+		}
+		first, last := ring.Buckets[:len(tc.first)], ring.Buckets[len(ring.Buckets)-len(tc.last):]
+		if fmt.Sprint(first) != fmt.Sprint(tc.first) || fmt.Sprint(last) != fmt.Sprint(tc.last) {
+			t.Errorf("%v: ring starts %v and ends %v", tc.servers, first, last)
+		}
+		for ix, expected := range tc.keys {
+			key := fmt.Sprintf("Key_%d", ix)
+			if actual := ring.MapBucket(KetamaHash(key)); actual != int(expected-'0') {
+				t.Errorf("%v: %s on %d, expected %c", tc.servers, key, actual, expected)
+			}
+		}
+		if expected := fmt.Sprintf("ConsistentHashRing[%d, 160]", len(tc.servers)); ring.Name() != expected {
+			t.Errorf("%v: named %s, expected %s", tc.servers, ring.Name(), expected)
+		}
+	}
+}
+
+// TestKetamaNoWeight checks that NewKetama refuses to make a ring with no
+// points, which would panic on the first lookup
+func TestKetamaNoWeight(t *testing.T) {
+	for _, servers := range [][]KetamaServer{nil, {{"10.0.0.1:11211", 0}, {"10.0.0.2:11211", -1}}} {
+		if _, err := NewKetama(servers); err == nil {
+			t.Errorf("%v accepted", servers)
+		}
+	}
+}
+
+func TestKetamaHash(t *testing.T) {
+	for _, tc := range []struct {
+		key      string
+		expected uint64
+	}{
+		// the empty string is RFC 1321's first MD5 test, the rest are from
+		// memd_4node.exp.json
+		{"", 3649838548},
+		{"Key_0", 1026020100},
+		{"Key_1", 3873048688},
+		{"Key_1000", 282456685},
+		{"Key_1023", 1462001454},
+	} {
+		if actual := KetamaHash(tc.key); actual != tc.expected {
+			t.Errorf("%q hashed to %d, expected %d", tc.key, actual, tc.expected)
+		}
+	}
+}
+
+// BenchmarkIndex compares lookups with and without the index on rings the
+// size of large clusters. A ring of 100k buckets takes a while to build.
+func BenchmarkIndex(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	out := make([]int, len(locs), len(locs))
+	for _, size := range []int{1000, 10000, 100000} {
+		indexed := New(size, replicas)
+		unindexed := &ConsistentHashRing{Buckets: indexed.Buckets, Replicas: indexed.Replicas}
+		b.Run(fmt.Sprintf("buckets=%d/search", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				out[i&1023] = unindexed.MapBucket(locs[i&1023])
+			}
+		})
+		b.Run(fmt.Sprintf("buckets=%d/index", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				out[i&1023] = indexed.MapBucket(locs[i&1023])
+			}
+		})
+		b.Run(fmt.Sprintf("buckets=%d/batch", size), func(b *testing.B) {
+			for i := 0; i < b.N; i += len(locs) {
+				indexed.MapBatch(locs, out)
+			}
+		})
+	}
+}
+
+// TestIndexed checks that rings from every constructor and from snapshots
+// are indexed, and place keys the same as without the index
+func TestIndexed(t *testing.T) {
+	locs := MapperTest.Locations(5000)
+	ring := New(100, replicas)
+	data, err := ring.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &ConsistentHashRing{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	ketama, err := NewKetama([]KetamaServer{{"10.0.0.1:11211", 1}, {"10.0.0.2:11211", 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rings := map[string]*ConsistentHashRing{
+		"New":               ring,
+		"NewWithMembership": NewWithMembership(Membership.New(3, 5, 8, 13), replicas),
+		"NewKetama":         ketama,
+		"restored":          restored,
+	}
+	for name, indexed := range rings {
+		if indexed.index == nil {
+			t.Fatalf("%s: ring has no index", name)
+		}
+		unindexed := &ConsistentHashRing{Buckets: indexed.Buckets, Replicas: indexed.Replicas}
+		out := make([]int, len(locs), len(locs))
+		unindexed.MapBatch(locs, out)
+		for ix, location := range locs {
+			if indexed.MapBucket(location) != unindexed.MapBucket(location) || out[ix] != unindexed.MapBucket(location) {
+				t.Fatalf("%s: %x placed on %d with the index and %d without", name, location, indexed.MapBucket(location), unindexed.MapBucket(location))
+			}
+		}
+	}
+}
+
+// TestMergeBatch checks the sorted walk MapBatch takes on very large rings,
+// on a small one, with batches that are nothing like evenly spread hashes
+func TestMergeBatch(t *testing.T) {
+	ring := New(100, replicas)
+	rr := ring.Buckets
+	descending := make([]uint64, 3000, 3000)
+	for ix := range descending {
+		descending[ix] = math.MaxUint64 - uint64(ix)*(math.MaxUint64/3000)
+	}
+	same := make([]uint64, 1000, 1000)
+	for ix := range same {
+		same[ix] = 0x5555555555555555
+	}
+	batches := map[string][]uint64{
+		"spread":     MapperTest.Locations(5000),
+		"same":       same,
+		"descending": descending,
+		"edges":      {0, math.MaxUint64, 1, rr[0].Place, rr[len(rr)-1].Place, rr[len(rr)-1].Place + 1},
+		"points":     {rr[7].Place - 1, rr[7].Place, rr[7].Place + 1},
+		"empty":      {},
+	}
+	for name, locs := range batches {
+		out := make([]int, len(locs), len(locs))
+		ring.mergeBatch(locs, out)
+		for ix, location := range locs {
+			if out[ix] != ring.MapBucket(location) {
+				t.Fatalf("%s: %x batched to %d, expected %d", name, location, out[ix], ring.MapBucket(location))
+			}
+		}
+	}
+}
+
+// TestReindex checks that a ring whose Buckets are changed by hand places
+// keys as the points say once it is reindexed, including when a point is
+// moved in place and nothing about the slice changes
+func TestReindex(t *testing.T) {
+	locs := MapperTest.Locations(10000)
+	for name, change := range map[string]func([]BucketPlace) []BucketPlace{
+		"removed":  func(rr []BucketPlace) []BucketPlace { return append(rr[:5], rr[6:]...) },
+		"replaced": func(rr []BucketPlace) []BucketPlace { return append([]BucketPlace{}, rr[len(rr)/2:]...) },
+		"appended": func(rr []BucketPlace) []BucketPlace { return append(rr, BucketPlace{math.MaxUint64, 10}) },
+		"moved": func(rr []BucketPlace) []BucketPlace {
+			rr[len(rr)-1].Place = rr[len(rr)-2].Place + (math.MaxUint64-rr[len(rr)-2].Place)/2
+			rr[0].Place /= 2
+			return rr
+		},
+	} {
+		ring := New(10, 20)
+		ring.Buckets = change(ring.Buckets)
+		ring.Reindex()
+		plain := &ConsistentHashRing{Buckets: ring.Buckets, Replicas: ring.Replicas}
+		MapperTest.Same(t, ring, plain, append(locs, 0, ring.Buckets[0].Place, math.MaxUint64))
+		last := ring.Buckets[len(ring.Buckets)-1]
+		if ring.MapBucket(last.Place+1) != ring.Buckets[0].Bucket || ring.MapBucket(last.Place) != last.Bucket {
+			t.Errorf("%s: reindexed ring does not wrap after its last point", name)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package CrushPlacement
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// maxTries bounds how many times a replica is redrawn after landing in a
+// failure domain that already holds one, or on a branch with no weight
+const maxTries = 50
+
+// DeviceType marks a node as a device: a leaf that holds a bucket
+const DeviceType = "device"
+
+// Node is one level of a topology: a region, zone, rack, host or whatever
+// the description uses. Devices are the leaves. They have no type or
+// DeviceType, hold a bucket and carry a weight. Every other node weighs the
+// sum of its children, so a rack or host with nothing in it yet weighs 0 and
+// is never chosen. Names have to be unique, since they seed each node's
+// draws.
+type Node struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Bucket   int     `json:"bucket,omitempty"`
+	Weight   float64 `json:"weight,omitempty"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// Rule says how many replicas to place and which type of node they must not
+// share. An empty FailureDomain only requires distinct leaves.
+type Rule struct {
+	Replicas      int    `json:"replicas"`
+	FailureDomain string `json:"failure_domain"`
+}
+
+// straw2 is a node prepared for placement
+type straw2 struct {
+	node     *Node
+	seed     uint64
+	weight   float64
+	device   bool
+	children []*straw2
+}
+
+// CrushMap places replicas by walking a weighted topology, choosing among
+// the children of each node with straw2: every child draws ln(u)/weight for
+// a hash u of the key, child and replica, and the highest draw wins. A
+// child's draw does not depend on its siblings, so changing one node's weight
+// only moves keys to or from that node among its siblings. That holds at each
+// level, not overall: the change also reweighs every ancestor, and each of
+// those sheds keys from all of its subtree, so CRUSH moves more than the
+// minimum. Replicas that land in a failure domain already used are redrawn.
+// Modeled on Ceph's CRUSH.
+// https://ceph.io/assets/pdfs/weil-crush-sc06.pdf
+type CrushMap struct {
+	root    *straw2
+	rule    Rule
+	buckets int
+}
+
+// ParseTopology reads a topology described as nested JSON nodes
+func ParseTopology(data []byte) (*Node, error) {
+	root := &Node{}
+	if err := json.Unmarshal(data, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// New makes a new CrushMap for a topology and a rule. It fails if a node is
+// named twice, a bucket appears twice, a device has a negative weight or
+// children, there are no devices, or no node has the rule's failure domain
+// type.
+func New(root *Node, rule Rule) (*CrushMap, error) {
+	if rule.Replicas < 1 {
+		return nil, fmt.Errorf("rule needs at least one replica, not %d", rule.Replicas)
+	}
+	names := map[string]bool{}
+	buckets := map[int]bool{}
+	domainFound := rule.FailureDomain == ""
+	var prepare func(n *Node) (*straw2, error)
+	prepare = func(n *Node) (*straw2, error) {
+		if names[n.Name] {
+			return nil, fmt.Errorf("node %q appears more than once", n.Name)
+		}
+		names[n.Name] = true
+		domainFound = domainFound || n.Type == rule.FailureDomain
+		s := &straw2{node: n, seed: xxhash.ChecksumString64(n.Name)}
+		if n.Type == "" || n.Type == DeviceType {
+			if len(n.Children) > 0 {
+				return nil, fmt.Errorf("device %q has children", n.Name)
+			}
+			if n.Weight < 0 || math.IsNaN(n.Weight) {
+				return nil, fmt.Errorf("device %q has weight %v", n.Name, n.Weight)
+			}
+			if buckets[n.Bucket] {
+				return nil, fmt.Errorf("bucket %d appears more than once", n.Bucket)
+			}
+			buckets[n.Bucket] = true
+			s.weight = n.Weight
+			s.device = true
+			return s, nil
+		}
+		for _, c := range n.Children {
+			child, err := prepare(c)
+			if err != nil {
+				return nil, err
+			}
+			s.children = append(s.children, child)
+			s.weight += child.weight
+		}
+		return s, nil
+	}
+
+	s, err := prepare(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("topology has no devices")
+	}
+	if !domainFound {
+		return nil, fmt.Errorf("no node has failure domain type %q", rule.FailureDomain)
+	}
+	return &CrushMap{s, rule, len(buckets)}, nil
+}
+
+// choose picks a child of s with straw2, or returns nil if none of them has
+// any weight
+func choose(s *straw2, lb []byte, r uint64) *straw2 {
+	var best *straw2
+	bestDraw := math.Inf(-1)
+	for _, c := range s.children {
+		if c.weight <= 0 {
+			continue
+		}
+		h := xxhash.Checksum64S(lb, c.seed^(r*0x9e3779b97f4a7c15))
+		// 53 bits of the hash make a uniform u in (0, 1]
+		u := float64(h>>11+1) / (1 << 53)
+		if draw := math.Log(u) / c.weight; draw > bestDraw {
+			best, bestDraw = c, draw
+		}
+	}
+	return best
+}
+
+// descend walks down from s until it reaches a node of type stop, or a
+// device if stop is empty. It returns nil if it runs into a branch with no
+// weight.
+func descend(s *straw2, lb []byte, r uint64, stop string) *straw2 {
+	for s != nil && !s.device && (stop == "" || s.node.Type != stop) {
+		s = choose(s, lb, r)
+	}
+	return s
+}
+
+// Place fills out with the buckets holding each replica for a given object
+// hash, primary first, and returns it. There will be fewer than the rule asks
+// for if the topology does not have enough failure domains with weight.
+func (cm *CrushMap) Place(location uint64, out []int) []int {
+	return cm.place(location, cm.rule.Replicas, out[:0])
+}
+
+// MapBucket returns the bucket holding the primary replica for a given object
+// hash, or -1 if no device has any weight
+func (cm *CrushMap) MapBucket(location uint64) int {
+	var placed [1]int
+	out := cm.place(location, 1, placed[:0])
+	if len(out) == 0 {
+		return -1
+	}
+	return out[0]
+}
+
+// MapBatch maps each location to the bucket holding its primary replica, in
+// the same position in out, which has to be at least as long as locations
+func (cm *CrushMap) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = cm.MapBucket(location)
+	}
+}
+
+// place chooses the first replicas replicas. As in CRUSH, a retry draws with
+// the next replica number, so the first few replicas never depend on how
+// many are asked for.
+func (cm *CrushMap) place(location uint64, replicas int, out []int) []int {
+	var lb [8]byte
+	binary.LittleEndian.PutUint64(lb[:], location)
+
+	var domainBuf [8]*straw2
+	domains := domainBuf[:0]
+	for rep := 0; rep < replicas; rep++ {
+	tries:
+		for try := 0; try < maxTries; try++ {
+			r := uint64(rep + try)
+			domain := descend(cm.root, lb[:], r, cm.rule.FailureDomain)
+			if domain == nil {
+				continue
+			}
+			for _, d := range domains {
+				if d == domain {
+					continue tries
+				}
+			}
+			leaf := descend(domain, lb[:], r, "")
+			if leaf == nil || leaf.weight <= 0 {
+				continue
+			}
+			domains = append(domains, domain)
+			out = append(out, leaf.node.Bucket)
+			break
+		}
+	}
+	return out
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which primaries are expected to
+// move, assuming all leaves weigh the same. This is the straw2 answer for a
+// flat topology. Deeper ones move more, since a change reweighs every node
+// above it.
+func (cm *CrushMap) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
+}
+
+// Name tells you who we are
+func (cm *CrushMap) Name() string {
+	return fmt.Sprintf("Crush(%d x %s)[%d]", cm.rule.Replicas, cm.rule.FailureDomain, cm.buckets)
+}
+
+// SnapshotKind identifies CrushMap snapshots
+const SnapshotKind = "CrushMap"
+
+// snapshotVersion 2 made devices explicit. Version 1 treated every node
+// without children as a device, whatever its type.
+const snapshotVersion = 2
+
+type crushState struct {
+	Topology *Node `json:"topology"`
+	Rule     Rule  `json:"rule"`
+}
+
+// restore rebuilds a CrushMap from its topology and rule. The draws only
+// depend on node names and weights, so New puts everything back.
+func (cm *CrushMap) restore(state crushState, version uint16) error {
+	if state.Topology == nil {
+		return fmt.Errorf("snapshot has no topology")
+	}
+	if version < 2 {
+		upgradeDevices(&state)
+	}
+	restored, err := New(state.Topology, state.Rule)
+	if err != nil {
+		return err
+	}
+	*cm = *restored
+	return nil
+}
+
+// upgradeDevices turns a version 1 topology into one that places the same
+// way. Every node without children was a device then, and when those were
+// also the failure domain, the rule only asked for distinct devices.
+func upgradeDevices(state *crushState) {
+	domainFound := state.Rule.FailureDomain == ""
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if len(n.Children) == 0 {
+			n.Type = DeviceType
+		}
+		domainFound = domainFound || n.Type == state.Rule.FailureDomain
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(state.Topology)
+	if !domainFound {
+		state.Rule.FailureDomain = ""
+	}
+}
+
+func encodeNode(e *Snapshot.Encoder, n *Node) {
+	e.String(n.Name)
+	e.String(n.Type)
+	e.Int(n.Bucket)
+	e.Float64(n.Weight)
+	e.Uint64(uint64(len(n.Children)))
+	for _, c := range n.Children {
+		encodeNode(e, c)
+	}
+}
+
+// decodeNode reads a node and its children. A node takes at least 12 bytes,
+// which bounds the child counts a corrupt snapshot can ask for.
+func decodeNode(d *Snapshot.Decoder) *Node {
+	n := &Node{Name: d.String(), Type: d.String(), Bucket: d.Int(), Weight: d.Float64()}
+	if children := d.Len(12); children > 0 {
+		n.Children = make([]*Node, children, children)
+		for ix := range n.Children {
+			n.Children[ix] = decodeNode(d)
+		}
+	}
+	return n
+}
+
+// MarshalBinary encodes the CrushMap as a versioned snapshot
+func (cm *CrushMap) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(cm.rule.Replicas)
+	e.String(cm.rule.FailureDomain)
+	encodeNode(e, cm.root.node)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the CrushMap with the one in a snapshot
+func (cm *CrushMap) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := crushState{Rule: Rule{Replicas: d.Int(), FailureDomain: d.String()}}
+	state.Topology = decodeNode(d)
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return cm.restore(state, d.Version)
+}
+
+// MarshalJSON encodes the CrushMap as a versioned snapshot
+func (cm *CrushMap) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, crushState{cm.root.node, cm.rule})
+}
+
+// UnmarshalJSON replaces the CrushMap with the one in a snapshot
+func (cm *CrushMap) UnmarshalJSON(data []byte) error {
+	state := crushState{}
+	version, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state)
+	if err != nil {
+		return err
+	}
+	return cm.restore(state, version)
+}
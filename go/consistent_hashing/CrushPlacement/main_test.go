@@ -0,0 +1,327 @@
+package CrushPlacement
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// topology builds 2 regions of 2 zones of 3 racks of 4 hosts, with host
+// numbers running across racks
+func topology() *Node {
+	root := &Node{Name: "root", Type: "root"}
+	host := 0
+	for r := 0; r < 2; r++ {
+		region := &Node{Name: fmt.Sprintf("region%d", r), Type: "region"}
+		for z := 0; z < 2; z++ {
+			zone := &Node{Name: fmt.Sprintf("%s-zone%d", region.Name, z), Type: "zone"}
+			for k := 0; k < 3; k++ {
+				rack := &Node{Name: fmt.Sprintf("%s-rack%d", zone.Name, k), Type: "rack"}
+				for h := 0; h < 4; h++ {
+					rack.Children = append(rack.Children, &Node{Name: fmt.Sprintf("host%d", host), Type: DeviceType, Bucket: host, Weight: 1})
+					host++
+				}
+				zone.Children = append(zone.Children, rack)
+			}
+			region.Children = append(region.Children, zone)
+		}
+		root.Children = append(root.Children, region)
+	}
+	return root
+}
+
+// rackOf is the rack a host from topology is in
+func rackOf(host int) int {
+	return host / 4
+}
+
+// regionOf is the region a host from topology is in
+func regionOf(host int) int {
+	return host / 24
+}
+
+func TestDistinctFailureDomains(t *testing.T) {
+	cm, err := New(topology(), Rule{3, "rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []int{}
+	for _, location := range MapperTest.Locations(5000) {
+		out = cm.Place(location, out)
+		if len(out) != 3 {
+			t.Fatalf("%x placed on %v", location, out)
+		}
+		if rackOf(out[0]) == rackOf(out[1]) || rackOf(out[0]) == rackOf(out[2]) || rackOf(out[1]) == rackOf(out[2]) {
+			t.Fatalf("%x placed on %v, sharing a rack", location, out)
+		}
+		if cm.MapBucket(location) != out[0] {
+			t.Fatalf("%x has primary %d, but MapBucket says %d", location, out[0], cm.MapBucket(location))
+		}
+	}
+}
+
+func TestTooFewDomains(t *testing.T) {
+	cm, err := New(topology(), Rule{3, "region"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := cm.Place(12345, nil); len(out) != 2 {
+		t.Errorf("placed on %v, expected one host in each of the 2 regions", out)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	root := topology()
+	heavy := root.Children[0].Children[0].Children[0].Children[0]
+	heavy.Weight = 3
+	cm, err := New(root, Rule{1, ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[int]int{}
+	locs := MapperTest.Locations(51000)
+	for _, location := range locs {
+		counts[cm.MapBucket(location)]++
+	}
+	// 51 units of weight, 1000 keys each
+	if counts[heavy.Bucket] < 2700 || counts[heavy.Bucket] > 3300 {
+		t.Errorf("weight 3 host got %d keys, expected about 3000", counts[heavy.Bucket])
+	}
+	if counts[1] < 850 || counts[1] > 1150 {
+		t.Errorf("weight 1 host got %d keys, expected about 1000", counts[1])
+	}
+}
+
+// Changing a host's weight changes the weight of every bucket above it, so
+// straw2 will move keys between siblings at each of those levels, but never
+// between two regions that do not contain the host.
+func TestWeightChangeContained(t *testing.T) {
+	before, _ := New(topology(), Rule{3, "rack"})
+	root := topology()
+	changed := root.Children[1].Children[0].Children[2].Children[1]
+	changed.Weight = 0
+	after, _ := New(root, Rule{3, "rack"})
+
+	moved := 0
+	locs := MapperTest.Locations(20000)
+	for _, location := range locs {
+		a, b := before.MapBucket(location), after.MapBucket(location)
+		if b == changed.Bucket {
+			t.Fatalf("%x still placed on zero weight host %d", location, b)
+		}
+		if a == b {
+			continue
+		}
+		moved++
+		if regionOf(a) != regionOf(changed.Bucket) && regionOf(b) != regionOf(changed.Bucket) {
+			t.Fatalf("%x moved from %d to %d, neither in the changed region", location, a, b)
+		}
+	}
+	// Each level loses the share its bucket gave up among its siblings:
+	// region 1/2-23/47, zone (1/2)(1/2-11/23), rack (1/4)(1/3-3/11), host
+	// (1/12)(1/4), for about 0.057 against the minimal 1/48
+	expected := (0.5 - 23.0/47) + 0.5*(0.5-11.0/23) + 0.25*(1.0/3-3.0/11) + 1.0/48
+	if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.005 {
+		t.Errorf("%0.4f moved, expected %0.4f", actual, expected)
+	}
+}
+
+// In a flat topology, straw2 is plain weighted rendezvous hashing
+func TestExpectedMoveRate(t *testing.T) {
+	flat := func(members Membership.Membership) *CrushMap {
+		root := &Node{Name: "root", Type: "root"}
+		for _, b := range members {
+			root.Children = append(root.Children, &Node{Name: fmt.Sprintf("host%d", b), Type: DeviceType, Bucket: b, Weight: 1})
+		}
+		cm, err := New(root, Rule{1, ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cm
+	}
+	from := Membership.Range(10)
+	for _, to := range []Membership.Membership{from.Without(4), from.Without(4).With(12), from.With(10, 11)} {
+		a, b := flat(from), flat(to)
+		locs := MapperTest.Locations(20000)
+		moved := 0
+		for _, location := range locs {
+			if a.MapBucket(location) != b.MapBucket(location) {
+				moved++
+			}
+		}
+		expected := a.ExpectedMoveRate(from, to)
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.02 {
+			t.Errorf("%v: %0.4f moved, expected %0.4f", to, actual, expected)
+		}
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	root := topology()
+	root.Children[1].Children[0].Children[0].Children[0].Bucket = 0
+	if _, err := New(root, Rule{3, "rack"}); err == nil {
+		t.Errorf("duplicate bucket accepted")
+	}
+	if _, err := New(topology(), Rule{3, "datacenter"}); err == nil {
+		t.Errorf("unknown failure domain accepted")
+	}
+	if _, err := New(topology(), Rule{0, "rack"}); err == nil {
+		t.Errorf("zero replicas accepted")
+	}
+	root = topology()
+	device := root.Children[0].Children[0].Children[0].Children[0]
+	device.Children = []*Node{{Name: "disk", Weight: 1}}
+	if _, err := New(root, Rule{3, "rack"}); err == nil {
+		t.Errorf("device with children accepted")
+	}
+	if _, err := New(&Node{Name: "root", Type: "root", Children: []*Node{{Name: "rack", Type: "rack"}}}, Rule{1, "rack"}); err == nil {
+		t.Errorf("topology with no devices accepted")
+	}
+}
+
+// An empty rack is not a device. It has no bucket to clash with, weighs
+// nothing and so never changes where anything goes.
+func TestEmptyRack(t *testing.T) {
+	before, err := New(topology(), Rule{3, "rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := topology()
+	zone := root.Children[1].Children[1]
+	zone.Children = append(zone.Children, &Node{Name: "empty-rack", Type: "rack"})
+	after, err := New(root, Rule{3, "rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Name() != before.Name() {
+		t.Errorf("%s with an empty rack, expected %s", after.Name(), before.Name())
+	}
+	x, y := []int{}, []int{}
+	for _, location := range MapperTest.Locations(5000) {
+		x, y = before.Place(location, x), after.Place(location, y)
+		if fmt.Sprint(x) != fmt.Sprint(y) {
+			t.Fatalf("%x placed on %v with an empty rack, was %v", location, y, x)
+		}
+	}
+}
+
+func TestParseTopology(t *testing.T) {
+	root, err := ParseTopology([]byte(`{
+		"name": "dc", "type": "root", "children": [
+			{"name": "rack0", "type": "rack", "children": [
+				{"name": "a", "type": "device", "bucket": 0, "weight": 1},
+				{"name": "b", "type": "device", "bucket": 1, "weight": 2}
+			]},
+			{"name": "rack1", "type": "rack", "children": [
+				{"name": "c", "type": "device", "bucket": 2, "weight": 1}
+			]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := New(root, Rule{2, "rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := cm.Place(42, nil)
+	if len(out) != 2 || (out[0] == 2) == (out[1] == 2) {
+		t.Errorf("placed on %v, expected host 2 and one of rack0", out)
+	}
+}
+
+func BenchmarkPlace(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	cm, _ := New(topology(), Rule{3, "rack"})
+	out := make([]int, 0, 3)
+	for _, replicas := range []int{1, 3} {
+		b.Run(fmt.Sprintf("replicas=%d", replicas), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				cm.place(locs[i&1023], replicas, out[:0])
+			}
+		})
+	}
+}
+
+// TestSnapshotRoundTrip checks that every replica, not just the primary, is
+// placed the same after restoring
+func TestSnapshotRoundTrip(t *testing.T) {
+	root := topology()
+	root.Children[1].Children[0].Children[2].Children[1].Weight = 2.5
+	original, err := New(root, Rule{3, "rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, j := MapperTest.SnapshotRoundTrip(t, original, func() MapperTest.Snapshotter { return &CrushMap{} })
+	fromBinary, fromJSON := b.(*CrushMap), j.(*CrushMap)
+	if fromBinary.Name() != original.Name() || fromJSON.Name() != original.Name() {
+		t.Errorf("restored %s and %s, expected %s", fromBinary.Name(), fromJSON.Name(), original.Name())
+	}
+	expected, x, y := []int{}, []int{}, []int{}
+	for _, location := range MapperTest.Locations(5000) {
+		expected = original.Place(location, expected)
+		x, y = fromBinary.Place(location, x), fromJSON.Place(location, y)
+		if fmt.Sprint(x) != fmt.Sprint(expected) || fmt.Sprint(y) != fmt.Sprint(expected) {
+			t.Fatalf("%x placed on %v and %v after restoring, was %v", location, x, y, expected)
+		}
+	}
+
+	// a topology New would refuse is refused when restoring too
+	root.Children[0].Name = root.Children[1].Name
+	data, err := Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, crushState{root, Rule{3, "rack"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &CrushMap{}); err == nil {
+		t.Errorf("snapshot with duplicate names accepted")
+	}
+}
+
+// Version 1 snapshots had no device type, and every node without children
+// was a device. They still restore and place the same.
+func TestSnapshotVersion1(t *testing.T) {
+	original, err := New(topology(), Rule{3, "rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"rack", "host"} {
+		root := topology()
+		var typeHosts func(n *Node)
+		typeHosts = func(n *Node) {
+			if n.Type == DeviceType {
+				n.Type = "host"
+			}
+			for _, c := range n.Children {
+				typeHosts(c)
+			}
+		}
+		typeHosts(root)
+		e := Snapshot.NewEncoder(SnapshotKind, 1)
+		e.Int(3)
+		e.String(domain)
+		encodeNode(e, root)
+		restored := &CrushMap{}
+		if err := restored.UnmarshalBinary(e.Bytes()); err != nil {
+			t.Fatalf("%s: %v", domain, err)
+		}
+		if domain == "host" {
+			// distinct hosts were distinct devices
+			if restored.rule.FailureDomain != "" {
+				t.Errorf("host rule restored as %q", restored.rule.FailureDomain)
+			}
+			continue
+		}
+		x, y := []int{}, []int{}
+		for _, location := range MapperTest.Locations(5000) {
+			x, y = original.Place(location, x), restored.Place(location, y)
+			if fmt.Sprint(x) != fmt.Sprint(y) {
+				t.Fatalf("%x placed on %v from a version 1 snapshot, expected %v", location, y, x)
+			}
+		}
+	}
+}
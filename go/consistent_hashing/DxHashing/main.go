@@ -0,0 +1,204 @@
+package DxHashing
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// maxProbeFactor bounds the random probing at this many times the array
+// size, after which MapBucket scans for the next active bucket instead. With
+// at least half the array active, running out takes 2^-(2*size) luck.
+const maxProbeFactor = 8
+
+// DxHash keeps a bit array of buckets, each active or inactive, and maps a
+// key by drawing pseudo-random buckets from a generator seeded with the key
+// until one is active. Removing a bucket only moves its own keys, since every
+// other key stops at the same active bucket it did before. Lookups cost about
+// size/active probes, so the array should not be much bigger than the number
+// of working buckets. https://arxiv.org/pdf/2107.07930.pdf
+type DxHash struct {
+	active []uint64
+	// inactive is a stack of buckets available to Add, most recently
+	// removed last
+	inactive []int
+	size     int
+	mask     uint64
+}
+
+// New makes a new DxHash with buckets active buckets. The bit array is
+// capacity rounded up to a power of two, and capacity will be raised to
+// buckets, or to 1, if it is smaller.
+func New(buckets int, capacity int) *DxHash {
+	if capacity < buckets {
+		capacity = buckets
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	arraySize := 1 << uint(bits.Len(uint(capacity-1)))
+	dh := &DxHash{
+		active:   make([]uint64, (arraySize+63)/64, (arraySize+63)/64),
+		inactive: make([]int, 0, arraySize),
+		size:     buckets,
+		mask:     uint64(arraySize - 1),
+	}
+	for b := 0; b < buckets; b++ {
+		dh.active[b/64] |= 1 << uint(b%64)
+	}
+	for b := arraySize - 1; b >= buckets; b-- {
+		dh.inactive = append(dh.inactive, b)
+	}
+	return dh
+}
+
+func (dh *DxHash) isActive(b uint64) bool {
+	return dh.active[b/64]&(1<<(b%64)) != 0
+}
+
+// MapBucket returns the target bucket for a given object hash
+func (dh *DxHash) MapBucket(location uint64) int {
+	state := location
+	b := uint64(0)
+	for probe := uint64(0); probe <= maxProbeFactor*dh.mask; probe++ {
+		// splitmix64, which is cheap and passes BigCrush
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		b = (z ^ (z >> 31)) & dh.mask
+		if dh.isActive(b) {
+			return int(b)
+		}
+	}
+	for !dh.isActive(b) {
+		b = (b + 1) & dh.mask
+	}
+	return int(b)
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (dh *DxHash) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = dh.MapBucket(location)
+	}
+}
+
+// Add activates the most recently removed bucket, or the lowest never-used
+// one, and returns it. It returns -1 if the whole array is active.
+func (dh *DxHash) Add() int {
+	if len(dh.inactive) == 0 {
+		return -1
+	}
+	b := dh.inactive[len(dh.inactive)-1]
+	dh.inactive = dh.inactive[:len(dh.inactive)-1]
+	dh.active[b/64] |= 1 << uint(b%64)
+	dh.size++
+	return b
+}
+
+// Remove deactivates a bucket. Only keys that were mapped to it move. It
+// reports false if the bucket was not active or is the last one.
+func (dh *DxHash) Remove(bucket int) bool {
+	if bucket < 0 || uint64(bucket) > dh.mask || !dh.isActive(uint64(bucket)) || dh.size <= 1 {
+		return false
+	}
+	dh.active[bucket/64] &^= 1 << uint(bucket%64)
+	dh.inactive = append(dh.inactive, bucket)
+	dh.size--
+	return true
+}
+
+// Working returns the number of active buckets
+func (dh *DxHash) Working() int {
+	return dh.size
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. A key's probe sequence does not depend on membership, so it stays
+// when the first active bucket it probes over both memberships is in both.
+func (dh *DxHash) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
+}
+
+// Name tells you who we are
+func (dh *DxHash) Name() string {
+	return fmt.Sprintf("DxHash[%d/%d]", dh.size, dh.mask+1)
+}
+
+// SnapshotKind identifies DxHash snapshots
+const SnapshotKind = "DxHash"
+
+const snapshotVersion = 1
+
+type dxState struct {
+	ArraySize int   `json:"array_size"`
+	Inactive  []int `json:"inactive"`
+}
+
+// restore rebuilds a DxHash from its array size and inactive stack. The
+// stack order is kept, so Add brings buckets back in the same order.
+func (dh *DxHash) restore(state dxState) error {
+	if state.ArraySize > Snapshot.MaxBuckets {
+		return fmt.Errorf("snapshot array size %d is over %d", state.ArraySize, Snapshot.MaxBuckets)
+	}
+	if state.ArraySize < 1 || state.ArraySize&(state.ArraySize-1) != 0 || len(state.Inactive) >= state.ArraySize {
+		return fmt.Errorf("snapshot has %d of %d buckets inactive", len(state.Inactive), state.ArraySize)
+	}
+	restored := New(state.ArraySize, state.ArraySize)
+	for _, b := range state.Inactive {
+		if b < 0 || b >= state.ArraySize || !restored.isActive(uint64(b)) {
+			return fmt.Errorf("snapshot cannot deactivate bucket %d", b)
+		}
+		restored.active[b/64] &^= 1 << uint(b%64)
+		restored.inactive = append(restored.inactive, b)
+		restored.size--
+	}
+	*dh = *restored
+	return nil
+}
+
+// MarshalBinary encodes the DxHash as a versioned snapshot
+func (dh *DxHash) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(int(dh.mask + 1))
+	e.Uint64(uint64(len(dh.inactive)))
+	for _, b := range dh.inactive {
+		e.Int(b)
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the DxHash with the one in a snapshot
+func (dh *DxHash) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := dxState{ArraySize: d.Int()}
+	state.Inactive = make([]int, d.Len(1))
+	for ix := range state.Inactive {
+		state.Inactive[ix] = d.Int()
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return dh.restore(state)
+}
+
+// MarshalJSON encodes the DxHash as a versioned snapshot
+func (dh *DxHash) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, dxState{int(dh.mask + 1), dh.inactive})
+}
+
+// UnmarshalJSON replaces the DxHash with the one in a snapshot
+func (dh *DxHash) UnmarshalJSON(data []byte) error {
+	state := dxState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return dh.restore(state)
+}
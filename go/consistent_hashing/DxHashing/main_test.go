@@ -0,0 +1,158 @@
+package DxHashing
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// members lists the working buckets
+func members(working map[int]bool) Membership.Membership {
+	m := []int{}
+	for b := range working {
+		m = append(m, b)
+	}
+	return Membership.New(m...)
+}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Range(t, New(size, 2*size), size)
+	}
+}
+
+func TestMinimalDisruption(t *testing.T) {
+	locs := MapperTest.Locations(20000)
+	for _, size := range MapperTest.Sizes[2:] {
+		r := rand.New(rand.NewSource(int64(size)))
+		dh := New(size, size+size/2)
+		working := map[int]bool{}
+		for b := 0; b < size; b++ {
+			working[b] = true
+		}
+
+		before := MapperTest.MapAll(dh, locs)
+		for step := 0; step < size/2; step++ {
+			from := members(working)
+			var changed int
+			if r.Intn(3) > 0 {
+				changed = r.Intn(size)
+				if !working[changed] || !dh.Remove(changed) {
+					continue
+				}
+				delete(working, changed)
+			} else {
+				if changed = dh.Add(); changed < 0 {
+					continue
+				}
+				working[changed] = true
+			}
+
+			after := MapperTest.MapAll(dh, locs)
+			moved := 0
+			for ix := range locs {
+				if !working[after[ix]] {
+					t.Fatalf("size %d step %d: %x mapped to removed bucket %d", size, step, locs[ix], after[ix])
+				}
+				if before[ix] == after[ix] {
+					continue
+				}
+				moved++
+				if before[ix] != changed && after[ix] != changed {
+					t.Fatalf("size %d step %d: %x moved from %d to %d when %d changed", size, step, locs[ix], before[ix], after[ix], changed)
+				}
+			}
+			expected := dh.ExpectedMoveRate(from, members(working))
+			if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.02 {
+				t.Errorf("size %d step %d: %0.4f moved, expected %0.4f", size, step, actual, expected)
+			}
+			before = after
+		}
+	}
+}
+
+func TestAddRestores(t *testing.T) {
+	locs := MapperTest.Locations(5000)
+	dh := New(100, 200)
+	original := MapperTest.MapAll(dh, locs)
+	for _, b := range []int{5, 50, 99, 0} {
+		dh.Remove(b)
+	}
+	for dh.Working() < 100 {
+		dh.Add()
+	}
+	for ix, bucket := range MapperTest.MapAll(dh, locs) {
+		if bucket != original[ix] {
+			t.Fatalf("%x mapped to %d after restoring, was %d", locs[ix], bucket, original[ix])
+		}
+	}
+}
+
+// New(0, 0) used to work out a zero-length array from capacity-1 wrapping
+// around. It should get a single inactive bucket that Add can bring in.
+func TestNewEmpty(t *testing.T) {
+	dh := New(0, 0)
+	if dh.Working() != 0 || dh.mask != 0 {
+		t.Fatalf("%s: %d working, mask %d", dh.Name(), dh.Working(), dh.mask)
+	}
+	if b := dh.Add(); b != 0 {
+		t.Fatalf("Add gave %d, expected 0", b)
+	}
+	MapperTest.Range(t, dh, 1)
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range MapperTest.Sizes {
+		for ix, removed := range []int{0, size / 2} {
+			if ix > 0 && removed == 0 {
+				continue
+			}
+			dh := New(size, 2*size)
+			for bucket := 0; bucket < removed; bucket++ {
+				dh.Remove(bucket * 2 % size)
+			}
+			b.Run(fmt.Sprintf("buckets=%d/removed=%d", size, removed), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					dh.MapBucket(locs[i&1023])
+				}
+			})
+		}
+	}
+}
+
+// TestSnapshotRoundTrip checks that a restored DxHash maps the same and also
+// keeps the same history, so the next Add brings back the same bucket
+func TestSnapshotRoundTrip(t *testing.T) {
+	locs := MapperTest.Locations(5000)
+	r := rand.New(rand.NewSource(41))
+	for _, size := range MapperTest.Sizes {
+		original := New(size, 2*size)
+		for removed := 0; removed < size/2; removed++ {
+			original.Remove(r.Intn(size))
+		}
+		original.Add()
+		b, j := MapperTest.SnapshotRoundTrip(t, original, func() MapperTest.Snapshotter { return &DxHash{} })
+		fromBinary, fromJSON := b.(*DxHash), j.(*DxHash)
+		for step := 0; step < 2; step++ {
+			if a, b, c := original.Add(), fromBinary.Add(), fromJSON.Add(); a != b || a != c {
+				t.Fatalf("size %d step %d: added %d and %d after restoring, expected %d", size, step, b, c, a)
+			}
+			MapperTest.Same(t, original, fromBinary, locs)
+			MapperTest.Same(t, original, fromJSON, locs)
+		}
+	}
+
+	// a snapshot of a few bytes must not get to ask for a huge array
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(1 << 40)
+	e.Uint64(0)
+	if err := (&DxHash{}).UnmarshalBinary(e.Bytes()); err == nil {
+		t.Errorf("snapshot with a array of %d accepted", 1<<40)
+	}
+}
@@ -0,0 +1,144 @@
+package FlipHashing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// maxDraws bounds the redraws for keys landing past the last bucket. Each
+// draw succeeds with probability over one half, so running out is a 2^-64
+// event, and even then the answer is still consistent.
+const maxDraws = 64
+
+// FlipHash is a constant-time, constant-memory consistent hash over a range
+// of buckets, built on powers of two. For 2^r buckets, the key's low r bits
+// pick a power of two by their highest set bit, and a second hash "flips" the
+// bits below it to pick a bucket in [2^m, 2^(m+1)). Growing to 2^(r+1) only
+// moves keys whose new top bit is set, into the new upper half. Bucket counts
+// between powers of two redraw keys that land past the end, falling back to
+// the 2^(r-1) answer whenever a redraw lands in the lower half.
+// https://arxiv.org/pdf/2402.17549.pdf
+type FlipHash struct {
+	buckets uint64
+}
+
+// New makes a new FlipHash
+func New(buckets int) *FlipHash {
+	return &FlipHash{uint64(buckets)}
+}
+
+// MapBucket returns the target bucket for a given object hash
+func (fh *FlipHash) MapBucket(location uint64) int {
+	if fh.buckets <= 1 {
+		return 0
+	}
+	var lb [8]byte
+	binary.LittleEndian.PutUint64(lb[:], location)
+
+	r := uint(bits.Len64(fh.buckets - 1))
+	d := flipPow2(lb[:], location, r)
+	if d < fh.buckets {
+		return int(d)
+	}
+
+	half := uint64(1) << (r - 1)
+	for i := uint64(0); i < maxDraws; i++ {
+		// seeds below 64 belong to flipPow2
+		d = xxhash.Checksum64S(lb[:], uint64(r+1)<<8|i) & (half<<1 - 1)
+		if d < half {
+			break
+		}
+		if d < fh.buckets {
+			return int(d)
+		}
+	}
+	return int(flipPow2(lb[:], location, r-1))
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (fh *FlipHash) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = fh.MapBucket(location)
+	}
+}
+
+// flipPow2 maps a key to [0, 2^r)
+func flipPow2(lb []byte, location uint64, r uint) uint64 {
+	b := location & (1<<r - 1)
+	if b == 0 {
+		return 0
+	}
+	m := uint(bits.Len64(b) - 1)
+	return 1<<m | xxhash.Checksum64S(lb, uint64(m))&(1<<m-1)
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. Like JumpHash, only keys of buckets added or removed at the top move,
+// and any other membership has to be served by position.
+func (fh *FlipHash) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.RangeMoveRate(from, to)
+}
+
+// Name tells you who we are
+func (fh *FlipHash) Name() string {
+	return fmt.Sprintf("FlipHash[%d]", fh.buckets)
+}
+
+// SnapshotKind identifies FlipHash snapshots
+const SnapshotKind = "FlipHash"
+
+const snapshotVersion = 1
+
+type flipState struct {
+	Buckets uint64 `json:"buckets"`
+}
+
+// restore checks and installs decoded fields. A FlipHash with no buckets
+// would still map every key to bucket 0, so it is refused.
+func (fh *FlipHash) restore(buckets uint64) error {
+	if buckets == 0 {
+		return fmt.Errorf("snapshot has no buckets")
+	}
+	fh.buckets = buckets
+	return nil
+}
+
+// MarshalBinary encodes the FlipHash as a versioned snapshot
+func (fh *FlipHash) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(fh.buckets)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the FlipHash with the one in a snapshot
+func (fh *FlipHash) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	buckets := d.Uint64()
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return fh.restore(buckets)
+}
+
+// MarshalJSON encodes the FlipHash as a versioned snapshot
+func (fh *FlipHash) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, flipState{fh.buckets})
+}
+
+// UnmarshalJSON replaces the FlipHash with the one in a snapshot
+func (fh *FlipHash) UnmarshalJSON(data []byte) error {
+	state := flipState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return fh.restore(state.Buckets)
+}
@@ -0,0 +1,134 @@
+package FlipHashing
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+func TestMapBucketUniform(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		fh := New(size)
+		seen := make([]int, size, size)
+		locs := MapperTest.Locations(200 * size)
+		for _, location := range locs {
+			bucket := fh.MapBucket(location)
+			if bucket < 0 || bucket >= size {
+				t.Fatalf("size %d: %x mapped to %d", size, location, bucket)
+			}
+			seen[bucket]++
+		}
+		// 200 per bucket gives a standard deviation near 14
+		for bucket, cnt := range seen {
+			if cnt < 120 || cnt > 280 {
+				t.Errorf("size %d: bucket %d got %d keys, expected about 200", size, bucket, cnt)
+			}
+		}
+	}
+}
+
+// Growing one bucket at a time crosses every power of two up to 128
+func TestMinimalDisruption(t *testing.T) {
+	locs := MapperTest.Locations(20000)
+	placed := make([]int, len(locs), len(locs))
+	for size := 1; size <= 130; size++ {
+		fh := New(size)
+		moved := 0
+		for ix, location := range locs {
+			bucket := fh.MapBucket(location)
+			if size > 1 && bucket != placed[ix] {
+				moved++
+				if bucket != size-1 {
+					t.Fatalf("size %d: %x moved from %d to %d, not the new bucket", size, location, placed[ix], bucket)
+				}
+			}
+			placed[ix] = bucket
+		}
+		if size == 1 {
+			continue
+		}
+		expected := New(size-1).ExpectedMoveRate(Membership.Range(size-1), Membership.Range(size))
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.02 {
+			t.Errorf("size %d: %0.4f moved, expected %0.4f", size, actual, expected)
+		}
+	}
+}
+
+func TestExpectedMoveRate(t *testing.T) {
+	for _, tc := range []struct {
+		from, to int
+		expected float64
+	}{
+		{8, 9, 1.0 / 9},
+		{9, 8, 1.0 / 9},
+		{4, 16, 0.75},
+		{100, 100, 0},
+	} {
+		if actual := New(tc.from).ExpectedMoveRate(Membership.Range(tc.from), Membership.Range(tc.to)); math.Abs(actual-tc.expected) > 1e-12 {
+			t.Errorf("%d -> %d: %0.4f, expected %0.4f", tc.from, tc.to, actual, tc.expected)
+		}
+	}
+}
+
+// A membership other than a range is served by position, so taking a bucket
+// out of the middle shifts everything above it
+func TestExpectedMoveRateByPosition(t *testing.T) {
+	from := Membership.Range(10)
+	for _, to := range []Membership.Membership{
+		from.Without(9),
+		from.Without(4),
+		from.Without(0),
+		from.Without(2).With(10),
+		from.With(10, 11, 12),
+	} {
+		a, b := New(len(from)), New(len(to))
+		locs := MapperTest.Locations(20000)
+		moved := 0
+		for _, location := range locs {
+			if from[a.MapBucket(location)] != to[b.MapBucket(location)] {
+				moved++
+			}
+		}
+		expected := a.ExpectedMoveRate(from, to)
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.02 {
+			t.Errorf("%v: %0.4f moved, expected %0.4f", to, actual, expected)
+		}
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range append(MapperTest.Sizes, 1025) {
+		fh := New(size)
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fh.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.SnapshotRoundTrip(t, New(size), func() MapperTest.Snapshotter { return &FlipHash{} })
+	}
+}
+
+func TestSnapshotNoBuckets(t *testing.T) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(0)
+	if err := (&FlipHash{}).UnmarshalBinary(e.Bytes()); err == nil {
+		t.Errorf("binary snapshot with no buckets accepted")
+	}
+	data, err := Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, flipState{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&FlipHash{}).UnmarshalJSON(data); err == nil {
+		t.Errorf("JSON snapshot with no buckets accepted")
+	}
+}
@@ -3,41 +3,225 @@ package JumpHash
 import (
 	"fmt"
 	"math"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// Mode is the arithmetic used for each jump. They only disagree when a
+// quotient rounds across an integer, which happens in a few lookups in a
+// hundred million with bucket counts near 2^31, but that is enough to send a
+// key to different servers in different languages.
+type Mode int
+
+const (
+	// Reference computes the jump in float64 as Google's C++ does
+	Reference Mode = iota
+	// Guava divides by a float64 in (0, 1] as Guava's
+	// Hashing.consistentHash does, and saturates as a Java int cast does
+	Guava
+	// Integer computes the jump with an exact integer division, which any
+	// language can reproduce bit for bit
+	Integer
 )
 
+var modeNames = map[Mode]string{Reference: "reference", Guava: "guava", Integer: "integer"}
+
+// String tells you which mode this is
+func (m Mode) String() string {
+	if name, ok := modeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
 // JumpHash is a random number generator acting like a consistent hash
 // function and doing a good job of it. https://arxiv.org/pdf/1406.2294.pdf
 type JumpHash struct {
-	buckets uint64
+	buckets int32
+	mode    Mode
 }
 
 // New makes a new JumpHash
 func New(buckets int) *JumpHash {
-	return &JumpHash{uint64(buckets)}
+	return NewWithMode(buckets, Reference)
+}
+
+// NewWithMode makes a new JumpHash jumping with a given Mode. The reference
+// and Guava both take an int32 bucket count, so a count that does not fit
+// cannot be served the same way and panics.
+func NewWithMode(buckets int, mode Mode) *JumpHash {
+	if buckets < 0 || buckets > math.MaxInt32 {
+		panic(fmt.Sprintf("JumpHash bucket count %d does not fit in an int32", buckets))
+	}
+	return &JumpHash{int32(buckets), mode}
 }
 
 // MapBucket returns the target bucket for a given object
 func (jh *JumpHash) MapBucket(location uint64) int {
-	b := uint64(1)
-	j := uint64(0)
-	for j < jh.buckets {
+	switch jh.mode {
+	case Guava:
+		return int(HashGuava(int64(location), jh.buckets))
+	case Integer:
+		return int(HashInteger(location, jh.buckets))
+	}
+	return int(Hash(location, jh.buckets))
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations. The mode is only checked once per batch.
+func (jh *JumpHash) MapBatch(locations []uint64, out []int) {
+	switch jh.mode {
+	case Guava:
+		for ix, location := range locations {
+			out[ix] = int(HashGuava(int64(location), jh.buckets))
+		}
+	case Integer:
+		for ix, location := range locations {
+			out[ix] = int(HashInteger(location, jh.buckets))
+		}
+	default:
+		for ix, location := range locations {
+			out[ix] = int(Hash(location, jh.buckets))
+		}
+	}
+}
+
+// Hash is JumpConsistentHash from the paper. It returns -1 for no buckets.
+func Hash(key uint64, buckets int32) int32 {
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int32(b)
+}
+
+// HashGuava is Guava's Hashing.consistentHash(long, int). It returns 0 for
+// no buckets, where Guava throws.
+func HashGuava(input int64, buckets int32) int32 {
+	state := uint64(input)
+	candidate := int32(0)
+	for {
+		state = state*2862933555777941757 + 1
+		next := javaInt(float64(candidate+1) / (float64(int32(state>>33)+1) / (1 << 31)))
+		if next < 0 || next >= buckets {
+			return candidate
+		}
+		candidate = next
+	}
+}
+
+// javaInt converts a float64 to an int32 the way a Java cast does, which
+// saturates where Go's conversion is undefined
+func javaInt(f float64) int32 {
+	switch {
+	case f != f:
+		return 0
+	case f >= math.MaxInt32:
+		return math.MaxInt32
+	case f <= math.MinInt32:
+		return math.MinInt32
+	}
+	return int32(f)
+}
+
+// HashInteger is Hash with each jump the exact floor of (b+1) * 2^31 /
+// (r+1). b+1 is at most 2^31, so the product fits in 63 bits.
+func HashInteger(key uint64, buckets int32) int32 {
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
 		b = j
-		location = location*uint64(2862933555777941757) + 1
-		j = uint64(float64(b+1) * (float64(1<<31) / float64((location>>33)+1)))
+		key = key*2862933555777941757 + 1
+		j = int64((uint64(b+1) << 31) / ((key >> 33) + 1))
 	}
-	return int(b)
+	return int32(b)
 }
 
-// ExpectedMoveRate returns the rate (0-1) at which members are expected to move
-func (jh *JumpHash) ExpectedMoveRate(otherSize int) float64 {
-	otherSize++
-	buckets := int(jh.buckets + 1)
-	return math.Abs(float64(otherSize-buckets)) / float64(buckets)
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. JumpHash only serves a range, so any other membership is served by
+// position and changes in the middle shift everything above them.
+func (jh *JumpHash) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.RangeMoveRate(from, to)
 }
 
 // Name tells you who we are
 func (jh *JumpHash) Name() string {
-	return fmt.Sprintf("JumpHash[%d]", jh.buckets)
+	if jh.mode == Reference {
+		return fmt.Sprintf("JumpHash[%d]", jh.buckets)
+	}
+	return fmt.Sprintf("JumpHash(%s)[%d]", jh.mode, jh.buckets)
+}
+
+// SnapshotKind identifies JumpHash snapshots
+const SnapshotKind = "JumpHash"
+
+// snapshotVersion 2 added the mode. Version 1 snapshots are all Reference.
+const snapshotVersion = 2
+
+type jumpState struct {
+	Buckets uint64 `json:"buckets"`
+	Mode    string `json:"mode,omitempty"`
+}
+
+// restore checks and installs decoded fields
+func (jh *JumpHash) restore(buckets uint64, mode Mode) error {
+	if buckets > math.MaxInt32 {
+		return fmt.Errorf("snapshot bucket count %d does not fit in an int32", buckets)
+	}
+	if _, ok := modeNames[mode]; !ok {
+		return fmt.Errorf("snapshot has unknown %s", mode)
+	}
+	*jh = *NewWithMode(int(buckets), mode)
+	return nil
+}
+
+// MarshalBinary encodes the JumpHash as a versioned snapshot
+func (jh *JumpHash) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(uint64(jh.buckets))
+	e.Int(int(jh.mode))
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the JumpHash with the one in a snapshot
+func (jh *JumpHash) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	buckets := d.Uint64()
+	mode := Reference
+	if d.Version >= 2 {
+		mode = Mode(d.Int())
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return jh.restore(buckets, mode)
+}
+
+// MarshalJSON encodes the JumpHash as a versioned snapshot
+func (jh *JumpHash) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, jumpState{uint64(jh.buckets), jh.mode.String()})
+}
+
+// UnmarshalJSON replaces the JumpHash with the one in a snapshot
+func (jh *JumpHash) UnmarshalJSON(data []byte) error {
+	state := jumpState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	if state.Mode == "" {
+		return jh.restore(state.Buckets, Reference)
+	}
+	for mode, name := range modeNames {
+		if name == state.Mode {
+			return jh.restore(state.Buckets, mode)
+		}
+	}
+	return fmt.Errorf("snapshot has unknown mode %q", state.Mode)
 }
 
 /*
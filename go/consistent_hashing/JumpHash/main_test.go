@@ -0,0 +1,193 @@
+package JumpHash
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+func TestMapBucketDeterministic(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Same(t, New(size), New(size), MapperTest.Locations(1000))
+	}
+}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Range(t, New(size), size)
+	}
+}
+
+func TestMinimalDisruption(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Growth(t, New(size), New(size+1), size, 0.02)
+	}
+}
+
+// A membership other than a range is served by position, so taking a bucket
+// out of the middle shifts everything above it
+func TestExpectedMoveRateByPosition(t *testing.T) {
+	from := Membership.Range(10)
+	for _, to := range []Membership.Membership{
+		from.Without(9),
+		from.Without(4),
+		from.Without(0),
+		from.Without(2).With(10),
+		from.With(10, 11, 12),
+	} {
+		a, b := New(len(from)), New(len(to))
+		locs := MapperTest.Locations(20000)
+		moved := 0
+		for _, location := range locs {
+			if from[a.MapBucket(location)] != to[b.MapBucket(location)] {
+				moved++
+			}
+		}
+		expected := a.ExpectedMoveRate(from, to)
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.02 {
+			t.Errorf("%v: %0.4f moved, expected %0.4f", to, actual, expected)
+		}
+	}
+}
+
+// goldenSizes are the bucket counts for each row of golden
+var goldenSizes = []int32{1, 2, 3, 7, 8, 10, 100, 1000, 1024, 65536, 1000000, math.MaxInt32}
+
+// golden was made by compiling JumpConsistentHash from the paper with gcc.
+// A C transcription of Guava's consistentHash agrees on every one of them.
+var golden = []struct {
+	key     uint64
+	buckets []int32
+}{
+	{0x0000000000000000, []int32{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	{0x0000000000000001, []int32{0, 0, 0, 6, 6, 6, 55, 549, 549, 21134, 985611, 262355607}},
+	{0x0000000000000002, []int32{0, 0, 0, 6, 6, 6, 62, 338, 338, 3927, 152951, 736532115}},
+	{0x00000000deadbeef, []int32{0, 1, 2, 5, 5, 5, 87, 285, 285, 64244, 479362, 1452406526}},
+	{0x000000003b9aca07, []int32{0, 0, 0, 0, 7, 7, 65, 790, 790, 3190, 130025, 794687178}},
+	{0x7fffffffffffffff, []int32{0, 0, 2, 2, 7, 8, 97, 972, 972, 8550, 622539, 213047985}},
+	{0x8000000000000000, []int32{0, 1, 1, 5, 5, 5, 84, 453, 453, 53854, 802256, 1119800965}},
+	{0xffffffffffffffff, []int32{0, 1, 2, 2, 7, 9, 92, 313, 313, 18311, 589430, 699554662}},
+	{0x0123456789abcdef, []int32{0, 0, 0, 0, 0, 0, 57, 194, 194, 33301, 352229, 1651575352}},
+	{0xab54a98ceb1f0ad2, []int32{0, 0, 0, 0, 0, 8, 49, 294, 294, 46485, 46485, 215486598}},
+}
+
+func TestGolden(t *testing.T) {
+	for _, g := range golden {
+		for ix, buckets := range goldenSizes {
+			expected := g.buckets[ix]
+			if actual := Hash(g.key, buckets); actual != expected {
+				t.Errorf("%x in %d: %d, expected %d", g.key, buckets, actual, expected)
+			}
+			if actual := HashGuava(int64(g.key), buckets); actual != expected {
+				t.Errorf("guava %x in %d: %d, expected %d", g.key, buckets, actual, expected)
+			}
+			if actual := HashInteger(g.key, buckets); actual != expected {
+				t.Errorf("integer %x in %d: %d, expected %d", g.key, buckets, actual, expected)
+			}
+		}
+	}
+}
+
+// TestDivergence pins keys where the modes disagree. They were found by
+// running the C reference, the Guava transcription and the integer version
+// over 240 million lookups with large bucket counts. None of these agree
+// with all three.
+func TestDivergence(t *testing.T) {
+	for _, tc := range []struct {
+		key                       uint64
+		reference, guava, integer int32
+	}{
+		{0x1feee3f4ef79c178, 2076360584, 2076360585, 2076360584},
+		{0xcc152eb68498ff2d, 1918241566, 1918241565, 1918241565},
+		{0x880771171d9df8ef, 1889647999, 1889647999, 1889647998},
+		{0xfc30930f206dec82, 1188985318, 1188985318, 1188985317},
+		{0xccbe9dd93b9466e2, 706486794, 706486794, 706486780},
+		{0x95bcc6f7af02c5f7, 1111592885, 1111592884, 1111592884},
+		{0xb5ca11b8eee92b5c, 1983924053, 1983924054, 1983924053},
+		{0x9bff8e9aad33e94b, 1804405462, 1804405461, 1804405461},
+	} {
+		for mode, expected := range map[Mode]int32{Reference: tc.reference, Guava: tc.guava, Integer: tc.integer} {
+			if actual := NewWithMode(math.MaxInt32, mode).MapBucket(tc.key); actual != int(expected) {
+				t.Errorf("%s %x: %d, expected %d", mode, tc.key, actual, expected)
+			}
+		}
+	}
+}
+
+// TestModesAgree checks that the modes only part ways rarely, so any of them
+// is as good a consistent hash as the others
+func TestModesAgree(t *testing.T) {
+	for _, size := range append(MapperTest.Sizes, 1000000) {
+		for _, location := range MapperTest.Locations(20000) {
+			a := New(size).MapBucket(location)
+			if b, c := NewWithMode(size, Guava).MapBucket(location), NewWithMode(size, Integer).MapBucket(location); a != b || a != c {
+				t.Fatalf("size %d: %x mapped to %d, %d and %d", size, location, a, b, c)
+			}
+		}
+	}
+	if Hash(1, 0) != -1 || HashInteger(1, 0) != -1 || HashGuava(1, 0) != 0 {
+		t.Errorf("no buckets mapped to %d, %d and %d", Hash(1, 0), HashInteger(1, 0), HashGuava(1, 0))
+	}
+}
+
+// TestInt32Buckets checks that bucket counts the reference cannot take are
+// refused rather than truncated
+func TestInt32Buckets(t *testing.T) {
+	for _, buckets := range []int{-1, math.MaxInt32 + 1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%d buckets accepted", buckets)
+				}
+			}()
+			New(buckets)
+		}()
+	}
+	if jh := New(math.MaxInt32); jh.Name() != "JumpHash[2147483647]" {
+		t.Errorf("unexpected name %s", jh.Name())
+	}
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(math.MaxInt32 + 1)
+	e.Int(int(Reference))
+	if err := (&JumpHash{}).UnmarshalBinary(e.Bytes()); err == nil {
+		t.Errorf("snapshot with too many buckets accepted")
+	}
+}
+
+// TestSnapshotVersion1 reads a snapshot from before modes were added
+func TestSnapshotVersion1(t *testing.T) {
+	e := Snapshot.NewEncoder(SnapshotKind, 1)
+	e.Uint64(100)
+	jh := NewWithMode(7, Integer)
+	if err := jh.UnmarshalBinary(e.Bytes()); err != nil || jh.Name() != "JumpHash[100]" {
+		t.Errorf("read %s, %v", jh.Name(), err)
+	}
+	if err := json.Unmarshal([]byte(`{"kind":"JumpHash","version":1,"state":{"buckets":100}}`), jh); err != nil || jh.Name() != "JumpHash[100]" {
+		t.Errorf("read %s, %v", jh.Name(), err)
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, mode := range []Mode{Reference, Guava, Integer} {
+		for _, size := range MapperTest.Sizes {
+			jh := NewWithMode(size, mode)
+			b.Run(fmt.Sprintf("mode=%s/buckets=%d", mode, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					jh.MapBucket(locs[i&1023])
+				}
+			})
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.SnapshotRoundTrip(t, New(size), func() MapperTest.Snapshotter { return &JumpHash{} })
+	}
+}
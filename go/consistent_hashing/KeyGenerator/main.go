@@ -0,0 +1,95 @@
+package KeyGenerator
+
+import (
+	"github.com/OneOfOne/xxhash"
+)
+
+// Iterator walks every combination of depth+1 words joined by "-", in the
+// same order the old recursive channel generator produced them. Keys are
+// handed out in batches so the caller pays for one function call per batch
+// rather than one channel handoff per key.
+type Iterator struct {
+	words  []string
+	digits []int
+	buf    []byte
+	done   bool
+}
+
+// New makes a new Iterator over words. depth is the number of extra words
+// appended to each key, so depth 0 yields the words themselves and depth 2
+// yields len(words)^3 keys.
+func New(words []string, depth int) *Iterator {
+	if depth < 0 {
+		depth = 0
+	}
+	return &Iterator{
+		words:  words,
+		digits: make([]int, depth+1, depth+1),
+		done:   len(words) == 0,
+	}
+}
+
+// Len is the total number of keys the iterator produces
+func (it *Iterator) Len() int {
+	total := 1
+	for range it.digits {
+		total *= len(it.words)
+	}
+	return total
+}
+
+// Reset rewinds the iterator to the first key
+func (it *Iterator) Reset() {
+	for ix := range it.digits {
+		it.digits[ix] = 0
+	}
+	it.done = len(it.words) == 0
+}
+
+// Next fills batch with the following keys and returns how many were written.
+// A return of zero means the iterator is exhausted.
+func (it *Iterator) Next(batch []string) int {
+	n := 0
+	for ; n < len(batch) && !it.done; n++ {
+		batch[n] = string(it.current())
+		it.advance()
+	}
+	return n
+}
+
+// NextPlaces fills batch with the locations of the following keys, as
+// ObjectHasher.PlaceString would compute them, and returns how many were
+// written. The keys are assembled in a reused buffer, so no strings are
+// allocated. A return of zero means the iterator is exhausted.
+func (it *Iterator) NextPlaces(batch []uint64) int {
+	n := 0
+	for ; n < len(batch) && !it.done; n++ {
+		batch[n] = xxhash.Checksum64(it.current())
+		it.advance()
+	}
+	return n
+}
+
+// current assembles the key for the current digits into buf
+func (it *Iterator) current() []byte {
+	it.buf = it.buf[:0]
+	for ix, d := range it.digits {
+		if ix > 0 {
+			it.buf = append(it.buf, '-')
+		}
+		it.buf = append(it.buf, it.words[d]...)
+	}
+	return it.buf
+}
+
+// advance bumps the digits like an odometer, last word fastest
+func (it *Iterator) advance() {
+	for ix := len(it.digits) - 1; ix >= 0; ix-- {
+		it.digits[ix]++
+		if it.digits[ix] < len(it.words) {
+			return
+		}
+		it.digits[ix] = 0
+	}
+	it.done = true
+}
@@ -0,0 +1,79 @@
+package KeyGenerator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+)
+
+var words = []string{"a", "bb", "ccc"}
+
+func TestOrder(t *testing.T) {
+	expected := []string{}
+	for _, x := range words {
+		for _, y := range words {
+			expected = append(expected, x+"-"+y)
+		}
+	}
+
+	it := New(words, 1)
+	if it.Len() != len(expected) {
+		t.Fatalf("Len is %d, expected %d", it.Len(), len(expected))
+	}
+	// a batch size that does not divide the key count exercises the tail
+	batch := make([]string, 4, 4)
+	actual := []string{}
+	for n := it.Next(batch); n > 0; n = it.Next(batch) {
+		actual = append(actual, batch[:n]...)
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Fatalf("got %v, expected %v", actual, expected)
+	}
+}
+
+func TestNextPlaces(t *testing.T) {
+	for depth := 0; depth < 3; depth++ {
+		keys, places := New(words, depth), New(words, depth)
+		kb, pb := make([]string, 5, 5), make([]uint64, 5, 5)
+		cnt := 0
+		for n := keys.Next(kb); n > 0; n = keys.Next(kb) {
+			if m := places.NextPlaces(pb); m != n {
+				t.Fatalf("depth %d: %d places for %d keys", depth, m, n)
+			}
+			for ix := 0; ix < n; ix++ {
+				if ObjectHasher.PlaceString(kb[ix]) != pb[ix] {
+					t.Fatalf("depth %d: %q placed at %x", depth, kb[ix], pb[ix])
+				}
+			}
+			cnt += n
+		}
+		if cnt != keys.Len() {
+			t.Errorf("depth %d: %d keys, expected %d", depth, cnt, keys.Len())
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	it := New(words, 2)
+	batch := make([]uint64, 10, 10)
+	it.NextPlaces(batch)
+	first := batch[0]
+	for it.NextPlaces(batch) > 0 {
+	}
+	it.Reset()
+	if it.NextPlaces(batch) == 0 || batch[0] != first {
+		t.Fatalf("Reset did not rewind to the first key")
+	}
+}
+
+func BenchmarkNextPlaces(b *testing.B) {
+	it := New(words, 5)
+	batch := make([]uint64, 4096, 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(batch) {
+		if it.NextPlaces(batch) == 0 {
+			it.Reset()
+		}
+	}
+}
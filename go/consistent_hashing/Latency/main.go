@@ -0,0 +1,129 @@
+package Latency
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// subBucketBits sets the precision of the histogram. Each power of two is
+// split into 1<<subBucketBits linear buckets, so recorded values are off by
+// at most 1/16th (about 6%).
+const subBucketBits = 4
+
+const subBuckets = 1 << subBucketBits
+
+// Histogram is a log-linear histogram of latencies, in the style of
+// HdrHistogram. Values are kept in picoseconds so that sub-nanosecond
+// per-lookup averages still land in distinct buckets.
+type Histogram struct {
+	counts []uint64
+	total  uint64
+	sum    float64
+	max    float64
+}
+
+// New makes an empty Histogram
+func New() *Histogram {
+	return &Histogram{counts: make([]uint64, (64-subBucketBits+1)*subBuckets)}
+}
+
+// Record adds a single observation, in nanoseconds. Negative values, which
+// show up when the calibrated timer overhead is larger than the measured
+// interval, are recorded as zero.
+func (h *Histogram) Record(ns float64) {
+	h.RecordN(ns, 1)
+}
+
+// RecordN adds count observations of the same value, in nanoseconds. Timing
+// a run of lookups and recording its average this way is cheaper than timing
+// each one, but the histogram then only sees averages: a single slow lookup
+// is smoothed over the rest of its run, and Quantile and Max describe the
+// runs, not the lookups in them.
+func (h *Histogram) RecordN(ns float64, count uint64) {
+	if ns < 0 || math.IsNaN(ns) {
+		ns = 0
+	}
+	h.counts[index(uint64(ns*1000))] += count
+	h.total += count
+	h.sum += ns * float64(count)
+	if ns > h.max {
+		h.max = ns
+	}
+}
+
+// Count is the number of observations recorded
+func (h *Histogram) Count() uint64 {
+	return h.total
+}
+
+// Mean is the average of all observations, in nanoseconds
+func (h *Histogram) Mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / float64(h.total)
+}
+
+// Max is the largest observation, in nanoseconds
+func (h *Histogram) Max() float64 {
+	return h.max
+}
+
+// Quantile returns the value, in nanoseconds, below which q (0-1) of the
+// observations fall. The value is the midpoint of the containing bucket.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for ix, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			lo, width := bucketRange(ix)
+			return math.Min((float64(lo)+float64(width)/2)/1000, h.max)
+		}
+	}
+	return h.max
+}
+
+// index finds the bucket holding v. Values below 2*subBuckets get a bucket
+// each; above that, every power of two is split into subBuckets buckets.
+func index(v uint64) int {
+	shift := bits.Len64(v) - (subBucketBits + 1)
+	if shift < 0 {
+		return int(v)
+	}
+	return shift*subBuckets + int(v>>uint(shift))
+}
+
+// bucketRange is the inverse of index, returning the smallest value in the
+// bucket and its width
+func bucketRange(ix int) (lo uint64, width uint64) {
+	if ix < 2*subBuckets {
+		return uint64(ix), 1
+	}
+	shift := uint(ix/subBuckets - 1)
+	return uint64(ix-int(shift)*subBuckets) << shift, 1 << shift
+}
+
+// CalibrateTimer measures what a back-to-back pair of time.Now calls costs,
+// which is the floor under every interval measured with them. The median of
+// samples attempts is used so a stray preemption does not skew the result.
+func CalibrateTimer(samples int) time.Duration {
+	if samples <= 0 {
+		samples = 1
+	}
+	observed := make([]time.Duration, samples, samples)
+	for ix := range observed {
+		start := time.Now()
+		observed[ix] = time.Now().Sub(start)
+	}
+	sort.Slice(observed, func(i, j int) bool { return observed[i] < observed[j] })
+	return observed[samples/2]
+}
@@ -0,0 +1,57 @@
+package Latency
+
+import (
+	"math"
+	"testing"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 1, 31, 32, 33, 1000, 123456789, math.MaxUint64 >> 1} {
+		lo, width := bucketRange(index(v))
+		if v < lo || v-lo >= width {
+			t.Errorf("%d landed in [%d, %d)", v, lo, lo+width)
+		}
+		if float64(width) > float64(v)/subBuckets && width > 1 {
+			t.Errorf("%d landed in a bucket %d wide", v, width)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	h := New()
+	for ns := 1; ns <= 1000; ns++ {
+		h.Record(float64(ns))
+	}
+	for _, tc := range []struct {
+		q        float64
+		expected float64
+	}{
+		{0.5, 500},
+		{0.9, 900},
+		{0.99, 990},
+		{1, 1000},
+	} {
+		actual := h.Quantile(tc.q)
+		if math.Abs(actual-tc.expected)/tc.expected > 1.0/subBuckets {
+			t.Errorf("p%v is %0.1f, expected about %0.1f", tc.q*100, actual, tc.expected)
+		}
+	}
+	if h.Count() != 1000 || h.Max() != 1000 || h.Mean() != 500.5 {
+		t.Errorf("count %d, max %0.1f, mean %0.1f", h.Count(), h.Max(), h.Mean())
+	}
+}
+
+func TestRecordNegative(t *testing.T) {
+	h := New()
+	h.Record(-5)
+	if h.Quantile(0.5) != 0 {
+		t.Errorf("negative observation was not clamped to zero")
+	}
+}
+
+func BenchmarkRecord(b *testing.B) {
+	h := New()
+	for i := 0; i < b.N; i++ {
+		h.Record(float64(i & 0xffff))
+	}
+}
@@ -3,9 +3,12 @@ package MaglevHashing
 import (
 	"fmt"
 	"math"
+	"math/bits"
 	"sort"
 
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
 	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
 )
 
 // bucketPrimes is a selection of prime numbers we can use as the bucket count.
@@ -41,18 +44,44 @@ type MaglevHasher struct {
 // buckets is the number of buckets to select from. sizeClass is the approximate
 // maximum number of buckets. Changing this number will completely reshuffle the
 // lookup table, which is bad if the buckets are supposed to represent machines
-// that could fail or something similar. This implementation only supports an
-// integer bucket count, but the algorithm supports removing arbitrary buckets
-// in the middle.
+// that could fail or something similar.
 func New(buckets int, sizeClass int) *MaglevHasher {
+	return NewWithMembership(Membership.Range(buckets), sizeClass)
+}
+
+// NewWithMembership creates a new MaglevHasher over any set of buckets, such
+// as one with buckets in the middle removed. Each bucket's preferences depend
+// only on its id, so the tables for similar memberships are similar, but not
+// as similar as they could be. The table holds ids as int16, so an id outside
+// 0 to math.MaxInt16 panics.
+func NewWithMembership(members Membership.Membership, sizeClass int) *MaglevHasher {
 	if sizeClass < 0 {
-		sizeClass = buckets
+		sizeClass = len(members)
 	}
 	bix := sort.SearchInts(bucketPrimes, 100*sizeClass)
 	if bix >= len(bucketPrimes) {
 		bix = len(bucketPrimes) - 1
 	}
-	tableSize := bucketPrimes[bix]
+	return &MaglevHasher{uint64(len(members)), buildTable(members, bucketPrimes[bix])}
+}
+
+// permutation returns the slot a bucket tries first and how far it steps
+// each time the slot it tries is taken. skip has to be in [1, tableSize).
+// Zero would never leave an occupied slot, and since tableSize is prime any
+// other value eventually visits every slot. skip used to be taken from the
+// same hash as offset, which made it equal offset, so a bucket starting on
+// slot 0 spun forever once that slot was taken.
+func permutation(bucket int, tableSize int) (int, int) {
+	offset := ObjectHasher.PlaceUInt64N(uint64(bucket), 1) % uint64(tableSize)
+	skip := ObjectHasher.PlaceUInt64N(uint64(bucket), 2)%uint64(tableSize-1) + 1
+	return int(offset), int(skip)
+}
+
+// buildTable fills a lookup table of tableSize slots with members
+func buildTable(members Membership.Membership, tableSize int) []int16 {
+	if n := len(members); n > 0 && (members[0] < 0 || members[n-1] > math.MaxInt16) {
+		panic(fmt.Sprintf("MaglevHasher buckets %d to %d do not fit in an int16", members[0], members[n-1]))
+	}
 	table := make([]int16, tableSize, tableSize)
 
 	// Initialize the table to -1, indicating that the slot is empty
@@ -62,25 +91,24 @@ func New(buckets int, sizeClass int) *MaglevHasher {
 
 	// each bucket gets an offset and a skip, which is used when choosing each
 	// bucket's preferred slot in the table
-	bucketGroup := make([][2]int, buckets, buckets)
-	for ix := 0; ix < buckets; ix++ {
-		offset := ObjectHasher.PlaceUInt64N(uint64(ix), 1) % uint64(tableSize)
-		skip := ObjectHasher.PlaceUInt64N(uint64(ix), 1) % uint64((tableSize-1)+1)
-		bucketGroup[ix] = [2]int{int(offset), int(skip)}
+	bucketGroup := make([][2]int, len(members), len(members))
+	for ix, bucket := range members {
+		offset, skip := permutation(bucket, tableSize)
+		bucketGroup[ix] = [2]int{offset, skip}
 	}
 
 	// go through each bucket, letting it take its first preferred, unoccupied slot
 	for ix := 0; ix < tableSize; ix++ {
-		bucket := ix % buckets
-		offset := bucketGroup[bucket][0]
-		skip := bucketGroup[bucket][1]
+		member := ix % len(members)
+		offset := bucketGroup[member][0]
+		skip := bucketGroup[member][1]
 		for table[offset] >= 0 {
 			offset = (offset + skip) % tableSize
 		}
-		table[offset] = int16(bucket)
-		bucketGroup[bucket][0] = (offset + skip) % tableSize
+		table[offset] = int16(members[member])
+		bucketGroup[member][0] = (offset + skip) % tableSize
 	}
-	return &MaglevHasher{uint64(buckets), table}
+	return table
 }
 
 // MapBucket returns the target bucket for a given object hash
@@ -88,15 +116,137 @@ func (mh *MaglevHasher) MapBucket(location uint64) int {
 	return int(mh.lookupTable[(location % uint64(len(mh.lookupTable)))])
 }
 
-// ExpectedMoveRate is the rate we would expect random elements to move given
-// the current size of the MaglevHasher and an alternative size.
-func (mh *MaglevHasher) ExpectedMoveRate(otherSize int) float64 {
-	otherSize++
-	buckets := int(mh.Buckets + 1)
-	return math.Abs(float64(otherSize-buckets)) / float64(buckets)
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations. Nearly all of a lookup is the 64-bit
+// division for the slot, so the batch works out one reciprocal of the table
+// size and takes each remainder with multiplies.
+func (mh *MaglevHasher) MapBatch(locations []uint64, out []int) {
+	table := mh.lookupTable
+	fm := newFastMod(uint64(len(table)))
+	for ix, location := range locations {
+		out[ix] = int(table[fm.mod(location)])
+	}
+}
+
+// fastMod takes remainders by a fixed divisor d with a 128-bit reciprocal
+// c = ceil(2^128/d). The low 128 bits of c*a are the fraction a/d, and
+// multiplying that by d and keeping the top 64 bits gives a%d exactly for any
+// 64-bit a and d.
+// https://arxiv.org/abs/1902.01961
+type fastMod struct {
+	d, cHi, cLo uint64
+}
+
+func newFastMod(d uint64) fastMod {
+	// c is floor((2^128-1)/d)+1, wrapping to 0 for d=1, which still works
+	hi, rem := ^uint64(0)/d, ^uint64(0)%d
+	lo, _ := bits.Div64(rem, ^uint64(0), d)
+	lo, carry := bits.Add64(lo, 1, 0)
+	return fastMod{d, hi + carry, lo}
+}
+
+func (fm fastMod) mod(a uint64) uint64 {
+	fracHi, fracLo := bits.Mul64(fm.cLo, a)
+	fracHi += fm.cHi * a
+	top, _ := bits.Mul64(fracLo, fm.d)
+	hi, lo := bits.Mul64(fracHi, fm.d)
+	_, carry := bits.Add64(lo, top, 0)
+	return hi + carry
+}
+
+// ExpectedMoveRate is the rate we would expect random elements to move going
+// from one membership to another with this table size. Maglev trades some
+// extra movement for even tables, and how much depends on the order buckets
+// claim slots in, so rather than model it, this builds both tables and
+// counts the slots that changed.
+func (mh *MaglevHasher) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	if len(from) == 0 || len(to) == 0 {
+		return Membership.MinimalMoveRate(from, to)
+	}
+	a := buildTable(from, len(mh.lookupTable))
+	b := buildTable(to, len(mh.lookupTable))
+	changed := 0
+	for ix := range a {
+		if a[ix] != b[ix] {
+			changed++
+		}
+	}
+	return float64(changed) / float64(len(a))
 }
 
 // Name tells yo who we are
 func (mh *MaglevHasher) Name() string {
 	return fmt.Sprintf("MaglevHasher[%d]", mh.Buckets)
 }
+
+// SnapshotKind identifies MaglevHasher snapshots
+const SnapshotKind = "MaglevHasher"
+
+const snapshotVersion = 1
+
+type maglevState struct {
+	Buckets uint64  `json:"buckets"`
+	Table   []int16 `json:"table"`
+}
+
+// restore checks and installs decoded fields
+func (mh *MaglevHasher) restore(buckets uint64, table []int16) error {
+	if len(table) == 0 {
+		return fmt.Errorf("snapshot has an empty table")
+	}
+	for ix, b := range table {
+		if b < 0 {
+			return fmt.Errorf("snapshot table slot %d is empty", ix)
+		}
+	}
+	*mh = MaglevHasher{buckets, table}
+	return nil
+}
+
+// MarshalBinary encodes the MaglevHasher, table and all, as a versioned
+// snapshot
+func (mh *MaglevHasher) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(mh.Buckets)
+	e.Uint64(uint64(len(mh.lookupTable)))
+	for _, b := range mh.lookupTable {
+		e.Uint64(uint64(b))
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the MaglevHasher with the one in a snapshot
+func (mh *MaglevHasher) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	buckets := d.Uint64()
+	table := make([]int16, d.Len(1))
+	for ix := range table {
+		b := d.Uint64()
+		if b > math.MaxInt16 {
+			d.Fail("snapshot table slot %d has bucket %d", ix, b)
+		}
+		table[ix] = int16(b)
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return mh.restore(buckets, table)
+}
+
+// MarshalJSON encodes the MaglevHasher, table and all, as a versioned
+// snapshot
+func (mh *MaglevHasher) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, maglevState{mh.Buckets, mh.lookupTable})
+}
+
+// UnmarshalJSON replaces the MaglevHasher with the one in a snapshot
+func (mh *MaglevHasher) UnmarshalJSON(data []byte) error {
+	state := maglevState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return mh.restore(state.Buckets, state.Table)
+}
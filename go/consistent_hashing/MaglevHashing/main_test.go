@@ -0,0 +1,270 @@
+package MaglevHashing
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+)
+
+func TestLookupTableBalanced(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		mh := New(size, size)
+		counts := make([]int, size, size)
+		for ix, bucket := range mh.lookupTable {
+			if bucket < 0 || int(bucket) >= size {
+				t.Fatalf("size %d: slot %d holds %d", size, ix, bucket)
+			}
+			counts[bucket]++
+		}
+		min, max := counts[0], counts[0]
+		for _, c := range counts {
+			if c < min {
+				min = c
+			}
+			if c > max {
+				max = c
+			}
+		}
+		if max-min > 1 {
+			t.Errorf("size %d: buckets hold between %d and %d slots", size, min, max)
+		}
+	}
+}
+
+// New used to derive skip from the same hash as offset, without keeping it
+// above zero. A bucket whose first choice was taken would then spin forever,
+// which happened at 256 buckets with a size class of 257.
+func TestNewTerminates(t *testing.T) {
+	for size := 200; size <= 300; size++ {
+		New(size, size+1)
+	}
+}
+
+func TestMapBucketDeterministic(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Same(t, New(size, size), New(size, size), MapperTest.Locations(1000))
+	}
+}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Range(t, New(size, size), size)
+	}
+}
+
+// Maglev does not promise minimal disruption, but growing by one bucket with
+// a fixed size class should still only move a small multiple of the minimum.
+func TestBoundedDisruption(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		from, to := New(size, size+1), New(size+1, size+1)
+		locs := MapperTest.Locations(20000)
+		moved := 0
+		for _, location := range locs {
+			if from.MapBucket(location) != to.MapBucket(location) {
+				moved++
+			}
+		}
+		minimum := Membership.MinimalMoveRate(Membership.Range(size), Membership.Range(size+1))
+		actual := float64(moved) / float64(len(locs))
+		if actual < minimum*0.8 || actual > minimum*10 {
+			t.Errorf("size %d: %0.4f moved, minimum is %0.4f", size, actual, minimum)
+		}
+	}
+}
+
+func TestExpectedMoveRate(t *testing.T) {
+	from := Membership.Range(50)
+	for _, to := range []Membership.Membership{
+		from.With(50),
+		from.Without(49),
+		from.Without(20),
+		from.Without(3).With(77),
+	} {
+		a, b := NewWithMembership(from, 50), NewWithMembership(to, 50)
+		locs := MapperTest.Locations(50000)
+		moved := 0
+		for _, location := range locs {
+			if a.MapBucket(location) != b.MapBucket(location) {
+				moved++
+			}
+		}
+		expected := a.ExpectedMoveRate(from, to)
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.01 {
+			t.Errorf("%v: %0.4f moved, expected %0.4f", to, actual, expected)
+		}
+		// taking a bucket from the middle changes the order buckets claim
+		// slots in, so it costs more than the minimum
+		if minimum := Membership.MinimalMoveRate(from, to); expected < minimum {
+			t.Errorf("%v: expected %0.4f, below the minimum %0.4f", to, expected, minimum)
+		}
+	}
+}
+
+func TestNewWithMembership(t *testing.T) {
+	members := Membership.Range(20).Without(3, 11)
+	mh := NewWithMembership(members, 20)
+	for _, location := range MapperTest.Locations(10000) {
+		if b := mh.MapBucket(location); !members.Contains(b) {
+			t.Fatalf("%x mapped to %d, not a member", location, b)
+		}
+	}
+	if a, b := New(20, 20), NewWithMembership(Membership.Range(20), 20); len(a.lookupTable) != len(b.lookupTable) {
+		t.Fatalf("tables of %d and %d", len(a.lookupTable), len(b.lookupTable))
+	}
+}
+
+// TestInt16Buckets checks that ids the table cannot hold are refused rather
+// than wrapped
+func TestInt16Buckets(t *testing.T) {
+	for _, members := range []Membership.Membership{{1, math.MaxInt16 + 1}, {-1, 2}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v accepted", members)
+				}
+			}()
+			NewWithMembership(members, 2)
+		}()
+	}
+	if mh := NewWithMembership(Membership.Membership{0, math.MaxInt16}, 2); mh.MapBucket(1) < 0 {
+		t.Errorf("bucket %d wrapped", math.MaxInt16)
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range MapperTest.Sizes {
+		mh := New(size, size)
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				mh.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.SnapshotRoundTrip(t, New(size, size), func() MapperTest.Snapshotter { return &MaglevHasher{} })
+	}
+}
+
+func TestFastMod(t *testing.T) {
+	divisors := []uint64{1, 2, 3, 7, 8, 65537, 1 << 32, 1<<32 + 1, math.MaxUint64 - 1, math.MaxUint64}
+	values := append([]uint64{0, 1, 2, 1<<32 - 1, 1 << 32, math.MaxUint64 - 1, math.MaxUint64}, MapperTest.Locations(1000)...)
+	for _, d := range divisors {
+		fm := newFastMod(d)
+		for _, v := range values {
+			if fm.mod(v) != v%d {
+				t.Fatalf("%d mod %d came out %d, expected %d", v, d, fm.mod(v), v%d)
+			}
+		}
+	}
+	for _, d := range MapperTest.Locations(1000) {
+		fm := newFastMod(d)
+		for _, v := range values[:20] {
+			if fm.mod(v) != v%d {
+				t.Fatalf("%d mod %d came out %d, expected %d", v, d, fm.mod(v), v%d)
+			}
+		}
+	}
+}
+
+func BenchmarkMapBatch(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	out := make([]int, len(locs), len(locs))
+	for _, size := range MapperTest.Sizes {
+		mh := New(size, size)
+		b.Run(fmt.Sprintf("buckets=%d/scalar", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				out[i&1023] = mh.MapBucket(locs[i&1023])
+			}
+		})
+		b.Run(fmt.Sprintf("buckets=%d/batch", size), func(b *testing.B) {
+			for i := 0; i < b.N; i += len(locs) {
+				mh.MapBatch(locs, out)
+			}
+		})
+	}
+}
+
+// At a size class of 257 the table has 26003 slots and bucket 11 starts on
+// slot 0. The old permutation gave it a skip of 0 as well, which is where New
+// hung. Every bucket needs a skip it can actually step with.
+func TestPermutationSkip(t *testing.T) {
+	if _, skip := legacyPermutation(11, 26003); skip != 0 {
+		t.Fatalf("legacy skip for bucket 11 is %d, expected 0", skip)
+	}
+	for _, tableSize := range []int{2, 3, 26003, bucketPrimes[len(bucketPrimes)-1]} {
+		for bucket := 0; bucket < 300; bucket++ {
+			offset, skip := permutation(bucket, tableSize)
+			if offset < 0 || offset >= tableSize || skip < 1 || skip >= tableSize {
+				t.Fatalf("table %d bucket %d: offset %d, skip %d", tableSize, bucket, offset, skip)
+			}
+		}
+	}
+}
+
+// Giving skip its own hash reshuffled every table that used to build, not
+// just the ones that hung. These pin where a few keys went before and after,
+// so any further change to the permutation shows up here. The keys are
+// string hashes rather than MapperTest.Locations, which share a hash with
+// the offsets and land on bucket i at 100 buckets either way.
+func TestPermutationPlacements(t *testing.T) {
+	cases := []struct {
+		buckets       int
+		before, after []int
+	}{
+		{7, []int{5, 0, 4, 6, 1, 5, 6, 4}, []int{3, 1, 1, 5, 4, 2, 0, 5}},
+		{100, []int{41, 61, 37, 50, 78, 59, 51, 40}, []int{17, 59, 70, 44, 16, 14, 31, 6}},
+	}
+	for _, c := range cases {
+		mh := New(c.buckets, c.buckets)
+		old := legacyTable(Membership.Range(c.buckets), len(mh.lookupTable))
+		for ix := range c.after {
+			location := ObjectHasher.PlaceString(fmt.Sprintf("key-%d", ix))
+			if got := int(old[location%uint64(len(old))]); got != c.before[ix] {
+				t.Errorf("%d buckets, key-%d: legacy table gives %d, expected %d", c.buckets, ix, got, c.before[ix])
+			}
+			if got := mh.MapBucket(location); got != c.after[ix] {
+				t.Errorf("%d buckets, key-%d: got %d, expected %d", c.buckets, ix, got, c.after[ix])
+			}
+		}
+	}
+}
+
+// legacyPermutation is how New picked each bucket's offset and skip before
+// skip got its own hash. Both come out the same, and skip can be 0.
+func legacyPermutation(bucket int, tableSize int) (int, int) {
+	offset := int(ObjectHasher.PlaceUInt64N(uint64(bucket), 1) % uint64(tableSize))
+	return offset, offset
+}
+
+// legacyTable fills a table the way buildTable does, but with
+// legacyPermutation. It only terminates for memberships where no bucket gets
+// a skip of 0.
+func legacyTable(members Membership.Membership, tableSize int) []int16 {
+	table := make([]int16, tableSize)
+	for ix := range table {
+		table[ix] = -1
+	}
+	next := make([][2]int, len(members))
+	for ix, bucket := range members {
+		offset, skip := legacyPermutation(bucket, tableSize)
+		next[ix] = [2]int{offset, skip}
+	}
+	for ix := 0; ix < tableSize; ix++ {
+		member := ix % len(members)
+		offset, skip := next[member][0], next[member][1]
+		for table[offset] >= 0 {
+			offset = (offset + skip) % tableSize
+		}
+		table[offset] = int16(members[member])
+		next[member][0] = (offset + skip) % tableSize
+	}
+	return table
+}
@@ -0,0 +1,159 @@
+package MapperTest
+
+import (
+	"encoding"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+)
+
+// Sizes are the bucket counts the package tests run over
+var Sizes = []int{1, 2, 7, 8, 100, 1024}
+
+// Mapper is what the checks need of a mapper. The checks are the ones every
+// mapper package's tests share, so each package only spells out what is
+// particular to it.
+type Mapper interface {
+	MapBucket(location uint64) int
+	ExpectedMoveRate(from, to Membership.Membership) float64
+	Name() string
+}
+
+// Locations returns the hashes of the first n keys
+func Locations(n int) []uint64 {
+	locs := make([]uint64, n, n)
+	for ix := range locs {
+		locs[ix] = ObjectHasher.PlaceUInt64N(uint64(ix), 1)
+	}
+	return locs
+}
+
+// MapAll maps every location
+func MapAll(m Mapper, locs []uint64) []int {
+	placed := make([]int, len(locs), len(locs))
+	for ix, location := range locs {
+		placed[ix] = m.MapBucket(location)
+	}
+	return placed
+}
+
+// Range checks that a mapper with size buckets maps keys onto 0 to size-1,
+// and that every bucket gets some of them
+func Range(t *testing.T, m Mapper, size int) {
+	t.Helper()
+	seen := make([]int, size, size)
+	for _, location := range append(Locations(100*size), 0, math.MaxUint64) {
+		bucket := m.MapBucket(location)
+		if bucket < 0 || bucket >= size {
+			t.Fatalf("%s: %x mapped to %d", m.Name(), location, bucket)
+		}
+		seen[bucket]++
+	}
+	for bucket, cnt := range seen {
+		if cnt == 0 {
+			t.Errorf("%s: bucket %d never used", m.Name(), bucket)
+		}
+	}
+}
+
+// Same checks that two mappers place every location on the same bucket
+func Same(t *testing.T, a, b Mapper, locs []uint64) {
+	t.Helper()
+	for _, location := range locs {
+		if x, y := a.MapBucket(location), b.MapBucket(location); x != y {
+			t.Fatalf("%s: %x mapped to %d and %d", a.Name(), location, x, y)
+		}
+	}
+}
+
+// Growth checks that going from size buckets to size+1 only moves keys to
+// the new bucket, and moves as many as from expects to within tolerance
+func Growth(t *testing.T, from, to Mapper, size int, tolerance float64) {
+	t.Helper()
+	locs := Locations(20000)
+	moved := 0
+	for _, location := range locs {
+		a, b := from.MapBucket(location), to.MapBucket(location)
+		if a == b {
+			continue
+		}
+		moved++
+		if b != size {
+			t.Fatalf("%s: %x moved from %d to %d, not the new bucket", to.Name(), location, a, b)
+		}
+	}
+	expected := from.ExpectedMoveRate(Membership.Range(size), Membership.Range(size+1))
+	if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > tolerance {
+		t.Errorf("%s: %0.4f moved, expected %0.4f", to.Name(), actual, expected)
+	}
+}
+
+// Batcher is a mapper that can place many keys at once
+type Batcher interface {
+	MapBucket(location uint64) int
+	MapBatch(locations []uint64, out []int)
+	Name() string
+}
+
+// Batch checks that a mapper batches locs onto the same buckets it maps them
+// to one at a time, writes nothing past the end of the batch, and takes an
+// empty batch
+func Batch(t *testing.T, m Batcher, locs []uint64) {
+	t.Helper()
+	out := make([]int, len(locs)+1, len(locs)+1)
+	out[len(locs)] = -7
+	m.MapBatch(locs, out)
+	for ix, location := range locs {
+		if expected := m.MapBucket(location); out[ix] != expected {
+			t.Fatalf("%s: %x batched to %d, expected %d", m.Name(), location, out[ix], expected)
+		}
+	}
+	if out[len(locs)] != -7 {
+		t.Fatalf("%s: batch wrote past the locations", m.Name())
+	}
+	m.MapBatch(nil, out)
+	m.MapBatch(locs[:0], out[:0])
+}
+
+// Snapshotter is a Mapper that can be saved and restored
+type Snapshotter interface {
+	Mapper
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// SnapshotRoundTrip saves original as a binary and a JSON snapshot, restores
+// each into a mapper from empty, and checks that both place keys the same as
+// the original and that a damaged binary snapshot is refused. The restored
+// mappers are returned for any checks particular to the package.
+func SnapshotRoundTrip(t *testing.T, original Snapshotter, empty func() Snapshotter) (fromBinary, fromJSON Snapshotter) {
+	t.Helper()
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%s: %v", original.Name(), err)
+	}
+	fromBinary = empty()
+	if err := fromBinary.UnmarshalBinary(data); err != nil {
+		t.Fatalf("%s: %v", original.Name(), err)
+	}
+	js, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("%s: %v", original.Name(), err)
+	}
+	fromJSON = empty()
+	if err := json.Unmarshal(js, fromJSON); err != nil {
+		t.Fatalf("%s: %v", original.Name(), err)
+	}
+	locs := Locations(5000)
+	Same(t, original, fromBinary, locs)
+	Same(t, original, fromJSON, locs)
+
+	data[len(data)/2] ^= 1
+	if err := empty().UnmarshalBinary(data); err == nil {
+		t.Errorf("%s: corrupt snapshot accepted", original.Name())
+	}
+	return fromBinary, fromJSON
+}
@@ -0,0 +1,149 @@
+package Membership
+
+import (
+	"math"
+	"sort"
+)
+
+// Membership is the set of buckets in service, as sorted, distinct ids. Ids
+// are whatever a mapper hands out: 0 to n-1 for a fresh mapper, with gaps
+// once buckets in the middle are removed.
+type Membership []int
+
+// Range is the membership of a fresh mapper with n buckets
+func Range(n int) Membership {
+	m := make(Membership, n, n)
+	for ix := range m {
+		m[ix] = ix
+	}
+	return m
+}
+
+// New makes a Membership from buckets in any order, dropping duplicates
+func New(buckets ...int) Membership {
+	m := append(Membership{}, buckets...)
+	sort.Ints(m)
+	out := m[:0]
+	for ix, b := range m {
+		if ix == 0 || b != m[ix-1] {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// IndexOf returns the position of bucket in m, or -1 if it is not a member
+func (m Membership) IndexOf(bucket int) int {
+	ix := sort.SearchInts(m, bucket)
+	if ix < len(m) && m[ix] == bucket {
+		return ix
+	}
+	return -1
+}
+
+// Contains says whether bucket is a member
+func (m Membership) Contains(bucket int) bool {
+	return m.IndexOf(bucket) >= 0
+}
+
+// IsRange says whether m is 0 to len(m)-1 with no gaps
+func (m Membership) IsRange() bool {
+	return len(m) == 0 || (m[0] == 0 && m[len(m)-1] == len(m)-1)
+}
+
+// Without returns a copy of m with buckets taken out
+func (m Membership) Without(buckets ...int) Membership {
+	drop := New(buckets...)
+	out := make(Membership, 0, len(m))
+	for _, b := range m {
+		if !drop.Contains(b) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// With returns a copy of m with buckets added
+func (m Membership) With(buckets ...int) Membership {
+	return New(append(append([]int{}, m...), buckets...)...)
+}
+
+// Common counts the buckets in both a and b
+func Common(a, b Membership) int {
+	common := 0
+	for ix, jx := 0, 0; ix < len(a) && jx < len(b); {
+		switch {
+		case a[ix] < b[jx]:
+			ix++
+		case a[ix] > b[jx]:
+			jx++
+		default:
+			common++
+			ix++
+			jx++
+		}
+	}
+	return common
+}
+
+// MinimalMoveRate is the least any mapper can move going from one membership
+// to another while staying balanced. Each common bucket can keep at most the
+// smaller of its two shares, everything else has to move.
+func MinimalMoveRate(from, to Membership) float64 {
+	if len(from) == 0 && len(to) == 0 {
+		return 0
+	}
+	return 1 - float64(Common(from, to))/math.Max(float64(len(from)), float64(len(to)))
+}
+
+// JaccardMoveRate is the move rate of mappers where each key goes to the best
+// scoring bucket and a bucket's scores do not depend on who else is a member:
+// rendezvous hashing, rings, and anything removing buckets by redrawing.
+// Taking the best bucket over both memberships together, a key stays exactly
+// when that bucket is in both, so it moves at one minus the Jaccard index.
+// That is minimal when buckets are only added or only removed, but not when
+// some are swapped for others.
+func JaccardMoveRate(from, to Membership) float64 {
+	common := Common(from, to)
+	union := len(from) + len(to) - common
+	if union == 0 {
+		return 0
+	}
+	return 1 - float64(common)/float64(union)
+}
+
+// RangeMoveRate is the move rate of mappers that can only grow and shrink at
+// the top, like JumpHash, when serving a membership by position: the ith
+// member is bucket i. Growing from n to m positions keeps keys below n where
+// they are and takes the keys for each new position evenly from the old
+// ones. A key stays if the members at its two positions are the same bucket,
+// which for anything other than adding or removing at the top end means most
+// keys move.
+func RangeMoveRate(from, to Membership) float64 {
+	small, large := from, to
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	if len(small) == 0 {
+		if len(large) == 0 {
+			return 0
+		}
+		return 1
+	}
+	// keys in the first len(small) positions keep their position
+	same := 0
+	for ix := range small {
+		if small[ix] == large[ix] {
+			same++
+		}
+	}
+	// keys in the positions past that came evenly from all of the first ones
+	crossed := 0
+	for _, b := range large[len(small):] {
+		if small.Contains(b) {
+			crossed++
+		}
+	}
+	n, m := float64(len(small)), float64(len(large))
+	return 1 - (float64(same)+float64(crossed)/n)/m
+}
@@ -0,0 +1,57 @@
+package Membership
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	if m := New(5, 1, 3, 1, 5); !reflect.DeepEqual(m, Membership{1, 3, 5}) {
+		t.Errorf("got %v", m)
+	}
+	if m := Range(4); !reflect.DeepEqual(m, Membership{0, 1, 2, 3}) || !m.IsRange() {
+		t.Errorf("got %v", m)
+	}
+	if m := Range(4).Without(2, 7); !reflect.DeepEqual(m, Membership{0, 1, 3}) || m.IsRange() {
+		t.Errorf("got %v", m)
+	}
+	if m := Range(4).Without(3); !m.IsRange() {
+		t.Errorf("%v is a range", m)
+	}
+	if m := New(1, 3).With(2, 3); !reflect.DeepEqual(m, Membership{1, 2, 3}) {
+		t.Errorf("got %v", m)
+	}
+	if m := New(1, 3); m.IndexOf(3) != 1 || m.IndexOf(2) != -1 || !m.Contains(1) || m.Contains(0) {
+		t.Errorf("lookups in %v", m)
+	}
+}
+
+func TestMoveRates(t *testing.T) {
+	for _, tc := range []struct {
+		from, to                     Membership
+		minimal, jaccard, positional float64
+	}{
+		// growing at the top is minimal for everyone
+		{Range(8), Range(9), 1.0 / 9, 1.0 / 9, 1.0 / 9},
+		{Range(9), Range(8), 1.0 / 9, 1.0 / 9, 1.0 / 9},
+		// removing 2 of 0-4 shifts 3 and 4 down a position, leaving 2 in
+		// place and a quarter of the keys at position 4 on 3
+		{Range(5), Range(5).Without(2), 1.0 / 5, 1.0 / 5, 1 - (2+1.0/4)/5},
+		// swapping one bucket for another
+		{Range(4), Range(4).Without(1).With(9), 1.0 / 4, 1 - 3.0/5, 1 - 1.0/4},
+		{Range(4), Range(4), 0, 0, 0},
+		{Membership{}, Membership{}, 0, 0, 0},
+		{Membership{}, Range(3), 1, 1, 1},
+	} {
+		if actual := MinimalMoveRate(tc.from, tc.to); math.Abs(actual-tc.minimal) > 1e-12 {
+			t.Errorf("%v -> %v: minimal %f, expected %f", tc.from, tc.to, actual, tc.minimal)
+		}
+		if actual := JaccardMoveRate(tc.from, tc.to); math.Abs(actual-tc.jaccard) > 1e-12 {
+			t.Errorf("%v -> %v: jaccard %f, expected %f", tc.from, tc.to, actual, tc.jaccard)
+		}
+		if actual := RangeMoveRate(tc.from, tc.to); math.Abs(actual-tc.positional) > 1e-12 {
+			t.Errorf("%v -> %v: positional %f, expected %f", tc.from, tc.to, actual, tc.positional)
+		}
+	}
+}
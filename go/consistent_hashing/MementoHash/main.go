@@ -0,0 +1,208 @@
+package MementoHash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// replacement records a removed bucket. replacer is both the number of
+// working buckets just after the removal and the bucket that took the
+// removed one's place. prev is the bucket removed before this one.
+type replacement struct {
+	replacer int
+	prev     int
+}
+
+// MementoHash is JumpHash plus a memento of removed buckets, so buckets can
+// be removed from the middle and not just the top. Keys of a removed bucket
+// are rehashed into the buckets that were working when it was removed;
+// nothing else moves. With no removals it is exactly JumpHash.
+// https://arxiv.org/pdf/2306.09783.pdf
+type MementoHash struct {
+	jump    *JumpHash.JumpHash
+	size    int
+	memento map[int]replacement
+	last    int
+}
+
+// New makes a new MementoHash with buckets working buckets
+func New(buckets int) *MementoHash {
+	return &MementoHash{JumpHash.New(buckets), buckets, map[int]replacement{}, -1}
+}
+
+// MapBucket returns the target bucket for a given object hash
+func (mh *MementoHash) MapBucket(location uint64) int {
+	b := mh.jump.MapBucket(location)
+	r, removed := mh.memento[b]
+	if !removed {
+		return b
+	}
+
+	var lb [8]byte
+	binary.LittleEndian.PutUint64(lb[:], location)
+	for removed {
+		// pick among the buckets working when b was removed. Any of those
+		// removed even earlier have a replacer of at least r.replacer, and
+		// were stood in for by their replacer at that point.
+		h := int(xxhash.Checksum64S(lb[:], uint64(b)) % uint64(r.replacer))
+		for hr, ok := mh.memento[h]; ok && hr.replacer >= r.replacer; hr, ok = mh.memento[h] {
+			h = hr.replacer
+		}
+		b = h
+		r, removed = mh.memento[b]
+	}
+	return b
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (mh *MementoHash) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = mh.MapBucket(location)
+	}
+}
+
+// Add brings back the most recently removed bucket, or grows by one if
+// nothing has been removed, and returns the bucket added
+func (mh *MementoHash) Add() int {
+	if mh.last < 0 {
+		mh.size++
+		mh.jump = JumpHash.New(mh.size)
+		return mh.size - 1
+	}
+	b := mh.last
+	mh.last = mh.memento[b].prev
+	delete(mh.memento, b)
+	return b
+}
+
+// Remove takes a working bucket out of service. Only keys that were mapped to
+// it move. It reports false if the bucket was not working or is the last one.
+func (mh *MementoHash) Remove(bucket int) bool {
+	if bucket < 0 || bucket >= mh.size || mh.Working() <= 1 {
+		return false
+	}
+	if _, ok := mh.memento[bucket]; ok {
+		return false
+	}
+	if bucket == mh.size-1 && mh.last < 0 {
+		// nothing removed yet, so plain JumpHash can shrink
+		mh.size--
+		mh.jump = JumpHash.New(mh.size)
+		return true
+	}
+	mh.memento[bucket] = replacement{mh.Working() - 1, mh.last}
+	mh.last = bucket
+	return true
+}
+
+// Working returns the number of working buckets
+func (mh *MementoHash) Working() int {
+	return mh.size - len(mh.memento)
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. Removals only move the removed bucket's keys and growth at the top
+// is JumpHash's, so the change is minimal in both directions.
+func (mh *MementoHash) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
+}
+
+// Name tells you who we are
+func (mh *MementoHash) Name() string {
+	return fmt.Sprintf("MementoHash[%d/%d]", mh.Working(), mh.size)
+}
+
+// SnapshotKind identifies MementoHash snapshots
+const SnapshotKind = "MementoHash"
+
+const snapshotVersion = 1
+
+type mementoState struct {
+	Size    int   `json:"size"`
+	Removed []int `json:"removed"`
+}
+
+// removals lists the removed buckets, oldest first
+func (mh *MementoHash) removals() []int {
+	removed := make([]int, len(mh.memento), len(mh.memento))
+	for b, ix := mh.last, len(removed)-1; b >= 0; b, ix = mh.memento[b].prev, ix-1 {
+		removed[ix] = b
+	}
+	return removed
+}
+
+// restore rebuilds a MementoHash by replaying its removals. Each replacement
+// only depends on how many buckets were working at the time, so the memento
+// comes out the same.
+func (mh *MementoHash) restore(state mementoState) error {
+	// only the removals take memory, but JumpHash cannot go past an int32
+	if state.Size > math.MaxInt32 {
+		return fmt.Errorf("snapshot size %d does not fit in an int32", state.Size)
+	}
+	if state.Size < 1 || len(state.Removed) >= state.Size {
+		return fmt.Errorf("snapshot has %d of %d buckets removed", len(state.Removed), state.Size)
+	}
+	restored := New(state.Size)
+	for _, b := range state.Removed {
+		if b == restored.size-1 && restored.last < 0 {
+			// Remove would shrink instead, which the original could not
+			// have done and still had this size
+			return fmt.Errorf("snapshot removes top bucket %d first", b)
+		}
+		if !restored.Remove(b) {
+			return fmt.Errorf("snapshot cannot remove bucket %d", b)
+		}
+	}
+	*mh = *restored
+	return nil
+}
+
+// MarshalBinary encodes the MementoHash as a versioned snapshot
+func (mh *MementoHash) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(mh.size)
+	removed := mh.removals()
+	e.Uint64(uint64(len(removed)))
+	for _, b := range removed {
+		e.Int(b)
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the MementoHash with the one in a snapshot
+func (mh *MementoHash) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := mementoState{Size: d.Int()}
+	state.Removed = make([]int, d.Len(1))
+	for ix := range state.Removed {
+		state.Removed[ix] = d.Int()
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return mh.restore(state)
+}
+
+// MarshalJSON encodes the MementoHash as a versioned snapshot
+func (mh *MementoHash) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, mementoState{mh.size, mh.removals()})
+}
+
+// UnmarshalJSON replaces the MementoHash with the one in a snapshot
+func (mh *MementoHash) UnmarshalJSON(data []byte) error {
+	state := mementoState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return mh.restore(state)
+}
@@ -0,0 +1,211 @@
+package MemoryAccounting
+
+import (
+	"reflect"
+	"runtime"
+	"sort"
+	"unsafe"
+)
+
+// chanHeaderSize is the size of runtime.hchan on 64-bit platforms. Maps are
+// laid out differently depending on the Go release, so their sizes are worked
+// out in map_swiss.go and map_buckets.go.
+const chanHeaderSize = 96
+
+// span is a half-open range of addresses that has already been counted
+type span struct {
+	lo, hi uintptr
+}
+
+// accountant remembers what has been counted. Pointers, slices and strings
+// are tracked as address ranges because they can overlap: two slices of one
+// backing array, or a pointer to an element of a counted slice, must not be
+// counted twice. Maps and channels are opaque, so they are tracked by address.
+type accountant struct {
+	spans  []span
+	opaque map[uintptr]bool
+}
+
+// Sizeof returns the estimated memory usage of object(s) not just the size of
+// the type. Anything reachable through pointers, slices, strings, maps,
+// channels or interfaces is counted once, no matter how many references to it
+// there are, so shared and cyclic structures are handled. Unexported fields
+// are followed the same as exported ones.
+// On 64bit Sizeof("test") == 20 (16 = sizeof(StringHeader) + 4 bytes).
+func Sizeof(objs ...interface{}) (sz uint64) {
+	a := accountant{opaque: map[uintptr]bool{}}
+	for i := range objs {
+		if objs[i] == nil {
+			continue
+		}
+		val := reflect.ValueOf(objs[i])
+		sz += uint64(val.Type().Size()) + a.indirect(val)
+	}
+	return
+}
+
+// Measure calls build and returns both the Sizeof estimate for what it built
+// and the growth of the live heap across the call, as seen by the runtime.
+// The measurement includes anything else allocated and retained while build
+// ran, and the estimate does not know about allocator size classes, so the two
+// agreeing to within a few percent is as good as it gets.
+func Measure(build func() interface{}) (estimate uint64, measured int64) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	obj := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	estimate = Sizeof(obj)
+	runtime.KeepAlive(obj)
+	return estimate, int64(after.HeapAlloc) - int64(before.HeapAlloc)
+}
+
+// cover records [addr, addr+size) as counted and returns how many of those
+// bytes had not been counted before
+func (a *accountant) cover(addr uintptr, size uintptr) uint64 {
+	lo, hi := addr, addr+size
+	// the first span that ends at or after lo is the first that can touch
+	ix := sort.Search(len(a.spans), func(i int) bool { return a.spans[i].hi >= lo })
+	jx := ix
+	covered := uintptr(0)
+	for ; jx < len(a.spans) && a.spans[jx].lo <= hi; jx++ {
+		s := a.spans[jx]
+		covered += min(s.hi, hi) - max(s.lo, lo)
+		lo, hi = min(s.lo, lo), max(s.hi, hi)
+	}
+	a.spans = append(a.spans[:ix], append([]span{{lo, hi}}, a.spans[jx:]...)...)
+	return uint64(size - covered)
+}
+
+// first records an opaque object as counted and reports whether this was the
+// first time
+func (a *accountant) first(addr uintptr) bool {
+	if a.opaque[addr] {
+		return false
+	}
+	a.opaque[addr] = true
+	return true
+}
+
+func min(a, b uintptr) uintptr {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b uintptr) uintptr {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// indirect is the memory reachable from val, not counting val itself
+func (a *accountant) indirect(val reflect.Value) (sz uint64) {
+	typ := val.Type()
+	if !hasPointers(typ) {
+		return 0
+	}
+
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			break
+		}
+		// once every byte has been counted, so has everything it refers to
+		size := typ.Elem().Size()
+		added := a.cover(val.Pointer(), size)
+		if added == 0 && size > 0 {
+			break
+		}
+		sz += added + a.indirect(val.Elem())
+
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			sz += a.indirect(val.Field(i))
+		}
+
+	case reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			sz += a.indirect(val.Index(i))
+		}
+
+	case reflect.Slice:
+		if val.IsNil() || val.Cap() == 0 {
+			break
+		}
+		// everything up to cap is allocated, not just the visible part
+		size := uintptr(val.Cap()) * typ.Elem().Size()
+		added := a.cover(val.Pointer(), size)
+		if added == 0 && size > 0 {
+			break
+		}
+		sz += added
+		val = val.Slice(0, val.Cap())
+		for i := 0; i < val.Len(); i++ {
+			sz += a.indirect(val.Index(i))
+		}
+
+	case reflect.String:
+		s := val.String()
+		if len(s) == 0 {
+			break
+		}
+		sz += a.cover((*reflect.StringHeader)(unsafe.Pointer(&s)).Data, uintptr(len(s)))
+
+	case reflect.Map:
+		if val.IsNil() || !a.first(val.Pointer()) {
+			break
+		}
+		sz += mapSize(typ, val.Len())
+		iter := val.MapRange()
+		for iter.Next() {
+			sz += a.indirect(iter.Key()) + a.indirect(iter.Value())
+		}
+
+	case reflect.Chan:
+		if val.IsNil() || !a.first(val.Pointer()) {
+			break
+		}
+		// buffered elements cannot be inspected without receiving them
+		sz += chanHeaderSize + uint64(val.Cap())*uint64(typ.Elem().Size())
+
+	case reflect.Interface:
+		if val.IsNil() {
+			break
+		}
+		elem := val.Elem()
+		switch elem.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			// pointer-shaped values are stored in the interface itself
+		default:
+			// everything else is boxed in a separate allocation
+			sz += uint64(elem.Type().Size())
+		}
+		sz += a.indirect(elem)
+	}
+	return
+}
+
+// hasPointers reports whether values of typ can refer to other memory. Values
+// that cannot are fully accounted for by their type's size.
+func hasPointers(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Array:
+		return typ.Len() > 0 && hasPointers(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if hasPointers(typ.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
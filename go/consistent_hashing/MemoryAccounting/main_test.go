@@ -0,0 +1,62 @@
+package MemoryAccounting
+
+import (
+	"testing"
+)
+
+type node struct {
+	next  *node
+	value int64
+}
+
+type shared struct {
+	a, b *[64]int64
+}
+
+type hidden struct {
+	table []int16
+	name  string
+}
+
+func TestSizeof(t *testing.T) {
+	loop := &node{value: 1}
+	loop.next = &node{next: loop, value: 2}
+
+	arr := &[64]int64{}
+	backing := make([]int32, 100, 100)
+
+	for _, tc := range []struct {
+		name     string
+		obj      interface{}
+		expected uint64
+	}{
+		{"string", "test", 20},
+		{"int", int64(5), 8},
+		{"cycle", loop, 8 + 2*16},
+		{"shared pointer", shared{arr, arr}, 16 + 64*8},
+		{"unexported fields", &hidden{make([]int16, 10, 20), "abc"}, 8 + 24 + 16 + 20*2 + 3},
+		{"overlapping slices", [2][]int32{backing[:10], backing[50:]}, 48 + 400},
+		{"interface", []interface{}{int64(1), arr}, 24 + 2*16 + 8 + 64*8},
+		{"nil map", map[int]int(nil), 8},
+	} {
+		if actual := Sizeof(tc.obj); actual != tc.expected {
+			t.Errorf("%s: %d bytes, expected %d", tc.name, actual, tc.expected)
+		}
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	estimate, measured := Measure(func() interface{} {
+		rows := make([][]uint64, 100, 100)
+		for ix := range rows {
+			rows[ix] = make([]uint64, 1000, 1000)
+		}
+		return rows
+	})
+	if estimate != 24+100*24+100*1000*8 {
+		t.Errorf("estimated %d bytes", estimate)
+	}
+	if diff := float64(measured) - float64(estimate); diff < -0.05*float64(estimate) || diff > 0.05*float64(estimate) {
+		t.Errorf("estimated %d bytes, runtime saw %d", estimate, measured)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !go1.24
+
+package MemoryAccounting
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// mapHeaderSize is the size of runtime.hmap on 64-bit platforms
+	mapHeaderSize = 48
+
+	// mapBucketEntries and mapLoadFactor describe how the runtime sizes map
+	// buckets: 8 entries each, grown when the average passes 6.5
+	mapBucketEntries = 8
+	mapLoadFactor    = 6.5
+)
+
+// mapSize is the memory used by a map of typ holding n entries, not counting
+// what the keys and values refer to
+func mapSize(typ reflect.Type, n int) uint64 {
+	return mapHeaderSize + mapBuckets(n)*mapBucketSize(typ)
+}
+
+// mapBuckets is how many buckets the runtime allocates for n entries
+func mapBuckets(n int) uint64 {
+	buckets := uint64(1)
+	for float64(n) > mapLoadFactor*float64(buckets) {
+		buckets *= 2
+	}
+	return buckets
+}
+
+// mapBucketSize is one bucket: a tophash byte per entry, the keys, the values
+// and an overflow pointer
+func mapBucketSize(typ reflect.Type) uint64 {
+	entry := uint64(typ.Key().Size() + typ.Elem().Size())
+	return mapBucketEntries*(1+entry) + uint64(unsafe.Sizeof(uintptr(0)))
+}
@@ -0,0 +1,69 @@
+//go:build go1.24
+
+package MemoryAccounting
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// mapHeaderSize is the size of internal/runtime/maps.Map, and tableSize
+	// of the table structs it points to, on 64-bit platforms
+	mapHeaderSize = 48
+	tableSize     = 32
+
+	// Swiss tables keep entries in groups of 8 slots behind a word of
+	// control bytes. A table grows until it holds 1024 slots and then
+	// splits in two, and each table is allowed to get 7/8 full.
+	groupSlots       = 8
+	maxTableCapacity = 1024
+	maxAvgGroupLoad  = 7
+
+	// maxInlineSize is the biggest key or value kept in a slot. Bigger
+	// ones get an allocation each and the slot points to it.
+	maxInlineSize = 128
+)
+
+// mapSize is the memory used by a map of typ holding n entries, not counting
+// what the keys and values refer to. It assumes the map grew as entries were
+// added, rather than being made with a size hint.
+func mapSize(typ reflect.Type, n int) uint64 {
+	if n == 0 {
+		return mapHeaderSize
+	}
+	key, elem := typ.Key(), typ.Elem()
+	sz := uint64(0)
+	if key.Size() > maxInlineSize {
+		sz += uint64(n) * uint64(key.Size())
+		key = reflect.PtrTo(key)
+	}
+	if elem.Size() > maxInlineSize {
+		sz += uint64(n) * uint64(elem.Size())
+		elem = reflect.PtrTo(elem)
+	}
+	slot := reflect.StructOf([]reflect.StructField{
+		{Name: "Key", Type: key},
+		{Name: "Elem", Type: elem},
+	})
+	group := uint64(unsafe.Sizeof(uint64(0))) + groupSlots*uint64(slot.Size())
+
+	// up to 8 entries live in a single group with no table around it
+	if n <= groupSlots {
+		return mapHeaderSize + sz + group
+	}
+
+	// a full table only takes as many entries as it can hold 7/8 full, and
+	// the keys are spread evenly, so the tables all split at about the same
+	// time
+	tables, capacity := uint64(1), uint64(2*groupSlots)
+	for uint64(n) > tables*capacity*maxAvgGroupLoad/groupSlots {
+		if capacity < maxTableCapacity {
+			capacity *= 2
+		} else {
+			tables *= 2
+		}
+	}
+	directory := tables * uint64(unsafe.Sizeof(uintptr(0)))
+	return mapHeaderSize + sz + directory + tables*(tableSize+capacity/groupSlots*group)
+}
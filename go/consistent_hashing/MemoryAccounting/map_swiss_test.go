@@ -0,0 +1,59 @@
+//go:build go1.24
+
+package MemoryAccounting
+
+import (
+	"testing"
+)
+
+func filled(n int) map[int64]int64 {
+	m := map[int64]int64{}
+	for i := int64(0); i < int64(n); i++ {
+		m[i] = i
+	}
+	return m
+}
+
+// TestSizeofMap checks that Swiss table maps come out somewhere sensible
+// without pinning the runtime's layout. A map holds at least its keys and
+// values. Tables are at least 7/16 full once they have grown, and each slot
+// carries a control byte, so they never take more than three times that,
+// plus the header and a group or two for small maps.
+func TestSizeofMap(t *testing.T) {
+	check := func(name string, m interface{}, entries int, entrySize uint64) {
+		t.Helper()
+		payload := uint64(entries) * entrySize
+		lower, upper := 8+payload, 8+256+3*payload
+		if actual := Sizeof(m); actual < lower || actual > upper {
+			t.Errorf("%s, %d entries: %d bytes, expected %d to %d", name, entries, actual, lower, upper)
+		}
+	}
+	for _, n := range []int{0, 1, 8, 9, 100, 1000, 50000} {
+		check("int64 to int64", filled(n), n, 16)
+	}
+	// values over 128 bytes get an allocation each, which still counts
+	big := map[int32][200]byte{1: {}, 2: {}}
+	check("big values", big, 2, 4+200)
+}
+
+// TestMeasureMap checks map estimates against the runtime, which rounds each
+// allocation up to its size class and so comes out a few percent higher
+func TestMeasureMap(t *testing.T) {
+	for _, n := range []int{1000, 50000} {
+		for name, build := range map[string]func() interface{}{
+			"small values": func() interface{} { return filled(n) },
+			"big values": func() interface{} {
+				m := map[int32][200]byte{}
+				for i := int32(0); i < int32(n); i++ {
+					m[i] = [200]byte{}
+				}
+				return m
+			},
+		} {
+			estimate, measured := Measure(build)
+			if ratio := float64(measured) / float64(estimate); ratio < 0.98 || ratio > 1.1 {
+				t.Errorf("%s, %d entries: estimated %d bytes, runtime saw %d", name, n, estimate, measured)
+			}
+		}
+	}
+}
@@ -3,44 +3,267 @@ package ModHashing
 import (
 	"fmt"
 	"math"
+	"math/bits"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// Mode is how a ModHasher reduces a hash to a bucket
+type Mode int
+
+const (
+	// Mod takes the remainder, which needs a division
+	Mod Mode = iota
+	// Lemire takes the high word of location * buckets, which scales the
+	// hash into the range with a single multiply.
+	// https://lemire.me/blog/2016/06/27/a-fast-alternative-to-the-modulo-reduction/
+	Lemire
+	// Mask keeps the low bits up to the next power of two and folds
+	// anything past the last bucket down by half that power. It is the
+	// cheapest, but the folded buckets get twice the keys unless the bucket
+	// count is a power of two.
+	Mask
 )
 
+var modeNames = map[Mode]string{Mod: "mod", Lemire: "lemire", Mask: "mask"}
+
+// String tells you which mode this is
+func (m Mode) String() string {
+	if name, ok := modeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
 // ModHasher uses a simple mod of the object's hash to determine the bucket
 type ModHasher struct {
 	Buckets uint64
+	Mode    Mode
+	mask    uint64
+	fold    uint64
 }
 
 // New creates a new ModHasher
 func New(buckets int) *ModHasher {
-	return &ModHasher{uint64(buckets)}
+	return NewWithMode(buckets, Mod)
+}
+
+// NewWithMode creates a new ModHasher reducing hashes with a given Mode
+func NewWithMode(buckets int, mode Mode) *ModHasher {
+	mask, fold := maskFold(uint64(buckets))
+	return &ModHasher{uint64(buckets), mode, mask, fold}
+}
+
+// maskFold returns the mask of bits covering every bucket and the amount
+// taken off of values past the last bucket
+func maskFold(buckets uint64) (uint64, uint64) {
+	if buckets <= 1 {
+		return 0, 0
+	}
+	pow2 := uint64(1) << bits.Len64(buckets-1)
+	return pow2 - 1, pow2 / 2
 }
 
 // MapBucket returns the target bucket for a given object hash
 func (mh *ModHasher) MapBucket(location uint64) int {
+	switch mh.Mode {
+	case Lemire:
+		hi, _ := bits.Mul64(location, mh.Buckets)
+		return int(hi)
+	case Mask:
+		v := location & mh.mask
+		if v >= mh.Buckets {
+			v -= mh.fold
+		}
+		return int(v)
+	}
 	return int(location % mh.Buckets)
 }
 
-// ExpectedMoveRate is the rate we would expect random elements to move given
-// the current size of the ModHasher and an alternative size.
-func (mh *ModHasher) ExpectedMoveRate(otherSize int) float64 {
-	// 1 - (gcd(mh.Buckets, otherSize)/max(mh.Buckets, otherSize))
-	return 1.0 - (float64(gcd(mh.Buckets, uint64(otherSize))) / math.Max(float64(mh.Buckets), float64(otherSize)))
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations. The mode is only checked once per batch.
+func (mh *ModHasher) MapBatch(locations []uint64, out []int) {
+	switch mh.Mode {
+	case Lemire:
+		for ix, location := range locations {
+			hi, _ := bits.Mul64(location, mh.Buckets)
+			out[ix] = int(hi)
+		}
+	case Mask:
+		for ix, location := range locations {
+			v := location & mh.mask
+			if v >= mh.Buckets {
+				v -= mh.fold
+			}
+			out[ix] = int(v)
+		}
+	default:
+		for ix, location := range locations {
+			out[ix] = int(location % mh.Buckets)
+		}
+	}
 }
 
-func gcd(x uint64, y uint64) uint64 {
-	mf := uint64(math.Floor(math.Sqrt(math.Max(float64(x), float64(y)))))
-	_gcd := uint64(1)
-	for i := mf; i > 1; i-- {
-		if x%i == 0 && y%i == 0 {
-			_gcd *= i
-			x /= i
-			y /= i
+// ExpectedMoveRate is the rate we would expect random elements to move going
+// from one membership to another. A ModHasher only serves a range, so any
+// other membership is served by position, and a key stays when the members
+// at its old and new positions are the same bucket. Every mode picks
+// positions as an exact function of the hash, so each of these is exact too.
+func (mh *ModHasher) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	if len(from) == 0 || len(to) == 0 {
+		return Membership.MinimalMoveRate(from, to)
+	}
+	switch mh.Mode {
+	case Lemire:
+		return 1 - lemireOverlap(from, to)
+	case Mask:
+		return 1 - maskOverlap(from, to)
+	}
+	return 1 - modOverlap(from, to)
+}
+
+// modOverlap is the fraction of hashes mod puts on the same bucket for two
+// memberships. Over one period of lcm(n, m), each pair of positions a and b
+// with a = b mod gcd(n, m) comes up exactly once and no other pair does. For
+// two ranges, the pairs keeping their bucket are a = b < min(n, m), so this
+// is min/lcm = gcd/max.
+func modOverlap(from, to Membership.Membership) float64 {
+	n, m := uint64(len(from)), uint64(len(to))
+	g := gcd(n, m)
+	same := 0
+	for a, bucket := range from {
+		if b := to.IndexOf(bucket); b >= 0 && uint64(a)%g == uint64(b)%g {
+			same++
+		}
+	}
+	return float64(same) * float64(g) / (float64(n) * float64(m))
+}
+
+// lemireOverlap is the fraction of hashes Lemire reduction puts on the same
+// bucket for two memberships. Position a of n owns [a/n, (a+1)/n) of the hash
+// space, so a key stays where the shares of a bucket's two positions overlap.
+func lemireOverlap(from, to Membership.Membership) float64 {
+	n, m := float64(len(from)), float64(len(to))
+	overlap := 0.0
+	for a, bucket := range from {
+		b := to.IndexOf(bucket)
+		if b < 0 {
+			continue
+		}
+		lo := math.Max(float64(a)/n, float64(b)/m)
+		hi := math.Min(float64(a+1)/n, float64(b+1)/m)
+		if hi > lo {
+			overlap += hi - lo
+		}
+	}
+	return overlap
+}
+
+// maskOverlap is the fraction of hashes Mask reduction puts on the same
+// bucket for two memberships. Both only look at the low bits, so counting
+// the agreements over every value of the wider mask is exact. That is linear
+// in the next power of two above the larger count.
+func maskOverlap(from, to Membership.Membership) float64 {
+	n, m := uint64(len(from)), uint64(len(to))
+	nMask, nFold := maskFold(n)
+	mMask, mFold := maskFold(m)
+	span := nMask
+	if mMask > span {
+		span = mMask
+	}
+	same := uint64(0)
+	for v := uint64(0); v <= span; v++ {
+		a, b := v&nMask, v&mMask
+		if a >= n {
+			a -= nFold
+		}
+		if b >= m {
+			b -= mFold
 		}
+		if from[a] == to[b] {
+			same++
+		}
+	}
+	return float64(same) / float64(span+1)
+}
+
+// gcd is Euclid's algorithm
+func gcd(x uint64, y uint64) uint64 {
+	for y != 0 {
+		x, y = y, x%y
 	}
-	return _gcd
+	return x
 }
 
 // Name tells yo who we are
 func (mh *ModHasher) Name() string {
-	return fmt.Sprintf("ModHash[%d]", mh.Buckets)
+	if mh.Mode == Mod {
+		return fmt.Sprintf("ModHash[%d]", mh.Buckets)
+	}
+	return fmt.Sprintf("ModHash(%s)[%d]", mh.Mode, mh.Buckets)
+}
+
+// SnapshotKind identifies ModHasher snapshots
+const SnapshotKind = "ModHash"
+
+const snapshotVersion = 1
+
+type modState struct {
+	Buckets uint64 `json:"buckets"`
+	Mode    string `json:"mode"`
+}
+
+// restore checks and installs decoded fields. A mod by zero would panic on
+// every lookup, so it is refused.
+func (mh *ModHasher) restore(buckets uint64, mode Mode) error {
+	if buckets == 0 {
+		return fmt.Errorf("snapshot has no buckets")
+	}
+	if _, ok := modeNames[mode]; !ok {
+		return fmt.Errorf("snapshot has unknown %s", mode)
+	}
+	*mh = *NewWithMode(int(buckets), mode)
+	return nil
+}
+
+// MarshalBinary encodes the ModHasher as a versioned snapshot
+func (mh *ModHasher) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(mh.Buckets)
+	e.Int(int(mh.Mode))
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the ModHasher with the one in a snapshot
+func (mh *ModHasher) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	buckets := d.Uint64()
+	mode := Mode(d.Int())
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return mh.restore(buckets, mode)
+}
+
+// MarshalJSON encodes the ModHasher as a versioned snapshot
+func (mh *ModHasher) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, modState{mh.Buckets, mh.Mode.String()})
+}
+
+// UnmarshalJSON replaces the ModHasher with the one in a snapshot
+func (mh *ModHasher) UnmarshalJSON(data []byte) error {
+	state := modState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	for mode, name := range modeNames {
+		if name == state.Mode {
+			return mh.restore(state.Buckets, mode)
+		}
+	}
+	return fmt.Errorf("snapshot has unknown mode %q", state.Mode)
 }
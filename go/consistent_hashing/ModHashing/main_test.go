@@ -0,0 +1,221 @@
+package ModHashing
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+)
+
+var modes = []Mode{Mod, Lemire, Mask}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, mode := range modes {
+		for _, size := range MapperTest.Sizes {
+			MapperTest.Range(t, NewWithMode(size, mode), size)
+			MapperTest.Same(t, NewWithMode(size, mode), NewWithMode(size, mode), MapperTest.Locations(1000))
+		}
+	}
+}
+
+func TestGcd(t *testing.T) {
+	for _, tc := range [][3]uint64{
+		{8, 16, 8},
+		{16, 8, 8},
+		{12, 18, 6},
+		{10, 5, 5},
+		{17, 13, 1},
+		{0, 5, 5},
+		{7, 7, 7},
+		{1 << 40, 3 << 20, 1 << 20},
+		{2 * 3 * 3 * 5 * 7, 3 * 3 * 7 * 11, 3 * 3 * 7},
+	} {
+		if actual := gcd(tc[0], tc[1]); actual != tc[2] {
+			t.Errorf("gcd(%d, %d) = %d, expected %d", tc[0], tc[1], actual, tc[2])
+		}
+	}
+}
+
+// exactMoveRate counts the values in one full period of both mods that land
+// in different buckets. Every location behaves like its value mod lcm(n, m),
+// so this is exact rather than an estimate.
+func exactMoveRate(n, m uint64) float64 {
+	period := n / gcd(n, m) * m
+	moved := uint64(0)
+	for x := uint64(0); x < period; x++ {
+		if x%n != x%m {
+			moved++
+		}
+	}
+	return float64(moved) / float64(period)
+}
+
+func TestExpectedMoveRateExact(t *testing.T) {
+	for n := 1; n <= 64; n++ {
+		for m := 1; m <= 64; m++ {
+			expected := exactMoveRate(uint64(n), uint64(m))
+			if actual := New(n).ExpectedMoveRate(Membership.Range(n), Membership.Range(m)); math.Abs(actual-expected) > 1e-12 {
+				t.Errorf("%d -> %d: predicted %0.6f, exactly %0.6f", n, m, actual, expected)
+			}
+		}
+	}
+}
+
+// Memberships other than a range are served by position
+func TestExpectedMoveRateMembership(t *testing.T) {
+	from := Membership.Range(12)
+	for _, to := range []Membership.Membership{
+		from.Without(5),
+		from.Without(0).With(20),
+		from.With(12, 13, 14, 15),
+	} {
+		n, m := uint64(len(from)), uint64(len(to))
+		period := n / gcd(n, m) * m
+		moved := 0
+		for x := uint64(0); x < period; x++ {
+			if from[x%n] != to[x%m] {
+				moved++
+			}
+		}
+		expected := float64(moved) / float64(period)
+		if actual := New(len(from)).ExpectedMoveRate(from, to); math.Abs(actual-expected) > 1e-12 {
+			t.Errorf("mod %v: predicted %0.6f, exactly %0.6f", to, actual, expected)
+		}
+
+		for _, mode := range []Mode{Lemire, Mask} {
+			a, b := NewWithMode(len(from), mode), NewWithMode(len(to), mode)
+			locs := MapperTest.Locations(50000)
+			moved := 0
+			for _, location := range locs {
+				if from[a.MapBucket(location)] != to[b.MapBucket(location)] {
+					moved++
+				}
+			}
+			expected := a.ExpectedMoveRate(from, to)
+			if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.01 {
+				t.Errorf("%s %v: %0.4f moved, predicted %0.4f", mode, to, actual, expected)
+			}
+		}
+	}
+}
+
+func TestLemireMatchesMulHigh(t *testing.T) {
+	for _, tc := range []struct {
+		location uint64
+		buckets  int
+		expected int
+	}{
+		{0, 10, 0},
+		{1<<63 - 1, 10, 4},
+		{1 << 63, 10, 5},
+		{math.MaxUint64, 10, 9},
+		{math.MaxUint64, 1, 0},
+	} {
+		if actual := NewWithMode(tc.buckets, Lemire).MapBucket(tc.location); actual != tc.expected {
+			t.Errorf("%x of %d: got %d, expected %d", tc.location, tc.buckets, actual, tc.expected)
+		}
+	}
+}
+
+// Past the last bucket, mask folds down by half the power of two, so for 5
+// buckets 5, 6 and 7 land on 1, 2 and 3
+func TestMaskFolds(t *testing.T) {
+	mh := NewWithMode(5, Mask)
+	for v, expected := range []int{0, 1, 2, 3, 4, 1, 2, 3} {
+		if actual := mh.MapBucket(uint64(v) | 0xff00); actual != expected {
+			t.Errorf("%d: got %d, expected %d", v, actual, expected)
+		}
+	}
+}
+
+func TestModeExpectedMoveRate(t *testing.T) {
+	for _, mode := range []Mode{Lemire, Mask} {
+		for _, tc := range [][2]int{{8, 9}, {9, 8}, {100, 101}, {12, 18}, {5, 8}, {1024, 1025}} {
+			from, to := NewWithMode(tc[0], mode), NewWithMode(tc[1], mode)
+			locs := MapperTest.Locations(50000)
+			moved := 0
+			for _, location := range locs {
+				if from.MapBucket(location) != to.MapBucket(location) {
+					moved++
+				}
+			}
+			expected := from.ExpectedMoveRate(Membership.Range(tc[0]), Membership.Range(tc[1]))
+			if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.01 {
+				t.Errorf("%s %d -> %d: %0.4f moved, predicted %0.4f", mode, tc[0], tc[1], actual, expected)
+			}
+		}
+	}
+	// growing by one under Lemire moves half of everything, near enough
+	if actual := NewWithMode(1024, Lemire).ExpectedMoveRate(Membership.Range(1024), Membership.Range(1025)); math.Abs(actual-0.5) > 0.01 {
+		t.Errorf("lemire 1024 -> 1025 predicted %0.4f", actual)
+	}
+	// powers of two under Mask only move the keys the new half takes
+	if actual := NewWithMode(8, Mask).ExpectedMoveRate(Membership.Range(8), Membership.Range(16)); actual != 0.5 {
+		t.Errorf("mask 8 -> 16 predicted %0.4f", actual)
+	}
+}
+
+func TestName(t *testing.T) {
+	if name := New(8).Name(); name != "ModHash[8]" {
+		t.Errorf("mod named %q", name)
+	}
+	if name := NewWithMode(8, Lemire).Name(); name != "ModHash(lemire)[8]" {
+		t.Errorf("lemire named %q", name)
+	}
+	if name := Mode(7).String(); name != "Mode(7)" {
+		t.Errorf("unknown mode named %q", name)
+	}
+}
+
+func TestExpectedMoveRate(t *testing.T) {
+	for _, tc := range []struct {
+		from, to int
+		expected float64
+	}{
+		{8, 9, 1 - 1.0/9},
+		{100, 101, 1 - 1.0/101},
+		{12, 18, 1 - 6.0/18},
+		{10, 5, 1 - 5.0/10},
+		{8, 16, 1 - 8.0/16},
+		{16, 8, 1 - 8.0/16},
+	} {
+		from, to := New(tc.from), New(tc.to)
+		if actual := from.ExpectedMoveRate(Membership.Range(tc.from), Membership.Range(tc.to)); math.Abs(actual-tc.expected) > 1e-9 {
+			t.Errorf("%d -> %d: predicted %0.4f, expected %0.4f", tc.from, tc.to, actual, tc.expected)
+		}
+		locs := MapperTest.Locations(20000)
+		moved := 0
+		for _, location := range locs {
+			if from.MapBucket(location) != to.MapBucket(location) {
+				moved++
+			}
+		}
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-tc.expected) > 0.02 {
+			t.Errorf("%d -> %d: %0.4f moved, expected %0.4f", tc.from, tc.to, actual, tc.expected)
+		}
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, mode := range modes {
+		for _, size := range MapperTest.Sizes {
+			mh := NewWithMode(size, mode)
+			b.Run(fmt.Sprintf("mode=%s/buckets=%d", mode, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					mh.MapBucket(locs[i&1023])
+				}
+			})
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, mode := range modes {
+		for _, size := range MapperTest.Sizes {
+			MapperTest.SnapshotRoundTrip(t, NewWithMode(size, mode), func() MapperTest.Snapshotter { return &ModHasher{} })
+		}
+	}
+}
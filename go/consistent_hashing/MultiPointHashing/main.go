@@ -1,25 +1,38 @@
 package MultiPointHashing
 
 import (
-	"encoding/binary"
 	"fmt"
 	"math"
 	"sort"
 
-	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
 	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/RingIndex"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
 )
 
-// BucketPlace is the location of a bucket on the ring
+// BucketPlace is the location of a bucket on the ring. Named buckets are
+// placed by their name and the rest by their number.
 type BucketPlace struct {
-	Place  uint64
-	Bucket int
+	Place  uint64 `json:"place"`
+	Bucket int    `json:"bucket"`
+	Name   string `json:"name,omitempty"`
 }
 
-// MultiPointHashRing is just a collection of BucketPlace(s), sorted by place
+// MultiPointHashRing is multi-probe consistent hashing: each bucket has one
+// point on the ring, and a key is looked up at Tries places, each from its own
+// seeded hash, and goes to whichever bucket follows one of them most closely.
+// More tries even out the load that a single point per bucket leaves uneven.
+// https://arxiv.org/abs/1505.00062
+//
+// Buckets is sorted by place. Every try is a search of the ring, so rings
+// made by the constructors or restored from snapshots keep an index of the
+// places to speed them up, as ConsistentHashRing does. Add and Remove rebuild
+// it. After changing Buckets any other way call Reindex.
 type MultiPointHashRing struct {
 	Buckets []BucketPlace
 	Tries   uint
+	index   *RingIndex.Index
 }
 
 // New makes a new ring given a set of buckets
@@ -29,53 +42,309 @@ func New(buckets int, tries uint) *MultiPointHashRing {
 	}
 	ring := make([]BucketPlace, buckets, buckets)
 	for b := 0; b < buckets; b++ {
-		place := ObjectHasher.PlaceUInt64N(uint64(b), 1)
-		ring[b] = BucketPlace{place, b}
+		ring[b] = BucketPlace{Place: numberedPlace(b), Bucket: b}
 	}
 	sort.Slice(ring, func(i, j int) bool {
 		return ring[i].Place < ring[j].Place
 	})
-	return &MultiPointHashRing{ring, tries}
+	return newRing(ring, tries)
 }
 
-// MapBucket will return the correct bucket for the provided hash value
-// In consistent hashing, this is the next bucket number on the ring for a
-// given location
-func (ring *MultiPointHashRing) MapBucket(location uint64) int {
+// NewNamed makes a new ring of named buckets, such as host names. Bucket i
+// is names[i], placed by the hash of its name, so a bucket goes to the same
+// place on every ring it is in, whatever number it has there. Names have to
+// be distinct and not empty.
+func NewNamed(names []string, tries uint) (*MultiPointHashRing, error) {
+	if tries <= 0 {
+		tries = 21
+	}
+	ring := make([]BucketPlace, len(names), len(names))
+	for b, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("bucket %d has no name", b)
+		}
+		ring[b] = BucketPlace{namedPlace(name), b, name}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].Place < ring[j].Place
+	})
+	if err := check(ring); err != nil {
+		return nil, err
+	}
+	return newRing(ring, tries), nil
+}
+
+func numberedPlace(bucket int) uint64 {
+	return ObjectHasher.PlaceUInt64N(uint64(bucket), 1)
+}
+
+func namedPlace(name string) uint64 {
+	return ObjectHasher.PlaceString(name)
+}
+
+// newRing makes a ring of sorted points, with its index
+func newRing(points []BucketPlace, tries uint) *MultiPointHashRing {
+	ring := &MultiPointHashRing{Buckets: points, Tries: tries}
+	ring.Reindex()
+	return ring
+}
+
+// Reindex builds the ring's lookup index from its points
+func (ring *MultiPointHashRing) Reindex() {
 	rr := ring.Buckets
-	var bestDistance uint64 = math.MaxUint64
-	bestBucket := -1
+	ring.index = RingIndex.Build(len(rr), func(ix int) uint64 { return rr[ix].Place })
+}
+
+// check makes sure sorted points make a ring: one point per bucket, and
+// names used only once
+func check(points []BucketPlace) error {
+	buckets := map[int]bool{}
+	names := map[string]bool{}
+	for ix, p := range points {
+		if ix > 0 && p.Place < points[ix-1].Place {
+			return fmt.Errorf("points are not sorted at %d", ix)
+		}
+		if p.Bucket < 0 || buckets[p.Bucket] {
+			return fmt.Errorf("point %d has bucket %d, which is negative or already used", ix, p.Bucket)
+		}
+		buckets[p.Bucket] = true
+		if p.Name != "" {
+			if names[p.Name] {
+				return fmt.Errorf("name %q is used more than once", p.Name)
+			}
+			names[p.Name] = true
+		}
+	}
+	return nil
+}
 
-	b := make([]byte, 8)
-	h := xxhash.New64()
+// search returns the position of the first point at or after location, or
+// the number of points if there is none
+func (ring *MultiPointHashRing) search(location uint64) int {
+	rr := ring.Buckets
+	return ring.index.Find(location, len(rr), func(ix int) uint64 { return rr[ix].Place })
+}
+
+// closest returns the position of the point that follows one of location's
+// probes most closely, or -1 if the ring is empty. The probes are the
+// location hashed with seeds 0 to Tries-1. Each one is worked out from the
+// location alone, so none of them waits on the search before it.
+func (ring *MultiPointHashRing) closest(location uint64) int {
+	rr := ring.Buckets
+	if len(rr) == 0 {
+		return -1
+	}
+	var bestDistance uint64 = math.MaxUint64
+	best := 0
 	for i := uint(0); i < ring.Tries; i++ {
-		ix := sort.Search(
-			len(rr),
-			func(ix int) bool { return rr[ix].Place >= location },
-		)
+		probe := ObjectHasher.PlaceUInt64S(location, uint64(i))
+		ix := ring.search(probe)
 		if ix >= len(rr) {
 			ix = 0
 		}
-		distance := rr[ix].Place - location
-		if distance < bestDistance {
+		// wraps around the top of the space for the first point
+		if distance := rr[ix].Place - probe; distance < bestDistance {
 			bestDistance = distance
-			bestBucket = rr[ix].Bucket
+			best = ix
+		}
+	}
+	return best
+}
+
+// MapBucket will return the correct bucket for the provided hash value, or -1
+// if the ring is empty
+func (ring *MultiPointHashRing) MapBucket(location uint64) int {
+	ix := ring.closest(location)
+	if ix < 0 {
+		return -1
+	}
+	return ring.Buckets[ix].Bucket
+}
+
+// MapName returns the name of the bucket for the provided hash value, which
+// is empty if the bucket has no name or the ring is empty
+func (ring *MultiPointHashRing) MapName(location uint64) string {
+	ix := ring.closest(location)
+	if ix < 0 {
+		return ""
+	}
+	return ring.Buckets[ix].Name
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (ring *MultiPointHashRing) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = ring.MapBucket(location)
+	}
+}
+
+// find returns the position of a bucket's point, or -1 if it is not on the
+// ring
+func (ring *MultiPointHashRing) find(bucket int) int {
+	for ix, p := range ring.Buckets {
+		if p.Bucket == bucket {
+			return ix
 		}
-		binary.LittleEndian.PutUint64(b, location)
-		h.Write(b)
-		location = h.Sum64()
 	}
-	return bestBucket
+	return -1
+}
+
+// Bucket returns the number of the bucket with a name
+func (ring *MultiPointHashRing) Bucket(name string) (int, bool) {
+	if name == "" {
+		return -1, false
+	}
+	for _, p := range ring.Buckets {
+		if p.Name == name {
+			return p.Bucket, true
+		}
+	}
+	return -1, false
+}
+
+// insert puts a point on the ring in order
+func (ring *MultiPointHashRing) insert(p BucketPlace) {
+	ix := ring.search(p.Place)
+	points := make([]BucketPlace, 0, len(ring.Buckets)+1)
+	points = append(points, ring.Buckets[:ix]...)
+	points = append(points, p)
+	ring.Buckets = append(points, ring.Buckets[ix:]...)
+	ring.Reindex()
+}
+
+// Add puts a numbered bucket on the ring. It is false if the bucket is
+// already there.
+func (ring *MultiPointHashRing) Add(bucket int) bool {
+	if bucket < 0 || ring.find(bucket) >= 0 {
+		return false
+	}
+	ring.insert(BucketPlace{Place: numberedPlace(bucket), Bucket: bucket})
+	return true
 }
 
-// ExpectedMoveRate returns the rate (0-1) at which members are expected to move
-func (ring *MultiPointHashRing) ExpectedMoveRate(otherSize int) float64 {
-	buckets := 1 + len(ring.Buckets)
-	otherSize++
-	return math.Abs(float64(otherSize-buckets)) / float64(buckets)
+// AddNamed puts a named bucket on the ring as the lowest bucket number not in
+// use, and returns it
+func (ring *MultiPointHashRing) AddNamed(name string) (int, error) {
+	if name == "" {
+		return -1, fmt.Errorf("buckets cannot be named %q", name)
+	}
+	if _, ok := ring.Bucket(name); ok {
+		return -1, fmt.Errorf("there is already a bucket named %q", name)
+	}
+	used := make(map[int]bool, len(ring.Buckets))
+	for _, p := range ring.Buckets {
+		used[p.Bucket] = true
+	}
+	bucket := 0
+	for used[bucket] {
+		bucket++
+	}
+	ring.insert(BucketPlace{namedPlace(name), bucket, name})
+	return bucket, nil
+}
+
+// Remove takes any bucket off the ring. Only the keys that were mapped to it
+// move: a probe that went to it goes further along the ring, and the probe
+// that won each other key still ends where it did, closer than before. It is
+// false if the bucket is not on the ring.
+func (ring *MultiPointHashRing) Remove(bucket int) bool {
+	ix := ring.find(bucket)
+	if ix < 0 {
+		return false
+	}
+	points := make([]BucketPlace, 0, len(ring.Buckets)-1)
+	points = append(points, ring.Buckets[:ix]...)
+	ring.Buckets = append(points, ring.Buckets[ix+1:]...)
+	ring.Reindex()
+	return true
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. A key stays when the closest point over all of its probes, on the
+// ring of both memberships together, belongs to a bucket in both.
+func (ring *MultiPointHashRing) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
 }
 
 // Name tells you who we are
 func (ring *MultiPointHashRing) Name() string {
 	return fmt.Sprintf("MultiPointHashRing[%d, %d]", len(ring.Buckets), ring.Tries)
 }
+
+// SnapshotKind identifies MultiPointHashRing snapshots
+const SnapshotKind = "MultiPointHashRing"
+
+// snapshotVersion 2 added names. Version 1 rings chained each probe from the
+// one before, and restoring one with independent probes would place keys
+// differently than its writer did, so those are refused.
+const snapshotVersion = 2
+
+type ringState struct {
+	Tries  uint          `json:"tries"`
+	Points []BucketPlace `json:"points"`
+}
+
+// restore checks and installs decoded fields. Lookups binary search the
+// points, so they have to be sorted.
+func (ring *MultiPointHashRing) restore(version uint16, points []BucketPlace, tries uint) error {
+	if version < 2 {
+		return fmt.Errorf("version %d snapshots use chained probes, which are no longer supported", version)
+	}
+	if len(points) == 0 || tries < 1 {
+		return fmt.Errorf("snapshot has %d points and tries %d", len(points), tries)
+	}
+	if err := check(points); err != nil {
+		return fmt.Errorf("snapshot %v", err)
+	}
+	*ring = *newRing(points, tries)
+	return nil
+}
+
+// MarshalBinary encodes the ring as a versioned snapshot
+func (ring *MultiPointHashRing) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(uint64(ring.Tries))
+	e.Uint64(uint64(len(ring.Buckets)))
+	for _, p := range ring.Buckets {
+		e.Uint64(p.Place)
+		e.Int(p.Bucket)
+		e.String(p.Name)
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the ring with the one in a snapshot
+func (ring *MultiPointHashRing) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	if d.Version < 2 {
+		return ring.restore(d.Version, nil, 0)
+	}
+	tries := uint(d.Uint64())
+	points := make([]BucketPlace, d.Len(3))
+	for ix := range points {
+		points[ix] = BucketPlace{d.Uint64(), d.Int(), d.String()}
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return ring.restore(d.Version, points, tries)
+}
+
+// MarshalJSON encodes the ring as a versioned snapshot
+func (ring *MultiPointHashRing) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, ringState{ring.Tries, ring.Buckets})
+}
+
+// UnmarshalJSON replaces the ring with the one in a snapshot
+func (ring *MultiPointHashRing) UnmarshalJSON(data []byte) error {
+	state := ringState{}
+	version, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state)
+	if err != nil {
+		return err
+	}
+	return ring.restore(version, state.Points, state.Tries)
+}
@@ -0,0 +1,294 @@
+package MultiPointHashing
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+const tries = 10
+
+func TestMapBucketDeterministic(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Same(t, New(size, tries), New(size, tries), MapperTest.Locations(200))
+	}
+}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, size := range MapperTest.Sizes[:5] {
+		MapperTest.Range(t, New(size, tries), size)
+	}
+}
+
+func TestMinimalDisruption(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Growth(t, New(size, tries), New(size+1, tries), size, 0.05)
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range MapperTest.Sizes {
+		ring := New(size, tries)
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ring.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.SnapshotRoundTrip(t, New(size, tries), func() MapperTest.Snapshotter { return &MultiPointHashRing{} })
+	}
+}
+
+// TestIndexed checks that the index places keys the same as searching the
+// points directly, for new and restored rings
+func TestIndexed(t *testing.T) {
+	locs := MapperTest.Locations(5000)
+	for _, size := range MapperTest.Sizes {
+		ring := New(size, tries)
+		data, err := ring.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := &MultiPointHashRing{}
+		if err := restored.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		unindexed := &MultiPointHashRing{Buckets: ring.Buckets, Tries: ring.Tries}
+		if ring.index == nil || restored.index == nil {
+			t.Fatalf("size %d: ring is not indexed", size)
+		}
+		for _, location := range locs {
+			expected := unindexed.MapBucket(location)
+			if ring.MapBucket(location) != expected || restored.MapBucket(location) != expected {
+				t.Fatalf("size %d: %x placed on %d and %d with the index, %d without", size, location, ring.MapBucket(location), restored.MapBucket(location), expected)
+			}
+		}
+	}
+}
+
+// TestReindex checks that a ring whose Buckets are changed by hand places
+// keys as the points say once it is reindexed, whether the slice was
+// shortened or a point was moved in place
+func TestReindex(t *testing.T) {
+	locs := MapperTest.Locations(10000)
+	ring := New(10, tries)
+	ring.Buckets = append(ring.Buckets[:5], ring.Buckets[6:]...)
+	ring.Buckets[0].Place /= 2
+	ring.Reindex()
+	for _, location := range locs {
+		if actual, expected := ring.MapBucket(location), bruteForce(ring, location); actual != expected {
+			t.Fatalf("%x placed on %d, expected %d", location, actual, expected)
+		}
+	}
+}
+
+// bruteForce is multi-probe lookup written out the long way: every probe
+// against every point
+func bruteForce(ring *MultiPointHashRing, location uint64) int {
+	var bestDistance uint64 = math.MaxUint64
+	best := -1
+	for i := uint(0); i < ring.Tries; i++ {
+		probe := ObjectHasher.PlaceUInt64S(location, uint64(i))
+		// the smallest distance forward from the probe, wrapping around
+		for _, p := range ring.Buckets {
+			if distance := p.Place - probe; distance < bestDistance {
+				bestDistance, best = distance, p.Bucket
+			}
+		}
+	}
+	return best
+}
+
+func TestIndependentProbes(t *testing.T) {
+	for _, size := range MapperTest.Sizes[:5] {
+		ring := New(size, tries)
+		for _, location := range MapperTest.Locations(2000) {
+			if actual, expected := ring.MapBucket(location), bruteForce(ring, location); actual != expected {
+				t.Fatalf("size %d: %x mapped to %d, expected %d", size, location, actual, expected)
+			}
+		}
+	}
+}
+
+// TestRemove removes buckets in a random order, checking that only the keys
+// of each removed bucket move and that the ring places keys as one made with
+// only the buckets left would
+func TestRemove(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	locs := MapperTest.Locations(5000)
+	for _, size := range []int{2, 7, 100} {
+		ring := New(size, tries)
+		before := make([]int, len(locs), len(locs))
+		ring.MapBatch(locs, before)
+		for _, bucket := range rnd.Perm(size)[:size-1] {
+			if !ring.Remove(bucket) || ring.Remove(bucket) {
+				t.Fatalf("size %d: removing %d twice did not succeed once", size, bucket)
+			}
+			fresh := New(0, tries)
+			for _, p := range ring.Buckets {
+				fresh.Add(p.Bucket)
+			}
+			for ix, location := range locs {
+				after := ring.MapBucket(location)
+				if after != before[ix] && before[ix] != bucket {
+					t.Fatalf("size %d: removing %d moved %x from %d to %d", size, bucket, location, before[ix], after)
+				}
+				if after == bucket || after != fresh.MapBucket(location) {
+					t.Fatalf("size %d: %x mapped to %d after removing %d, %d on a fresh ring", size, location, after, bucket, fresh.MapBucket(location))
+				}
+				before[ix] = after
+			}
+		}
+	}
+}
+
+func TestNamed(t *testing.T) {
+	names := []string{"cache-a:11211", "cache-b:11211", "cache-c:11211", "cache-d:11211"}
+	ring, err := NewNamed(names, tries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same names in another order are numbered differently but placed
+	// the same
+	shuffled, err := NewNamed([]string{names[2], names[0], names[3], names[1]}, tries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locs := MapperTest.Locations(5000)
+	for _, location := range locs {
+		bucket, name := ring.MapBucket(location), ring.MapName(location)
+		if names[bucket] != name || shuffled.MapName(location) != name {
+			t.Fatalf("%x mapped to %d, %q and %q", location, bucket, name, shuffled.MapName(location))
+		}
+	}
+
+	if b, ok := ring.Bucket(names[2]); !ok || b != 2 {
+		t.Errorf("%q is bucket %d, %v", names[2], b, ok)
+	}
+	if !ring.Remove(1) {
+		t.Fatalf("could not remove bucket 1")
+	}
+	if _, ok := ring.Bucket(names[1]); ok {
+		t.Errorf("%q still has a bucket after removing it", names[1])
+	}
+	if b, err := ring.AddNamed("cache-e:11211"); err != nil || b != 1 {
+		t.Errorf("added as bucket %d, %v, expected 1", b, err)
+	}
+	if _, err := ring.AddNamed(names[0]); err == nil {
+		t.Errorf("added %q twice", names[0])
+	}
+	if _, err := NewNamed([]string{"a", "b", "a"}, tries); err == nil {
+		t.Errorf("made a ring with a name used twice")
+	}
+	if _, err := NewNamed([]string{"a", ""}, tries); err == nil {
+		t.Errorf("made a ring with an empty name")
+	}
+
+	data, err := ring.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &MultiPointHashRing{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := &MultiPointHashRing{}
+	if err := json.Unmarshal(js, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range locs {
+		if name := ring.MapName(location); restored.MapName(location) != name || fromJSON.MapName(location) != name {
+			t.Fatalf("%x mapped to %q, and %q and %q after restoring", location, name, restored.MapName(location), fromJSON.MapName(location))
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	ring := New(0, tries)
+	if ring.MapBucket(1) != -1 || ring.MapName(1) != "" {
+		t.Errorf("empty ring mapped to %d, %q", ring.MapBucket(1), ring.MapName(1))
+	}
+}
+
+func TestSnapshotVersion1(t *testing.T) {
+	e := Snapshot.NewEncoder(SnapshotKind, 1)
+	e.Uint64(tries)
+	e.Uint64(1)
+	e.Uint64(12345)
+	e.Int(0)
+	if err := (&MultiPointHashRing{}).UnmarshalBinary(e.Bytes()); err == nil {
+		t.Errorf("restored a version 1 snapshot, which chained its probes")
+	}
+	js := `{"kind": "MultiPointHashRing", "version": 1, "state": {"tries": 10, "points": [{"place": 12345, "bucket": 0}]}}`
+	if err := (&MultiPointHashRing{}).UnmarshalJSON([]byte(js)); err == nil {
+		t.Errorf("restored a version 1 JSON snapshot")
+	}
+}
+
+// peakToAverage places every location and returns the fullest bucket's load
+// over the average
+func peakToAverage(ring *MultiPointHashRing, locs []uint64) float64 {
+	counts := map[int]int{}
+	peak := 0
+	for _, location := range locs {
+		b := ring.MapBucket(location)
+		counts[b]++
+		if counts[b] > peak {
+			peak = counts[b]
+		}
+	}
+	return float64(peak) * float64(len(ring.Buckets)) / float64(len(locs))
+}
+
+// TestTriesEvenLoad checks that more probes even out the load. The paper has
+// 21 probes bringing the peak to about 1.05 of the average, before the few
+// percent that counting a couple of thousand keys a bucket adds.
+func TestTriesEvenLoad(t *testing.T) {
+	locs := MapperTest.Locations(200000)
+	ring := New(100, 1)
+	last := math.Inf(1)
+	for _, n := range []uint{1, 5, 21} {
+		ring.Tries = n
+		ratio := peakToAverage(ring, locs)
+		if ratio >= last {
+			t.Errorf("%d tries: peak-to-average %0.3f, no better than %0.3f", n, ratio, last)
+		}
+		last = ratio
+	}
+	if last > 1.2 {
+		t.Errorf("21 tries: peak-to-average %0.3f", last)
+	}
+}
+
+// BenchmarkTries is the trade-off between tries and load: each lookup costs
+// a search per try, and peak/avg is the fullest bucket's load over the
+// average for keys placed on 1000 buckets
+func BenchmarkTries(b *testing.B) {
+	locs := MapperTest.Locations(1 << 20)
+	ring := New(1000, 1)
+	for _, n := range []uint{1, 2, 3, 5, 8, 13, 21, 34, 55} {
+		ring.Tries = n
+		ratio := peakToAverage(ring, locs)
+		b.Run(fmt.Sprintf("tries=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ring.MapBucket(locs[i&1023])
+			}
+			b.ReportMetric(ratio, "peak/avg")
+		})
+	}
+}
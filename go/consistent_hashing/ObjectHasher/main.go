@@ -17,6 +17,15 @@ func PlaceUInt64N(o uint64, ix int) uint64 {
 	return o
 }
 
+// PlaceUInt64S hashes o with a seed. Every seed is a different hash function,
+// so, unlike the iterations of PlaceUInt64N, the places for different seeds
+// do not depend on each other.
+func PlaceUInt64S(o uint64, seed uint64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], o)
+	return xxhash.Checksum64S(b[:], seed)
+}
+
 func PlaceStringN(s string, ix int) uint64 {
 	return PlaceUInt64N(xxhash.ChecksumString64(s), ix)
 }
@@ -0,0 +1,81 @@
+package ObjectHasher
+
+import (
+	"fmt"
+	"testing"
+)
+
+var words = []string{"", "impress", "road", "furniture", "mess up", "teeny-tiny"}
+
+func TestPlaceStringN(t *testing.T) {
+	for _, w := range words {
+		if PlaceStringN(w, 0) != PlaceString(w) {
+			t.Errorf("%q: PlaceStringN(0) differs from PlaceString", w)
+		}
+		for ix := 1; ix < 5; ix++ {
+			if PlaceStringN(w, ix) != PlaceUInt64N(PlaceString(w), ix) {
+				t.Errorf("%q: PlaceStringN(%d) differs from iterating PlaceString", w, ix)
+			}
+			if PlaceStringN(w, ix) != PlaceUInt64N(PlaceStringN(w, ix-1), 1) {
+				t.Errorf("%q: PlaceStringN(%d) is not one iteration past %d", w, ix, ix-1)
+			}
+		}
+	}
+}
+
+func TestPlaceUInt64NDistinct(t *testing.T) {
+	seen := map[uint64]string{}
+	for o := uint64(0); o < 1000; o++ {
+		for ix := 0; ix < 4; ix++ {
+			p := PlaceUInt64N(o, ix)
+			name := fmt.Sprintf("PlaceUInt64N(%d, %d)", o, ix)
+			if ix == 0 {
+				if p != o {
+					t.Fatalf("%s changed the value", name)
+				}
+				continue
+			}
+			if prev, ok := seen[p]; ok {
+				t.Fatalf("%s collides with %s", name, prev)
+			}
+			seen[p] = name
+		}
+	}
+}
+
+func BenchmarkPlaceString(b *testing.B) {
+	for ix, w := range words {
+		b.Run(fmt.Sprintf("word=%d/len=%d", ix, len(w)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				PlaceString(w)
+			}
+		})
+	}
+}
+
+func BenchmarkPlaceUInt64N(b *testing.B) {
+	for _, n := range []int{1, 2, 10} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				PlaceUInt64N(uint64(i), n)
+			}
+		})
+	}
+}
+
+func TestPlaceUInt64S(t *testing.T) {
+	seen := map[uint64]string{}
+	for o := uint64(0); o < 1000; o++ {
+		for seed := uint64(0); seed < 4; seed++ {
+			p := PlaceUInt64S(o, seed)
+			name := fmt.Sprintf("PlaceUInt64S(%d, %d)", o, seed)
+			if seed == 0 && p != PlaceUInt64N(o, 1) {
+				t.Fatalf("%s differs from the unseeded hash", name)
+			}
+			if prev, ok := seen[p]; ok {
+				t.Fatalf("%s collides with %s", name, prev)
+			}
+			seen[p] = name
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package PartitionAssignment
+
+import (
+	"fmt"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// Mapper places partitions on nodes. Any of the mappers in this project will
+// do.
+type Mapper interface {
+	MapBucket(location uint64) int
+	ExpectedMoveRate(from, to Membership.Membership) float64
+	Name() string
+}
+
+// Move is one partition changing nodes
+type Move struct {
+	Partition int
+	From      int
+	To        int
+}
+
+// Assignment splits keys into a fixed number of partitions by their hash, and
+// puts each partition on a node with a Mapper, the way Kafka and Cassandra do.
+// Keys never change partitions, so when nodes come and go, whole partitions
+// move and the list of them is exact and short.
+type Assignment struct {
+	Partitions []int
+	mapper     Mapper
+	mapperName string
+}
+
+// PartitionLocation is where partition p sits when it is placed with a
+// Mapper. Partition numbers are small and sequential, so they are hashed
+// before placing.
+func PartitionLocation(p int) uint64 {
+	return ObjectHasher.PlaceUInt64N(uint64(p), 1)
+}
+
+// New makes a new Assignment of partitions partitions over the nodes of m.
+// It panics if there is not at least one partition.
+func New(partitions int, m Mapper) *Assignment {
+	if partitions < 1 {
+		panic(fmt.Sprintf("Assignment needs at least one partition, not %d", partitions))
+	}
+	table := make([]int, partitions, partitions)
+	for p := range table {
+		table[p] = m.MapBucket(PartitionLocation(p))
+	}
+	return &Assignment{table, m, m.Name()}
+}
+
+// Partition returns the partition for a given object hash. The partition
+// count never changes, so a plain mod is fine.
+func (a *Assignment) Partition(location uint64) int {
+	return int(location % uint64(len(a.Partitions)))
+}
+
+// MapBucket returns the node holding the partition of a given object hash
+func (a *Assignment) MapBucket(location uint64) int {
+	return a.Partitions[a.Partition(location)]
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (a *Assignment) MapBatch(locations []uint64, out []int) {
+	partitions := uint64(len(a.Partitions))
+	for ix, location := range locations {
+		out[ix] = a.Partitions[location%partitions]
+	}
+}
+
+// Loads returns how many partitions each of nodes nodes holds
+func (a *Assignment) Loads(nodes int) []int {
+	loads := make([]int, nodes, nodes)
+	for _, node := range a.Partitions {
+		if node >= 0 && node < nodes {
+			loads[node]++
+		}
+	}
+	return loads
+}
+
+// Rebalance assigns the same partitions with a new Mapper and returns the new
+// Assignment along with the partitions that have to move to get there
+func (a *Assignment) Rebalance(m Mapper) (*Assignment, []Move) {
+	next := New(len(a.Partitions), m)
+	moves, _ := Diff(a, next)
+	return next, moves
+}
+
+// Diff lists the partitions that are on different nodes in from and to, in
+// partition order. Assignments with different partition counts do not put
+// keys in the same partitions, so they cannot be compared.
+func Diff(from, to *Assignment) ([]Move, error) {
+	if len(from.Partitions) != len(to.Partitions) {
+		return nil, fmt.Errorf("cannot compare %d partitions with %d", len(from.Partitions), len(to.Partitions))
+	}
+	moves := []Move{}
+	for p, node := range from.Partitions {
+		if to.Partitions[p] != node {
+			moves = append(moves, Move{p, node, to.Partitions[p]})
+		}
+	}
+	return moves, nil
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. Partitions move like any other key of the underlying Mapper. An
+// Assignment loaded from a snapshot has only the table, not the Mapper that
+// made it, so it can only promise the minimum.
+func (a *Assignment) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	if a.mapper == nil {
+		return Membership.MinimalMoveRate(from, to)
+	}
+	return a.mapper.ExpectedMoveRate(from, to)
+}
+
+// Name tells you who we are
+func (a *Assignment) Name() string {
+	return fmt.Sprintf("Partitioned[%d] %s", len(a.Partitions), a.mapperName)
+}
+
+// SnapshotKind identifies Assignment snapshots
+const SnapshotKind = "PartitionAssignment"
+
+const snapshotVersion = 1
+
+type assignmentState struct {
+	Mapper     string `json:"mapper"`
+	Partitions []int  `json:"partitions"`
+}
+
+// restore takes the partition table as it is. Lookups only need the table,
+// which is the point of distributing it.
+func (a *Assignment) restore(state assignmentState) error {
+	if len(state.Partitions) == 0 {
+		return fmt.Errorf("snapshot has no partitions")
+	}
+	for p, node := range state.Partitions {
+		if node < 0 {
+			return fmt.Errorf("snapshot puts partition %d on node %d", p, node)
+		}
+	}
+	*a = Assignment{state.Partitions, nil, state.Mapper}
+	return nil
+}
+
+// MarshalBinary encodes the Assignment as a versioned snapshot
+func (a *Assignment) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.String(a.mapperName)
+	e.Uint64(uint64(len(a.Partitions)))
+	for _, node := range a.Partitions {
+		e.Int(node)
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the Assignment with the one in a snapshot
+func (a *Assignment) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := assignmentState{Mapper: d.String()}
+	state.Partitions = make([]int, d.Len(1))
+	for p := range state.Partitions {
+		state.Partitions[p] = d.Int()
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return a.restore(state)
+}
+
+// MarshalJSON encodes the Assignment as a versioned snapshot
+func (a *Assignment) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, assignmentState{a.mapperName, a.Partitions})
+}
+
+// UnmarshalJSON replaces the Assignment with the one in a snapshot
+func (a *Assignment) UnmarshalJSON(data []byte) error {
+	state := assignmentState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return a.restore(state)
+}
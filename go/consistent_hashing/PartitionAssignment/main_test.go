@@ -0,0 +1,134 @@
+package PartitionAssignment
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/ConsistentHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+)
+
+func TestMapBucket(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		jh := JumpHash.New(size)
+		a := New(4096, jh)
+		for _, location := range MapperTest.Locations(10000) {
+			p := a.Partition(location)
+			if p < 0 || p >= 4096 {
+				t.Fatalf("size %d: %x in partition %d", size, location, p)
+			}
+			if a.MapBucket(location) != jh.MapBucket(PartitionLocation(p)) {
+				t.Fatalf("size %d: %x mapped to %d, but its partition %d is on %d", size, location, a.MapBucket(location), p, jh.MapBucket(PartitionLocation(p)))
+			}
+		}
+	}
+}
+
+// TestNoPartitions checks that New refuses what restore refuses, rather than
+// making an Assignment that divides by zero on every lookup
+func TestNoPartitions(t *testing.T) {
+	for _, partitions := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%d partitions accepted", partitions)
+				}
+			}()
+			New(partitions, JumpHash.New(10))
+		}()
+	}
+}
+
+func TestLoads(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		loads := New(4096, ConsistentHashing.New(size, 200)).Loads(size)
+		total := 0
+		for node, load := range loads {
+			if load == 0 {
+				t.Errorf("size %d: node %d has no partitions", size, node)
+			}
+			total += load
+		}
+		if total != 4096 {
+			t.Errorf("size %d: %d partitions assigned", size, total)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		from := New(4096, JumpHash.New(size))
+		to, moves := from.Rebalance(JumpHash.New(size + 1))
+		moved := map[int]bool{}
+		for _, m := range moves {
+			if m.From != from.Partitions[m.Partition] || m.To != to.Partitions[m.Partition] {
+				t.Fatalf("size %d: %+v does not match the assignments", size, m)
+			}
+			if m.To != size {
+				t.Fatalf("size %d: %+v is not to the new node", size, m)
+			}
+			moved[m.Partition] = true
+		}
+		for p := range from.Partitions {
+			if !moved[p] && from.Partitions[p] != to.Partitions[p] {
+				t.Fatalf("size %d: partition %d moved but is not listed", size, p)
+			}
+		}
+
+		// every key that changed nodes is in a listed partition
+		for _, location := range MapperTest.Locations(10000) {
+			if from.MapBucket(location) != to.MapBucket(location) && !moved[from.Partition(location)] {
+				t.Fatalf("size %d: %x moved outside the listed partitions", size, location)
+			}
+		}
+	}
+}
+
+func TestDiffPartitionCount(t *testing.T) {
+	if _, err := Diff(New(10, JumpHash.New(3)), New(11, JumpHash.New(3))); err == nil {
+		t.Errorf("compared different partition counts")
+	}
+	moves, err := Diff(New(10, JumpHash.New(3)), New(10, JumpHash.New(3)))
+	if err != nil || len(moves) != 0 {
+		t.Errorf("identical assignments differ by %v, %v", moves, err)
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range []int{8, 1024} {
+		a := New(4096, JumpHash.New(size))
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				a.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func BenchmarkRebalance(b *testing.B) {
+	from := New(4096, ConsistentHashing.New(100, 200))
+	to := ConsistentHashing.New(101, 200)
+	for i := 0; i < b.N; i++ {
+		from.Rebalance(to)
+	}
+}
+
+// TestSnapshotRoundTrip checks that a restored Assignment maps the same and
+// can still be rebalanced, though it no longer has the Mapper that made it
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		original := New(4096, ConsistentHashing.New(size, 200))
+		b, j := MapperTest.SnapshotRoundTrip(t, original, func() MapperTest.Snapshotter { return &Assignment{} })
+		if b.Name() != original.Name() || j.Name() != original.Name() {
+			t.Errorf("size %d: restored %s and %s, expected %s", size, b.Name(), j.Name(), original.Name())
+		}
+
+		next := ConsistentHashing.New(size+1, 200)
+		_, expected := original.Rebalance(next)
+		if _, moves := b.(*Assignment).Rebalance(next); fmt.Sprint(moves) != fmt.Sprint(expected) {
+			t.Errorf("size %d: restored assignment rebalanced differently", size)
+		}
+	}
+}
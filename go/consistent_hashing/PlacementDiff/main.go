@@ -0,0 +1,169 @@
+package PlacementDiff
+
+import (
+	"bufio"
+	"io"
+	"sort"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+)
+
+// batchSize is how many keys are read from a KeySource at a time
+const batchSize = 4096
+
+// Mapper places keys on buckets. Any of the mappers in this project will do.
+type Mapper interface {
+	MapBucket(location uint64) int
+}
+
+// KeySource hands out keys in batches. It fills batch with the following
+// keys and returns how many were written, with zero meaning there are no
+// more. KeyGenerator.Iterator is one.
+type KeySource interface {
+	Next(batch []string) int
+}
+
+// Move is one key changing buckets
+type Move struct {
+	Key  string
+	From int
+	To   int
+}
+
+// Transfer is how many keys go from one bucket to another
+type Transfer struct {
+	From int
+	To   int
+	Keys int
+}
+
+// Matrix counts keys by the bucket they were on and the bucket they go to.
+// Buckets do not need to be numbered from zero or without gaps, so it only
+// keeps the cells that are used.
+type Matrix struct {
+	Keys  int
+	Moved int
+	cells map[[2]int]int
+}
+
+// NewMatrix makes a new, empty Matrix
+func NewMatrix() *Matrix {
+	return &Matrix{cells: map[[2]int]int{}}
+}
+
+// Add counts one key going from one bucket to another, which may be the same
+func (m *Matrix) Add(from, to int) {
+	m.Keys++
+	if from != to {
+		m.Moved++
+	}
+	m.cells[[2]int{from, to}]++
+}
+
+// Count returns how many keys went from one bucket to another
+func (m *Matrix) Count(from, to int) int {
+	return m.cells[[2]int{from, to}]
+}
+
+// Buckets lists every bucket a key was on or goes to, in order
+func (m *Matrix) Buckets() []int {
+	seen := map[int]bool{}
+	buckets := []int{}
+	for cell := range m.cells {
+		for _, b := range cell {
+			if !seen[b] {
+				seen[b] = true
+				buckets = append(buckets, b)
+			}
+		}
+	}
+	sort.Ints(buckets)
+	return buckets
+}
+
+// Transfers lists the keys moving between each pair of different buckets,
+// ordered by source and then destination
+func (m *Matrix) Transfers() []Transfer {
+	transfers := []Transfer{}
+	for cell, keys := range m.cells {
+		if cell[0] != cell[1] {
+			transfers = append(transfers, Transfer{cell[0], cell[1], keys})
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].From != transfers[j].From {
+			return transfers[i].From < transfers[j].From
+		}
+		return transfers[i].To < transfers[j].To
+	})
+	return transfers
+}
+
+// Sent returns how many keys leave a bucket
+func (m *Matrix) Sent(bucket int) int {
+	sent := 0
+	for cell, keys := range m.cells {
+		if cell[0] == bucket && cell[1] != bucket {
+			sent += keys
+		}
+	}
+	return sent
+}
+
+// Received returns how many keys arrive on a bucket
+func (m *Matrix) Received(bucket int) int {
+	received := 0
+	for cell, keys := range m.cells {
+		if cell[1] == bucket && cell[0] != bucket {
+			received += keys
+		}
+	}
+	return received
+}
+
+// Compare places every key from keys with both from and to, and returns the
+// transfer matrix. If emit is not nil, it is called with each key that moves,
+// in the order keys produced them, and the first error it returns stops the
+// comparison. Keys are placed by ObjectHasher.PlaceString, as the benchmark
+// does.
+func Compare(from, to Mapper, keys KeySource, emit func(Move) error) (*Matrix, error) {
+	m := NewMatrix()
+	batch := make([]string, batchSize, batchSize)
+	for n := keys.Next(batch); n > 0; n = keys.Next(batch) {
+		for _, key := range batch[:n] {
+			location := ObjectHasher.PlaceString(key)
+			a, b := from.MapBucket(location), to.MapBucket(location)
+			m.Add(a, b)
+			if a != b && emit != nil {
+				if err := emit(Move{key, a, b}); err != nil {
+					return m, err
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// LineSource reads keys one per line. Read errors end the keys early and
+// are kept in Err.
+type LineSource struct {
+	scanner *bufio.Scanner
+	Err     error
+}
+
+// NewLineSource makes a new LineSource reading from r
+func NewLineSource(r io.Reader) *LineSource {
+	return &LineSource{scanner: bufio.NewScanner(r)}
+}
+
+// Next fills batch with the following lines and returns how many were written
+func (ls *LineSource) Next(batch []string) int {
+	n := 0
+	for ; n < len(batch) && ls.scanner.Scan(); n++ {
+		batch[n] = ls.scanner.Text()
+	}
+	if n < len(batch) {
+		ls.Err = ls.scanner.Err()
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+package PlacementDiff
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/KeyGenerator"
+	"github.com/dangermike/hashing/go/consistent_hashing/MaglevHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+)
+
+var words = []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel", "india", "juliet"}
+
+// keys makes 10^4 keys
+func keys() *KeyGenerator.Iterator {
+	return KeyGenerator.New(words, 3)
+}
+
+func TestCompareGrowth(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		from, to := JumpHash.New(size), JumpHash.New(size+1)
+		moves := []Move{}
+		m, err := Compare(from, to, keys(), func(mv Move) error {
+			moves = append(moves, mv)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Keys != 10000 || m.Moved != len(moves) {
+			t.Fatalf("size %d: %d keys and %d moved, with %d moves emitted", size, m.Keys, m.Moved, len(moves))
+		}
+
+		// the moves are exactly the keys that change buckets
+		all := make([]string, 10000, 10000)
+		keys().Next(all)
+		ix := 0
+		for _, key := range all {
+			location := ObjectHasher.PlaceString(key)
+			a, b := from.MapBucket(location), to.MapBucket(location)
+			if a == b {
+				continue
+			}
+			if ix >= len(moves) || moves[ix] != (Move{key, a, b}) {
+				t.Fatalf("size %d: missing move of %q from %d to %d", size, key, a, b)
+			}
+			ix++
+		}
+
+		// growing JumpHash only moves keys to the new bucket
+		total := 0
+		for _, tr := range m.Transfers() {
+			if tr.To != size || tr.Keys != m.Count(tr.From, tr.To) {
+				t.Fatalf("size %d: unexpected transfer %+v", size, tr)
+			}
+			total += tr.Keys
+		}
+		if total != m.Moved || m.Received(size) != m.Moved || m.Sent(size) != 0 {
+			t.Errorf("size %d: %d transferred, %d received, %d moved", size, total, m.Received(size), m.Moved)
+		}
+	}
+}
+
+// TestMatrixTotals checks that the matrix accounts for every key, for a
+// mapper that moves keys between old buckets too
+func TestMatrixTotals(t *testing.T) {
+	from, to := MaglevHashing.New(10, 10), MaglevHashing.New(11, 11)
+	m, err := Compare(from, to, keys(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, sent, received := 0, 0, 0
+	for _, a := range m.Buckets() {
+		for _, b := range m.Buckets() {
+			total += m.Count(a, b)
+		}
+		sent += m.Sent(a)
+		received += m.Received(a)
+	}
+	if total != m.Keys || sent != m.Moved || received != m.Moved {
+		t.Errorf("%d keys, %d moved: matrix holds %d, %d sent, %d received", m.Keys, m.Moved, total, sent, received)
+	}
+	if fmt.Sprint(m.Buckets()) != fmt.Sprint([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}) {
+		t.Errorf("unexpected buckets %v", m.Buckets())
+	}
+}
+
+func TestCompareStops(t *testing.T) {
+	stop := errors.New("stop")
+	emitted := 0
+	m, err := Compare(JumpHash.New(10), JumpHash.New(20), keys(), func(Move) error {
+		emitted++
+		if emitted == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || emitted != 3 || m.Moved != 3 {
+		t.Errorf("stopped with %v after %d emitted and %d moved", err, emitted, m.Moved)
+	}
+}
+
+func TestLineSource(t *testing.T) {
+	ls := NewLineSource(strings.NewReader("a\nb\nc\n"))
+	batch := make([]string, 2, 2)
+	got := []string{}
+	for n := ls.Next(batch); n > 0; n = ls.Next(batch) {
+		got = append(got, batch[:n]...)
+	}
+	if fmt.Sprint(got) != "[a b c]" || ls.Err != nil {
+		t.Errorf("read %q, %v", got, ls.Err)
+	}
+}
+
+func BenchmarkCompare(b *testing.B) {
+	from, to := JumpHash.New(100), JumpHash.New(101)
+	it := keys()
+	for i := 0; i < b.N; i++ {
+		it.Reset()
+		Compare(from, to, it, nil)
+	}
+}
@@ -0,0 +1,168 @@
+package PlacementHandle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+)
+
+// Mapper places keys on buckets. Any of the mappers in this project will do.
+type Mapper interface {
+	MapBucket(location uint64) int
+	MapBatch(locations []uint64, out []int)
+	Name() string
+}
+
+// Builder makes a Mapper placing keys on members. It has to return a new
+// Mapper every time, since readers may still be using the last one.
+type Builder func(members Membership.Membership) Mapper
+
+// View is one version of a Handle. It is never changed once it is published,
+// so a reader holding one can make any number of lookups against the same
+// membership.
+type View struct {
+	Mapper  Mapper
+	Members Membership.Membership
+	Version uint64
+}
+
+// ErrNoMembers is returned by changes that would leave a Handle with no
+// members. Most mappers cannot place anything then, and some panic.
+var ErrNoMembers = errors.New("placement needs at least one member")
+
+// Handle holds the current placement and swaps in a new one when membership
+// changes. Readers never wait: they load the current View and use it. Writers
+// build the next View off to the side and publish it in one atomic store, so
+// a reader sees either all of a change or none of it.
+type Handle struct {
+	current atomic.Value // *View
+	build   Builder
+	writer  sync.Mutex
+}
+
+// New makes a new Handle placing keys on members with build, at version 1.
+// The View gets its own sorted copy of members, so the caller is free to
+// reuse the slice. It panics if there are no members.
+func New(members Membership.Membership, build Builder) *Handle {
+	members = Membership.New(members...)
+	if len(members) == 0 {
+		panic(ErrNoMembers)
+	}
+	h := &Handle{build: build}
+	h.current.Store(&View{build(members), members, 1})
+	return h
+}
+
+// Load returns the current View
+func (h *Handle) Load() *View {
+	return h.current.Load().(*View)
+}
+
+// Lookup returns the bucket for a given object hash and the version that
+// placed it
+func (h *Handle) Lookup(location uint64) (int, uint64) {
+	v := h.Load()
+	return v.Mapper.MapBucket(location), v.Version
+}
+
+// MapBucket returns the bucket for a given object hash in the current version
+func (h *Handle) MapBucket(location uint64) int {
+	return h.Load().Mapper.MapBucket(location)
+}
+
+// LookupBatch maps each location to the same position in out, which has to
+// be at least as long as locations, and returns the version that placed them.
+// The whole batch is placed by the same version.
+func (h *Handle) LookupBatch(locations []uint64, out []int) uint64 {
+	v := h.Load()
+	v.Mapper.MapBatch(locations, out)
+	return v.Version
+}
+
+// MapBatch is LookupBatch without the version
+func (h *Handle) MapBatch(locations []uint64, out []int) {
+	h.LookupBatch(locations, out)
+}
+
+// Name tells you who we are
+func (h *Handle) Name() string {
+	v := h.Load()
+	return fmt.Sprintf("Handle(v%d) %s", v.Version, v.Mapper.Name())
+}
+
+// Update replaces the members with what change returns when given the
+// current ones, and returns the version it published. Writers are applied one
+// at a time, so no change is lost to another made at the same moment.
+// Changes that leave the members as they were do not make a new version.
+// A change that leaves no members is refused with ErrNoMembers, and the
+// current View stays. What change returns is copied, sorted and
+// de-duplicated before it is published; change must not modify the members
+// it is given, which belong to the current View.
+func (h *Handle) Update(change func(members Membership.Membership) Membership.Membership) (uint64, error) {
+	h.writer.Lock()
+	defer h.writer.Unlock()
+	old := h.Load()
+	members := Membership.New(change(old.Members)...)
+	if len(members) == 0 {
+		return old.Version, ErrNoMembers
+	}
+	if len(members) == len(old.Members) && Membership.Common(members, old.Members) == len(members) {
+		return old.Version, nil
+	}
+	next := &View{h.build(members), members, old.Version + 1}
+	h.current.Store(next)
+	return next.Version, nil
+}
+
+// Set replaces the members
+func (h *Handle) Set(members Membership.Membership) (uint64, error) {
+	return h.Update(func(Membership.Membership) Membership.Membership { return members })
+}
+
+// Add adds buckets to the members
+func (h *Handle) Add(buckets ...int) (uint64, error) {
+	return h.Update(func(m Membership.Membership) Membership.Membership { return m.With(buckets...) })
+}
+
+// Remove takes buckets out of the members
+func (h *Handle) Remove(buckets ...int) (uint64, error) {
+	return h.Update(func(m Membership.Membership) Membership.Membership { return m.Without(buckets...) })
+}
+
+// positional serves any membership with a mapper that only serves a range,
+// by position
+type positional struct {
+	Mapper
+	members Membership.Membership
+}
+
+func (p positional) MapBucket(location uint64) int {
+	ix := p.Mapper.MapBucket(location)
+	if ix < 0 || ix >= len(p.members) {
+		return -1
+	}
+	return p.members[ix]
+}
+
+func (p positional) MapBatch(locations []uint64, out []int) {
+	p.Mapper.MapBatch(locations, out)
+	for ix, pos := range out[:len(locations)] {
+		if pos < 0 || pos >= len(p.members) {
+			out[ix] = -1
+		} else {
+			out[ix] = p.members[pos]
+		}
+	}
+}
+
+// Positional makes a Builder from the constructor of a mapper that only
+// serves the range 0 to n-1, such as JumpHash. Position i serves the ith
+// member, so a change in the middle shifts everyone above it.
+func Positional(build func(n int) Mapper) Builder {
+	return func(members Membership.Membership) Mapper {
+		return positional{build(len(members)), members}
+	}
+}
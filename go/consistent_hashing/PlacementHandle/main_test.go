@@ -0,0 +1,265 @@
+package PlacementHandle
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/ConsistentHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+)
+
+func jump(n int) Mapper {
+	return JumpHash.New(n)
+}
+
+func ring(members Membership.Membership) Mapper {
+	return ConsistentHashing.NewWithMembership(members, 10)
+}
+
+func TestVersions(t *testing.T) {
+	h := New(Membership.Range(10), Positional(jump))
+	locs := MapperTest.Locations(2000)
+	before := make([]int, len(locs), len(locs))
+	for ix, location := range locs {
+		before[ix] = h.MapBucket(location)
+	}
+
+	if v, err := h.Remove(3); v != 2 || err != nil {
+		t.Errorf("removing made version %d, %v", v, err)
+	}
+	if v, err := h.Remove(3); v != 2 || err != nil {
+		t.Errorf("removing again made version %d, %v", v, err)
+	}
+	for _, location := range locs {
+		if bucket, v := h.Lookup(location); bucket == 3 || v != 2 {
+			t.Fatalf("%x mapped to %d in version %d", location, bucket, v)
+		}
+	}
+
+	if v, err := h.Add(3); v != 3 || err != nil {
+		t.Errorf("adding made version %d, %v", v, err)
+	}
+	for ix, location := range locs {
+		if bucket := h.MapBucket(location); bucket != before[ix] {
+			t.Fatalf("%x mapped to %d after adding back, was %d", location, bucket, before[ix])
+		}
+	}
+	if h.Name() != "Handle(v3) JumpHash[10]" {
+		t.Errorf("unexpected name %s", h.Name())
+	}
+}
+
+// TestViewIsStable checks that a View keeps answering for its own version
+// after newer ones are published
+func TestViewIsStable(t *testing.T) {
+	h := New(Membership.Range(10), ring)
+	view := h.Load()
+	h.Set(Membership.New(20, 21, 22))
+	locs := MapperTest.Locations(2000)
+	for _, location := range locs {
+		if bucket := view.Mapper.MapBucket(location); !view.Members.Contains(bucket) || bucket >= 10 {
+			t.Fatalf("version %d mapped %x to %d", view.Version, location, bucket)
+		}
+		if bucket := h.MapBucket(location); bucket < 20 {
+			t.Fatalf("current version mapped %x to %d", location, bucket)
+		}
+	}
+}
+
+// TestCallerSlice checks that changing the slice a Handle was given does not
+// change the published View
+func TestCallerSlice(t *testing.T) {
+	members := Membership.Membership{3, 1, 2, 2}
+	h := New(members, ring)
+	members[0] = 7
+	if fmt.Sprint(h.Load().Members) != "[1 2 3]" {
+		t.Errorf("members are %v after New", h.Load().Members)
+	}
+	members = Membership.Membership{4, 5, 6}
+	h.Set(members)
+	members[0] = 9
+	if fmt.Sprint(h.Load().Members) != "[4 5 6]" {
+		t.Errorf("members are %v after Set", h.Load().Members)
+	}
+}
+
+// TestRefuseEmpty checks that changes leaving no members are refused and
+// that readers carry on with the View they had. A ring with no points would
+// panic on every lookup.
+func TestRefuseEmpty(t *testing.T) {
+	locs := MapperTest.Locations(1000)
+	for name, build := range map[string]Builder{"positional": Positional(jump), "ring": ring} {
+		h := New(Membership.Range(2), build)
+		before := h.Load()
+		changes := map[string]func() (uint64, error){
+			"Remove": func() (uint64, error) { return h.Remove(0, 1) },
+			"Set":    func() (uint64, error) { return h.Set(nil) },
+			"Update": func() (uint64, error) {
+				return h.Update(func(Membership.Membership) Membership.Membership { return Membership.Membership{} })
+			},
+		}
+		for change, apply := range changes {
+			if v, err := apply(); err != ErrNoMembers || v != 1 {
+				t.Errorf("%s: %s to no members gave version %d, %v", name, change, v, err)
+			}
+		}
+		if h.Load() != before {
+			t.Fatalf("%s: view replaced by a refused change", name)
+		}
+		for _, location := range locs {
+			if bucket, v := h.Lookup(location); v != 1 || !before.Members.Contains(bucket) {
+				t.Fatalf("%s: %x mapped to %d in version %d after a refused change", name, location, bucket, v)
+			}
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("New accepted no members")
+		}
+	}()
+	New(nil, ring)
+}
+
+// TestConcurrent runs readers and writers together. Readers check that every
+// answer is a member of the version that gave it and that versions never go
+// backwards. Writers each toggle their own buckets, so the final membership
+// shows whether any update was lost. Run it with -race.
+func TestConcurrent(t *testing.T) {
+	const writers, readers, steps = 4, 4, 200
+	h := New(Membership.Range(8), ring)
+	locs := MapperTest.Locations(1024)
+
+	done := make(chan struct{})
+	errs := make(chan error, readers)
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := uint64(0)
+			for ix := 0; ; ix++ {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				view := h.Load()
+				location := locs[ix&1023]
+				if bucket := view.Mapper.MapBucket(location); !view.Members.Contains(bucket) {
+					errs <- fmt.Errorf("version %d mapped %x to %d, not one of %v", view.Version, location, bucket, view.Members)
+					return
+				}
+				_, v := h.Lookup(location)
+				if v < view.Version || view.Version < last {
+					errs <- fmt.Errorf("version went from %d to %d to %d", last, view.Version, v)
+					return
+				}
+				last = v
+				if ix&63 == 0 {
+					// let the writers in when there are few CPUs
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+
+	expected := Membership.Range(8)
+	var writing sync.WaitGroup
+	var mu sync.Mutex
+	for w := 0; w < writers; w++ {
+		writing.Add(1)
+		go func(w int) {
+			defer writing.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			mine := map[int]bool{}
+			last := uint64(0)
+			for step := 0; step < steps; step++ {
+				b := 100 + 10*w + r.Intn(10)
+				var v uint64
+				var err error
+				if mine[b] {
+					v, err = h.Remove(b)
+				} else {
+					v, err = h.Add(b)
+				}
+				if err != nil {
+					t.Errorf("writer %d: %v", w, err)
+				}
+				mine[b] = !mine[b]
+				if v <= last {
+					t.Errorf("writer %d: version %d after %d", w, v, last)
+				}
+				last = v
+			}
+			mu.Lock()
+			for b, in := range mine {
+				if in {
+					expected = expected.With(b)
+				}
+			}
+			mu.Unlock()
+		}(w)
+	}
+	writing.Wait()
+	close(done)
+	wg.Wait()
+	for r := 0; r < readers; r++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	view := h.Load()
+	if fmt.Sprint(view.Members) != fmt.Sprint(expected) {
+		t.Errorf("ended with %v, expected %v", view.Members, expected)
+	}
+	if view.Version != 1+writers*steps {
+		t.Errorf("ended at version %d, expected %d", view.Version, 1+writers*steps)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	h := New(Membership.Range(100), ring)
+	b.Run("direct", func(b *testing.B) {
+		m := h.Load().Mapper
+		for i := 0; i < b.N; i++ {
+			m.MapBucket(locs[i&1023])
+		}
+	})
+	b.Run("handle", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.Lookup(locs[i&1023])
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				h.Lookup(locs[i&1023])
+			}
+		})
+	})
+}
+
+// TestLookupBatch checks that a batch reports the version that placed it.
+// The root package checks that batches match single lookups.
+func TestLookupBatch(t *testing.T) {
+	h := New(Membership.Range(10), Positional(jump))
+	h.Remove(3)
+	locs := MapperTest.Locations(1000)
+	out := make([]int, len(locs), len(locs))
+	if version := h.LookupBatch(locs, out); version != 2 {
+		t.Errorf("batch placed by version %d, expected 2", version)
+	}
+	for ix, location := range locs {
+		if out[ix] == 3 {
+			t.Fatalf("%x batched to removed bucket 3", location)
+		}
+	}
+}
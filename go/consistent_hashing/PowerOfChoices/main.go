@@ -0,0 +1,212 @@
+package PowerOfChoices
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// LoadOracle tells a ChoiceHash how loaded each bucket is. It is read on
+// every lookup, so it needs to be cheap and safe to call concurrently.
+type LoadOracle interface {
+	Load(bucket int) uint64
+}
+
+// ChoiceHash places each object on the least loaded of d candidate buckets.
+// Candidate i is the JumpHash of the ith iterated hash of the location, so
+// the candidates are independent of one another but each one is consistent
+// on its own. With d=2, the fullest of n buckets holding n objects drops from
+// about ln n/ln ln n objects to about ln ln n/ln 2.
+// https://www.eecs.harvard.edu/~michaelm/postscripts/mythesis.pdf
+//
+// Unlike the other mappers, the answer depends on the loads at the time of
+// the call. Something placed earlier may not be on the bucket MapBucket
+// returns now, so readers have to look on all of its Candidates.
+type ChoiceHash struct {
+	jump    *JumpHash.JumpHash
+	buckets int
+	choices int
+	oracle  LoadOracle
+}
+
+// New makes a new ChoiceHash picking from choices candidates by the loads
+// oracle reports. A nil oracle sees every bucket as empty, so it always picks
+// the first candidate and acts like a plain JumpHash.
+func New(buckets int, choices int, oracle LoadOracle) *ChoiceHash {
+	if choices < 1 {
+		choices = 1
+	}
+	if oracle == nil {
+		oracle = empty{}
+	}
+	return &ChoiceHash{JumpHash.New(buckets), buckets, choices, oracle}
+}
+
+// Candidates fills out with the buckets a given object hash may be placed on,
+// in order of preference, and returns it. Two candidates may be the same
+// bucket.
+func (ch *ChoiceHash) Candidates(location uint64, out []int) []int {
+	out = out[:0]
+	for i := 0; i < ch.choices; i++ {
+		out = append(out, ch.jump.MapBucket(location))
+		location = ObjectHasher.PlaceUInt64N(location, 1)
+	}
+	return out
+}
+
+// MapBucket returns the least loaded candidate for a given object hash. Ties
+// go to the earlier candidate.
+func (ch *ChoiceHash) MapBucket(location uint64) int {
+	best := ch.jump.MapBucket(location)
+	bestLoad := ch.oracle.Load(best)
+	for i := 1; i < ch.choices && bestLoad > 0; i++ {
+		location = ObjectHasher.PlaceUInt64N(location, 1)
+		b := ch.jump.MapBucket(location)
+		if load := ch.oracle.Load(b); load < bestLoad {
+			best, bestLoad = b, load
+		}
+	}
+	return best
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations. Loads are read as each location is placed,
+// so if the caller updates them in between, a batch can place differently
+// than one call at a time.
+func (ch *ChoiceHash) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = ch.MapBucket(location)
+	}
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which objects are expected to
+// need moving. An object is found by looking on all of its candidates, so it
+// only has to move if one of them changed.
+func (ch *ChoiceHash) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	stay := 1 - ch.jump.ExpectedMoveRate(from, to)
+	return 1 - math.Pow(stay, float64(ch.choices))
+}
+
+// Name tells you who we are
+func (ch *ChoiceHash) Name() string {
+	return fmt.Sprintf("PowerOf%dChoices[%d]", ch.choices, ch.buckets)
+}
+
+// SnapshotKind identifies ChoiceHash snapshots
+const SnapshotKind = "PowerOfChoices"
+
+const snapshotVersion = 1
+
+type choiceState struct {
+	Buckets int `json:"buckets"`
+	Choices int `json:"choices"`
+}
+
+// restore rebuilds a ChoiceHash from its bucket and choice counts. Loads are
+// not part of the snapshot, so it keeps the oracle it already had. The
+// bucket count is checked here, since JumpHash.New panics on one that does
+// not fit in an int32.
+func (ch *ChoiceHash) restore(state choiceState) error {
+	if state.Buckets < 1 || state.Choices < 1 {
+		return fmt.Errorf("snapshot has %d choices of %d buckets", state.Choices, state.Buckets)
+	}
+	if state.Buckets > math.MaxInt32 {
+		return fmt.Errorf("snapshot bucket count %d does not fit in an int32", state.Buckets)
+	}
+	if state.Buckets > Snapshot.MaxBuckets {
+		return fmt.Errorf("snapshot bucket count %d is over %d", state.Buckets, Snapshot.MaxBuckets)
+	}
+	*ch = *New(state.Buckets, state.Choices, ch.oracle)
+	return nil
+}
+
+// MarshalBinary encodes the ChoiceHash as a versioned snapshot
+func (ch *ChoiceHash) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(ch.buckets)
+	e.Int(ch.choices)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the ChoiceHash with the one in a snapshot
+func (ch *ChoiceHash) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := choiceState{Buckets: d.Int(), Choices: d.Int()}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return ch.restore(state)
+}
+
+// MarshalJSON encodes the ChoiceHash as a versioned snapshot
+func (ch *ChoiceHash) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, choiceState{ch.buckets, ch.choices})
+}
+
+// UnmarshalJSON replaces the ChoiceHash with the one in a snapshot
+func (ch *ChoiceHash) UnmarshalJSON(data []byte) error {
+	state := choiceState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return ch.restore(state)
+}
+
+// empty is the oracle used when none is given
+type empty struct{}
+
+func (empty) Load(int) uint64 { return 0 }
+
+// Counter is a LoadOracle counting what has been placed on each bucket. It is
+// safe for concurrent use.
+type Counter struct {
+	counts []uint64
+}
+
+// NewCounter makes a new Counter with every bucket empty
+func NewCounter(buckets int) *Counter {
+	return &Counter{make([]uint64, buckets, buckets)}
+}
+
+// Add counts one more object on a bucket
+func (c *Counter) Add(bucket int) {
+	atomic.AddUint64(&c.counts[bucket], 1)
+}
+
+// Remove counts one less object on a bucket
+func (c *Counter) Remove(bucket int) {
+	atomic.AddUint64(&c.counts[bucket], ^uint64(0))
+}
+
+// Load returns how many objects are on a bucket
+func (c *Counter) Load(bucket int) uint64 {
+	return atomic.LoadUint64(&c.counts[bucket])
+}
+
+// Max returns the load of the fullest bucket
+func (c *Counter) Max() uint64 {
+	max := uint64(0)
+	for ix := range c.counts {
+		if load := c.Load(ix); load > max {
+			max = load
+		}
+	}
+	return max
+}
+
+// Mean returns the average load across buckets
+func (c *Counter) Mean() float64 {
+	total := uint64(0)
+	for ix := range c.counts {
+		total += c.Load(ix)
+	}
+	return float64(total) / float64(len(c.counts))
+}
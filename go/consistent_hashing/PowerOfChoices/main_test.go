@@ -0,0 +1,166 @@
+package PowerOfChoices
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+func TestCandidates(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		ch := New(size, 3, nil)
+		out := []int{}
+		for _, location := range MapperTest.Locations(1000) {
+			out = ch.Candidates(location, out)
+			if len(out) != 3 {
+				t.Fatalf("size %d: %x has %d candidates", size, location, len(out))
+			}
+			for _, b := range out {
+				if b < 0 || b >= size {
+					t.Fatalf("size %d: %x has candidate %d", size, location, b)
+				}
+			}
+			if out[1] != ch.jump.MapBucket(ObjectHasher.PlaceUInt64N(location, 1)) {
+				t.Fatalf("size %d: %x second candidate %d is not from its second hash", size, location, out[1])
+			}
+		}
+	}
+}
+
+// With nothing loaded, the first candidate always wins
+func TestEmptyOracleIsJumpHash(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		ch := New(size, 2, nil)
+		jh := JumpHash.New(size)
+		for _, location := range MapperTest.Locations(1000) {
+			if a, b := ch.MapBucket(location), jh.MapBucket(location); a != b {
+				t.Fatalf("size %d: %x mapped to %d, jump says %d", size, location, a, b)
+			}
+		}
+	}
+}
+
+func TestPicksLeastLoaded(t *testing.T) {
+	counter := NewCounter(100)
+	ch := New(100, 4, counter)
+	out := []int{}
+	for _, location := range MapperTest.Locations(10000) {
+		b := ch.MapBucket(location)
+		out = ch.Candidates(location, out)
+		for _, c := range out {
+			if counter.Load(c) < counter.Load(b) {
+				t.Fatalf("%x mapped to %d with load %d, but candidate %d has %d", location, b, counter.Load(b), c, counter.Load(c))
+			}
+		}
+		counter.Add(b)
+	}
+}
+
+// Placing n objects on n buckets, the fullest bucket holds about 6 with one
+// choice and about 3 with two
+func TestMaxLoad(t *testing.T) {
+	const size = 10000
+	locs := MapperTest.Locations(size)
+	max := []uint64{}
+	for _, choices := range []int{1, 2, 3} {
+		counter := NewCounter(size)
+		ch := New(size, choices, counter)
+		for _, location := range locs {
+			counter.Add(ch.MapBucket(location))
+		}
+		if counter.Mean() != 1 {
+			t.Fatalf("%d choices: mean load %f", choices, counter.Mean())
+		}
+		max = append(max, counter.Max())
+	}
+	if max[0] < 5 || max[1] > 4 || max[2] > max[1] {
+		t.Errorf("max loads %v for 1, 2 and 3 choices", max)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter(4)
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				counter.Add(w)
+				counter.Add(3)
+				counter.Remove(3)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for b := 0; b < 3; b++ {
+		if counter.Load(b) != 1000 {
+			t.Errorf("bucket %d has %d", b, counter.Load(b))
+		}
+	}
+	if counter.Load(3) != 1000 || counter.Max() != 1000 || counter.Mean() != 1000 {
+		t.Errorf("bucket 3 has %d, max %d, mean %f", counter.Load(3), counter.Max(), counter.Mean())
+	}
+}
+
+func TestExpectedMoveRate(t *testing.T) {
+	from, to := Membership.Range(10), Membership.Range(11)
+	if a, b := New(10, 1, nil).ExpectedMoveRate(from, to), JumpHash.New(10).ExpectedMoveRate(from, to); math.Abs(a-b) > 1e-9 {
+		t.Errorf("one choice expects %f, jump expects %f", a, b)
+	}
+	// an object keeps all of its candidates with probability (10/11)^2
+	if actual, expected := New(10, 2, nil).ExpectedMoveRate(from, to), 1-100.0/121; math.Abs(actual-expected) > 1e-9 {
+		t.Errorf("expected %f, got %f", expected, actual)
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range []int{8, 1024} {
+		for _, choices := range []int{1, 2, 4} {
+			counter := NewCounter(size)
+			for _, location := range locs {
+				counter.Add(int(location % uint64(size)))
+			}
+			ch := New(size, choices, counter)
+			b.Run(fmt.Sprintf("buckets=%d/choices=%d", size, choices), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					ch.MapBucket(locs[i&1023])
+				}
+			})
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.SnapshotRoundTrip(t, New(size, 2, nil), func() MapperTest.Snapshotter { return &ChoiceHash{} })
+	}
+}
+
+// TestSnapshotBucketCount checks that bucket counts JumpHash would panic on
+// are refused before anything is built
+func TestSnapshotBucketCount(t *testing.T) {
+	for _, buckets := range []int{0, -1, Snapshot.MaxBuckets + 1, math.MaxInt32 + 1} {
+		e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+		e.Int(buckets)
+		e.Int(2)
+		if err := (&ChoiceHash{}).UnmarshalBinary(e.Bytes()); err == nil {
+			t.Errorf("binary snapshot with %d buckets accepted", buckets)
+		}
+		data, err := Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, choiceState{buckets, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&ChoiceHash{}).UnmarshalJSON(data); err == nil {
+			t.Errorf("JSON snapshot with %d buckets accepted", buckets)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package RendezvousHashing
 import (
 	"encoding/binary"
 	"fmt"
-	"math"
+	"math/bits"
 
 	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
 )
 
 // RendezvousHashGroup maintains uniformity and least-moves by hashing the
@@ -41,14 +43,118 @@ func (rhg *RendezvousHashGroup) MapBucket(location uint64) int {
 	return int(maxIx)
 }
 
-// ExpectedMoveRate returns the rate (0-1) at which members are expected to move
-func (rhg *RendezvousHashGroup) ExpectedMoveRate(otherSize int) float64 {
-	otherSize++
-	buckets := int(rhg.Buckets + 1)
-	return math.Abs(float64(otherSize-buckets)) / float64(buckets)
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations. Every key is scored against every bucket, so
+// the scoring is what has to be fast: hash8 is xxhash64 of the location's 8
+// bytes written out, with nothing allocated and no buffer to read back. The
+// keys go through in blocks, bucket by bucket, so each bucket's seed is set
+// up once per block and the scores for a block are independent of each
+// other, which lets the CPU work on several at a time.
+func (rhg *RendezvousHashGroup) MapBatch(locations []uint64, out []int) {
+	const block = 64
+	var best [block]uint64
+	for lo := 0; lo < len(locations); lo += block {
+		keys := locations[lo:]
+		if len(keys) > block {
+			keys = keys[:block]
+		}
+		winners := out[lo : lo+len(keys)]
+		for ix := range keys {
+			best[ix], winners[ix] = 0, 0
+		}
+		for b := uint64(0); b < rhg.Buckets; b++ {
+			seed := b + prime5 + 8
+			for ix, location := range keys {
+				if h := hash8(seed, location); h > best[ix] {
+					best[ix], winners[ix] = h, int(b)
+				}
+			}
+		}
+	}
+}
+
+const (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// hash8 is xxhash64 of the 8 little-endian bytes of v, for a seed already
+// offset by prime5 and the length
+func hash8(seed, v uint64) uint64 {
+	h := seed ^ (bits.RotateLeft64(v*prime2, 31) * prime1)
+	h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. A key stays when its top scoring bucket over both memberships is in
+// both.
+func (rhg *RendezvousHashGroup) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
 }
 
 // Name tells you who we are
 func (rhg *RendezvousHashGroup) Name() string {
 	return fmt.Sprintf("RendezvousHash[%d]", rhg.Buckets)
 }
+
+// SnapshotKind identifies RendezvousHashGroup snapshots
+const SnapshotKind = "RendezvousHash"
+
+const snapshotVersion = 1
+
+type rendezvousState struct {
+	Buckets uint64 `json:"buckets"`
+}
+
+// restore checks and installs decoded fields. A group with no buckets would
+// still map every key to bucket 0, so it is refused.
+func (rhg *RendezvousHashGroup) restore(buckets uint64) error {
+	if buckets == 0 {
+		return fmt.Errorf("snapshot has no buckets")
+	}
+	rhg.Buckets = buckets
+	return nil
+}
+
+// MarshalBinary encodes the group as a versioned snapshot
+func (rhg *RendezvousHashGroup) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(rhg.Buckets)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the group with the one in a snapshot
+func (rhg *RendezvousHashGroup) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	buckets := d.Uint64()
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return rhg.restore(buckets)
+}
+
+// MarshalJSON encodes the group as a versioned snapshot
+func (rhg *RendezvousHashGroup) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, rendezvousState{rhg.Buckets})
+}
+
+// UnmarshalJSON replaces the group with the one in a snapshot
+func (rhg *RendezvousHashGroup) UnmarshalJSON(data []byte) error {
+	state := rendezvousState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return rhg.restore(state.Buckets)
+}
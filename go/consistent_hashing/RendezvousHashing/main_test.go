@@ -0,0 +1,93 @@
+package RendezvousHashing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+func TestMapBucketDeterministic(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Same(t, New(size), New(size), MapperTest.Locations(200))
+	}
+}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, size := range MapperTest.Sizes[:5] {
+		MapperTest.Range(t, New(size), size)
+	}
+}
+
+func TestMinimalDisruption(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Growth(t, New(size), New(size+1), size, 0.03)
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range MapperTest.Sizes {
+		rhg := New(size)
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rhg.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.SnapshotRoundTrip(t, New(size), func() MapperTest.Snapshotter { return &RendezvousHashGroup{} })
+	}
+}
+
+func TestSnapshotNoBuckets(t *testing.T) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Uint64(0)
+	if err := (&RendezvousHashGroup{}).UnmarshalBinary(e.Bytes()); err == nil {
+		t.Errorf("binary snapshot with no buckets accepted")
+	}
+	data, err := Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, rendezvousState{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&RendezvousHashGroup{}).UnmarshalJSON(data); err == nil {
+		t.Errorf("JSON snapshot with no buckets accepted")
+	}
+}
+
+func TestHash8(t *testing.T) {
+	b := make([]byte, 8)
+	for _, seed := range []uint64{0, 1, 2, 1023, math.MaxUint64} {
+		for _, v := range append([]uint64{0, 1, math.MaxUint64}, MapperTest.Locations(100)...) {
+			binary.LittleEndian.PutUint64(b, v)
+			if expected := xxhash.Checksum64S(b, seed); hash8(seed+prime5+8, v) != expected {
+				t.Fatalf("seed %d, %x: hashed to %x, expected %x", seed, v, hash8(seed+prime5+8, v), expected)
+			}
+		}
+	}
+}
+
+func BenchmarkMapBatch(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	out := make([]int, len(locs), len(locs))
+	for _, size := range MapperTest.Sizes {
+		rhg := New(size)
+		b.Run(fmt.Sprintf("buckets=%d/scalar", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				out[i&1023] = rhg.MapBucket(locs[i&1023])
+			}
+		})
+		b.Run(fmt.Sprintf("buckets=%d/batch", size), func(b *testing.B) {
+			for i := 0; i < b.N; i += len(locs) {
+				rhg.MapBatch(locs, out)
+			}
+		})
+	}
+}
@@ -3,17 +3,23 @@ package RendezvousHashingWithSkeleton
 import (
 	"encoding/binary"
 	"fmt"
-	"math"
 
 	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
 )
 
 type member interface {
 	mapBucket(locationBytes []byte) int
 }
 
+// innerGroup picks among its children with rendezvous hashing. Each child
+// has its own seed, distinct from every bucket and every other node in the
+// tree. Reusing seeds between levels correlates the choices made at each
+// level, which starves most buckets of keys.
 type innerGroup struct {
 	children []member
+	seeds    []uint64
 }
 
 func (ig *innerGroup) mapBucket(locationBytes []byte) int {
@@ -21,7 +27,7 @@ func (ig *innerGroup) mapBucket(locationBytes []byte) int {
 	maxHashVal := uint64(0)
 
 	for ix := 0; ix < len(ig.children); ix++ {
-		h := xxhash.NewS64(uint64(ix))
+		h := xxhash.NewS64(ig.seeds[ix])
 		h.Write(locationBytes)
 		hv := h.Sum64()
 		if hv > maxHashVal {
@@ -58,6 +64,7 @@ func (c cluster) mapBucket(locationBytes []byte) int {
 // combined value
 type RendezvousHashGroup struct {
 	children []member
+	seeds    []uint64
 	Buckets  int
 	M        int
 	F        int
@@ -79,23 +86,39 @@ func New(buckets int, m int, f int) *RendezvousHashGroup {
 		members[ix] = cluster{firstB, lastB}
 	}
 
+	level := uint64(1)
+	seeds := levelSeeds(level, len(members))
 	for len(members) > f {
 		newCnt := 1 + (len(members)-1)/f
 		newMembers := make([]member, newCnt, newCnt)
 		for ix := 0; len(members) > 0; ix++ {
 			if f >= len(members) {
-				newMembers[ix] = &innerGroup{members}
+				newMembers[ix] = &innerGroup{members, seeds}
 				members = members[0:0]
 			} else {
-				newMembers[ix] = &innerGroup{members[:f]}
+				newMembers[ix] = &innerGroup{members[:f], seeds[:f]}
 				members = members[f:]
+				seeds = seeds[f:]
 			}
 		}
 
 		members = newMembers
+		level++
+		seeds = levelSeeds(level, len(members))
 	}
 
-	return &RendezvousHashGroup{members, buckets, m, f}
+	return &RendezvousHashGroup{members, seeds, buckets, m, f}
+}
+
+// levelSeeds makes the seeds for the nodes at one level of the tree. Buckets
+// are seeded with their own number, so the level goes in the upper bits to
+// keep every seed in the tree unique.
+func levelSeeds(level uint64, cnt int) []uint64 {
+	seeds := make([]uint64, cnt, cnt)
+	for ix := range seeds {
+		seeds[ix] = level<<32 | uint64(ix)
+	}
+	return seeds
 }
 
 // MapBucket will return the correct bucket for the provided hash value
@@ -107,7 +130,7 @@ func (rhg *RendezvousHashGroup) MapBucket(location uint64) int {
 	binary.LittleEndian.PutUint64(b, location)
 
 	for ix := 0; ix < len(rhg.children); ix++ {
-		h := xxhash.NewS64(uint64(ix))
+		h := xxhash.NewS64(rhg.seeds[ix])
 		h.Write(b)
 		hv := h.Sum64()
 		if hv > maxHash {
@@ -118,14 +141,248 @@ func (rhg *RendezvousHashGroup) MapBucket(location uint64) int {
 	return rhg.children[maxIx].mapBucket(b)
 }
 
-// ExpectedMoveRate returns the rate (0-1) at which members are expected to move
-func (rhg *RendezvousHashGroup) ExpectedMoveRate(otherSize int) float64 {
-	otherSize++
-	buckets := int(rhg.Buckets + 1)
-	return math.Abs(float64(otherSize-buckets)) / float64(buckets)
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (rhg *RendezvousHashGroup) MapBatch(locations []uint64, out []int) {
+	for ix, location := range locations {
+		out[ix] = rhg.MapBucket(location)
+	}
+}
+
+// choice is one pick on the way down the tree: the node taken and the range
+// of its siblings. Nodes are numbered across their level, so they are their
+// own seeds' low bits, and buckets are their own seeds.
+type choice struct {
+	lo, hi, self int
+}
+
+// path lists the choices that lead to bucket position ix in a tree of n
+// buckets, from the pick within its cluster up to the root's
+func path(n int, m int, f int, ix int) []choice {
+	p := []choice{}
+	for size := m; ; size = f {
+		lo := ix / size * size
+		hi := lo + size - 1
+		if hi >= n {
+			hi = n - 1
+		}
+		p = append(p, choice{lo, hi, ix})
+		ix, n = ix/size, 1+(n-1)/size
+		// the root picks among everything left
+		if n <= f {
+			return append(p, choice{0, n - 1, ix})
+		}
+	}
+}
+
+// joint is the chance that a key picks a among its siblings and b among its,
+// where both are picks at the same level of two trees. Nodes with the same
+// seed score a key the same in both, so the two picks are only independent
+// when no seed is in both ranges.
+func joint(a, b choice) float64 {
+	s, t := float64(a.hi-a.lo+1), float64(b.hi-b.lo+1)
+	u := s + t
+	if a.lo <= b.hi && b.lo <= a.hi {
+		lo, hi := a.lo, a.hi
+		if b.lo < lo {
+			lo = b.lo
+		}
+		if b.hi > hi {
+			hi = b.hi
+		}
+		u = float64(hi - lo + 1)
+	}
+	aInB := b.lo <= a.self && a.self <= b.hi
+	bInA := a.lo <= b.self && b.self <= a.hi
+	switch {
+	case a.self == b.self:
+		// the same node has to top both ranges
+		return 1 / u
+	case aInB && bInA:
+		return 0
+	case aInB:
+		// b tops everything, and a tops the rest of its range
+		return 1 / u / s
+	case bInA:
+		return 1 / u / t
+	}
+	// whichever of the two scores higher tops everything
+	return (1/s + 1/t) / u
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. The tree is built by position, so memberships are served that way: the
+// ith member is bucket i. A key stays when it reaches positions holding the
+// same member in both trees. Every node is seeded by its level and place in
+// it, so the two trees share seeds wherever they share nodes, and the chance
+// of each pair of paths is worked out level by level from the seeds they
+// have in common.
+func (rhg *RendezvousHashGroup) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	if len(from) == 0 || len(to) == 0 {
+		return Membership.MinimalMoveRate(from, to)
+	}
+	stay := 0.0
+	for ix, b := range from {
+		jx := to.IndexOf(b)
+		if jx < 0 {
+			continue
+		}
+		p, q := path(len(from), rhg.M, rhg.F, ix), path(len(to), rhg.M, rhg.F, jx)
+		chance := 1.0
+		for level := 0; level < len(p) || level < len(q); level++ {
+			switch {
+			case level >= len(q):
+				chance /= float64(p[level].hi - p[level].lo + 1)
+			case level >= len(p):
+				chance /= float64(q[level].hi - q[level].lo + 1)
+			default:
+				chance *= joint(p[level], q[level])
+			}
+		}
+		stay += chance
+	}
+	return 1 - stay
 }
 
 // Name tells you who we are
 func (rhg *RendezvousHashGroup) Name() string {
 	return fmt.Sprintf("RendezvousHashSkeleton(%d, %d)[%d]", rhg.M, rhg.F, rhg.Buckets)
 }
+
+// SnapshotKind identifies RendezvousHashGroup snapshots
+const SnapshotKind = "RendezvousHashSkeleton"
+
+const snapshotVersion = 1
+
+// nodeState is one node of the tree. Clusters have the range of buckets
+// they pick from, inner groups have children.
+type nodeState struct {
+	Seed     uint64      `json:"seed"`
+	Cluster  []int       `json:"cluster,omitempty"`
+	Children []nodeState `json:"children,omitempty"`
+}
+
+type skeletonState struct {
+	Buckets  int         `json:"buckets"`
+	M        int         `json:"m"`
+	F        int         `json:"f"`
+	Children []nodeState `json:"children"`
+}
+
+func toState(children []member, seeds []uint64) []nodeState {
+	states := make([]nodeState, len(children), len(children))
+	for ix, child := range children {
+		states[ix].Seed = seeds[ix]
+		switch c := child.(type) {
+		case cluster:
+			states[ix].Cluster = []int{c.minBucket, c.maxBucket}
+		case *innerGroup:
+			states[ix].Children = toState(c.children, c.seeds)
+		}
+	}
+	return states
+}
+
+// fromState rebuilds the tree, making sure every node can answer a lookup
+// with a bucket below buckets
+func fromState(states []nodeState, buckets int) ([]member, []uint64, error) {
+	if len(states) == 0 {
+		return nil, nil, fmt.Errorf("snapshot has a group with no children")
+	}
+	children := make([]member, len(states), len(states))
+	seeds := make([]uint64, len(states), len(states))
+	for ix, s := range states {
+		seeds[ix] = s.Seed
+		if s.Cluster != nil {
+			if len(s.Cluster) != 2 || s.Cluster[0] < 0 || s.Cluster[0] > s.Cluster[1] || s.Cluster[1] >= buckets {
+				return nil, nil, fmt.Errorf("snapshot has cluster %v with %d buckets", s.Cluster, buckets)
+			}
+			children[ix] = cluster{s.Cluster[0], s.Cluster[1]}
+			continue
+		}
+		inner, innerSeeds, err := fromState(s.Children, buckets)
+		if err != nil {
+			return nil, nil, err
+		}
+		children[ix] = &innerGroup{inner, innerSeeds}
+	}
+	return children, seeds, nil
+}
+
+func (rhg *RendezvousHashGroup) restore(state skeletonState) error {
+	children, seeds, err := fromState(state.Children, state.Buckets)
+	if err != nil {
+		return err
+	}
+	*rhg = RendezvousHashGroup{children, seeds, state.Buckets, state.M, state.F}
+	return nil
+}
+
+func encodeNodes(e *Snapshot.Encoder, states []nodeState) {
+	e.Uint64(uint64(len(states)))
+	for _, s := range states {
+		e.Uint64(s.Seed)
+		if s.Cluster != nil {
+			e.Uint64(0)
+			e.Int(s.Cluster[0])
+			e.Int(s.Cluster[1])
+			continue
+		}
+		e.Uint64(1)
+		encodeNodes(e, s.Children)
+	}
+}
+
+func decodeNodes(d *Snapshot.Decoder) []nodeState {
+	states := make([]nodeState, d.Len(3))
+	for ix := range states {
+		states[ix].Seed = d.Uint64()
+		switch d.Uint64() {
+		case 0:
+			states[ix].Cluster = []int{d.Int(), d.Int()}
+		case 1:
+			states[ix].Children = decodeNodes(d)
+		default:
+			d.Fail("snapshot has an unknown node type")
+		}
+	}
+	return states
+}
+
+// MarshalBinary encodes the group, tree and all, as a versioned snapshot
+func (rhg *RendezvousHashGroup) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(rhg.Buckets)
+	e.Int(rhg.M)
+	e.Int(rhg.F)
+	encodeNodes(e, toState(rhg.children, rhg.seeds))
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the group with the one in a snapshot
+func (rhg *RendezvousHashGroup) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := skeletonState{Buckets: d.Int(), M: d.Int(), F: d.Int()}
+	state.Children = decodeNodes(d)
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return rhg.restore(state)
+}
+
+// MarshalJSON encodes the group, tree and all, as a versioned snapshot
+func (rhg *RendezvousHashGroup) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, skeletonState{rhg.Buckets, rhg.M, rhg.F, toState(rhg.children, rhg.seeds)})
+}
+
+// UnmarshalJSON replaces the group with the one in a snapshot
+func (rhg *RendezvousHashGroup) UnmarshalJSON(data []byte) error {
+	state := skeletonState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return rhg.restore(state)
+}
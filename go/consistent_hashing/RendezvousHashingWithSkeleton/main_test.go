@@ -0,0 +1,209 @@
+package RendezvousHashingWithSkeleton
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+)
+
+// configs are bucket count, cluster size and fanout. Adding one bucket to any
+// of these either fills out the last cluster or, for {100, 4, 3}, opens a new
+// one at the end without changing the height of the tree. Either way only the
+// groups on the new bucket's path change.
+var configs = [][3]int{
+	{1, 4, 3},
+	{9, 4, 3},
+	{29, 10, 5},
+	{100, 4, 3},
+	{1023, 4, 3},
+}
+
+func TestMapBucketDeterministic(t *testing.T) {
+	for _, c := range configs {
+		MapperTest.Same(t, New(c[0], c[1], c[2]), New(c[0], c[1], c[2]), MapperTest.Locations(1000))
+	}
+}
+
+func TestMapBucketRange(t *testing.T) {
+	for _, c := range configs {
+		MapperTest.Range(t, New(c[0], c[1], c[2]), c[0])
+	}
+}
+
+// share walks the tree to bucket, returning the share of the keys that reach
+// it. Every group and cluster splits its keys evenly between its children.
+func share(children []member, bucket int) float64 {
+	for _, child := range children {
+		switch c := child.(type) {
+		case cluster:
+			if c.minBucket <= bucket && bucket <= c.maxBucket {
+				return 1 / float64(len(children)) / float64(c.maxBucket-c.minBucket+1)
+			}
+		case *innerGroup:
+			if s := share(c.children, bucket); s > 0 {
+				return s / float64(len(children))
+			}
+		}
+	}
+	return 0
+}
+
+// TestMinimalDisruptionWithinCluster checks that growing by one bucket only
+// moves keys to it. The new bucket only competes within its cluster, so it
+// gets its share of that cluster rather than of the whole group.
+func TestMinimalDisruptionWithinCluster(t *testing.T) {
+	for _, c := range configs {
+		from, to := New(c[0], c[1], c[2]), New(c[0]+1, c[1], c[2])
+		locs := MapperTest.Locations(20000)
+		moved := 0
+		for _, location := range locs {
+			a, b := from.MapBucket(location), to.MapBucket(location)
+			if a == b {
+				continue
+			}
+			moved++
+			if b != c[0] {
+				t.Fatalf("%v: %x moved from %d to %d, not the new bucket", c, location, a, b)
+			}
+		}
+		expected := share(to.children, c[0])
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.01 {
+			t.Errorf("%v: %0.4f moved, expected %0.4f", c, actual, expected)
+		}
+	}
+}
+
+func TestExpectedMoveRate(t *testing.T) {
+	for _, c := range configs {
+		from, to := Membership.Range(c[0]), Membership.Range(c[0]+1)
+		checkMoveRate(t, c[1], c[2], from, to)
+	}
+}
+
+// TestExpectedMoveRateByPosition covers memberships that are not ranges, and
+// changes that add a level to the tree or take one away
+func TestExpectedMoveRateByPosition(t *testing.T) {
+	from := Membership.Range(36)
+	for _, to := range []Membership.Membership{
+		from.Without(35),
+		from.Without(4),
+		from.Without(0).With(36, 37),
+		// 9 clusters of 4 fit under a root of 3, 10 need another level
+		from.With(36),
+		Membership.Range(200),
+		Membership.Range(5),
+	} {
+		checkMoveRate(t, 4, 3, from, to)
+	}
+	checkMoveRate(t, 10, 5, Membership.New(3, 8, 20, 21, 40), Membership.New(3, 20, 21, 40, 41, 42))
+}
+
+// checkMoveRate serves both memberships by position and compares the keys
+// that move with the model
+func checkMoveRate(t *testing.T, m int, f int, from, to Membership.Membership) {
+	t.Helper()
+	a, b := New(len(from), m, f), New(len(to), m, f)
+	locs := MapperTest.Locations(20000)
+	moved := 0
+	for _, location := range locs {
+		if from[a.MapBucket(location)] != to[b.MapBucket(location)] {
+			moved++
+		}
+	}
+	expected := a.ExpectedMoveRate(from, to)
+	if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.01 {
+		t.Errorf("m=%d f=%d %v: %0.4f moved, expected %0.4f", m, f, to, actual, expected)
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, c := range configs {
+		rhg := New(c[0], c[1], c[2])
+		b.Run(fmt.Sprintf("buckets=%d/m=%d/f=%d", c[0], c[1], c[2]), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rhg.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, c := range configs {
+		MapperTest.SnapshotRoundTrip(t, New(c[0], c[1], c[2]), func() MapperTest.Snapshotter { return &RendezvousHashGroup{} })
+	}
+}
+
+// New used to seed each inner node with just its position among its
+// siblings. Every level then reused the seeds of the level below and of the
+// first buckets in each cluster, so the picks at each level agreed with each
+// other and most keys ended up on a handful of buckets. The legacy tree
+// leaves buckets with nothing at all, the current one reaches every bucket.
+func TestLevelSeedsReachEveryBucket(t *testing.T) {
+	locs := MapperTest.Locations(100000)
+	for _, c := range configs[1:] {
+		old, rhg := legacySeeds(New(c[0], c[1], c[2])), New(c[0], c[1], c[2])
+		oldCounts, counts := make([]int, c[0]), make([]int, c[0])
+		for _, location := range locs {
+			oldCounts[old.MapBucket(location)]++
+			counts[rhg.MapBucket(location)]++
+		}
+		oldEmpty := 0
+		for bucket := range counts {
+			if oldCounts[bucket] == 0 {
+				oldEmpty++
+			}
+			if counts[bucket] == 0 {
+				t.Errorf("%v: bucket %d got no keys", c, bucket)
+			}
+		}
+		if oldEmpty == 0 {
+			t.Errorf("%v: legacy seeds reached every bucket", c)
+		}
+	}
+}
+
+// These pin where a few keys went with the old seeds and go with the new
+// ones, so any further change to the seeding shows up here.
+func TestLevelSeedsPlacements(t *testing.T) {
+	cases := []struct {
+		config        [3]int
+		before, after []int
+	}{
+		{[3]int{9, 4, 3}, []int{0, 8, 4, 6, 5, 3, 0, 0}, []int{5, 2, 1, 8, 1, 3, 0, 5}},
+		{[3]int{100, 4, 3}, []int{0, 97, 53, 53, 53, 3, 0, 0}, []int{5, 29, 99, 71, 65, 3, 27, 37}},
+		{[3]int{1023, 4, 3}, []int{0, 1021, 1021, 1020, 1022, 3, 0, 0}, []int{1017, 1010, 981, 982, 676, 1015, 999, 295}},
+	}
+	for _, c := range cases {
+		old := legacySeeds(New(c.config[0], c.config[1], c.config[2]))
+		rhg := New(c.config[0], c.config[1], c.config[2])
+		for ix, location := range MapperTest.Locations(len(c.after)) {
+			if got := old.MapBucket(location); got != c.before[ix] {
+				t.Errorf("%v, location %d: legacy seeds give %d, expected %d", c.config, ix, got, c.before[ix])
+			}
+			if got := rhg.MapBucket(location); got != c.after[ix] {
+				t.Errorf("%v, location %d: got %d, expected %d", c.config, ix, got, c.after[ix])
+			}
+		}
+	}
+}
+
+// legacySeeds reseeds every inner node of rhg the way New used to, with just
+// its position among its siblings, so that each level reuses the seeds of
+// the one below it and of the first buckets.
+func legacySeeds(rhg *RendezvousHashGroup) *RendezvousHashGroup {
+	var reseed func(children []member, seeds []uint64)
+	reseed = func(children []member, seeds []uint64) {
+		for ix, child := range children {
+			seeds[ix] = uint64(ix)
+			if g, ok := child.(*innerGroup); ok {
+				reseed(g.children, g.seeds)
+			}
+		}
+	}
+	reseed(rhg.children, rhg.seeds)
+	return rhg
+}
@@ -0,0 +1,294 @@
+package RendezvousHashingWithTable
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+// DefaultSlots is how many slots the table has for each bucket of capacity
+// when New is not told
+const DefaultSlots = 256
+
+// maxTable is the most slots a snapshot may ask for, which is 1GiB of table
+const maxTable = 1 << 28
+
+// candidates is how many buckets each slot draws from the capacity
+const candidates = 16
+
+// candidateSeed puts the seeds used to draw candidates above every bucket's
+// seed, so which buckets a slot draws has nothing to do with how they score
+const candidateSeed = 1 << 32
+
+// RendezvousTable puts a table of slots in front of rendezvous hashing, so a
+// lookup is a multiply and a read however many buckets there are. Keys are
+// spread over the slots, and each slot goes to the bucket rendezvous hashing
+// picks for it, scoring buckets for slot s as RendezvousHashGroup does for
+// the key s.
+//
+// Scoring every bucket for every slot would take slots times buckets hashes
+// to build, which is out of reach with a hundred thousand buckets, so each
+// slot draws a fixed set of candidates from the capacity and picks among the
+// ones that are working. Only if none of them are does it score every
+// working bucket. A bucket's standing in a slot does not depend on any other
+// bucket, so as with plain rendezvous hashing, adding a bucket only moves
+// slots to it and removing one only moves its own slots.
+//
+// Keys are shared out a slot at a time, so a bucket's share of the keys is
+// only as even as its share of the slots. With m slots per working bucket
+// that is off by about 1/sqrt(m), and the fullest of n buckets is about
+// sqrt(2 ln(n)/m) over average. More slots even that out, but the table takes
+// 4 bytes a slot and building it, or adding a bucket, hashes every slot 16
+// times.
+type RendezvousTable struct {
+	owners  []int32
+	working []bool
+	members Membership.Membership
+	slots   int
+}
+
+// New makes a new RendezvousTable with buckets working buckets out of
+// capacity and slots slots for each bucket of capacity. capacity is the most
+// buckets that can ever be working at once and will be raised to buckets if
+// it is smaller. slots will default to DefaultSlots if less than or equal to
+// zero.
+func New(buckets int, capacity int, slots int) *RendezvousTable {
+	return NewWithMembership(Membership.Range(buckets), capacity, slots)
+}
+
+// NewWithMembership makes a new RendezvousTable with any working buckets out
+// of capacity, which will be raised to fit the highest of them
+func NewWithMembership(members Membership.Membership, capacity int, slots int) *RendezvousTable {
+	if n := len(members); n > 0 && capacity <= members[n-1] {
+		capacity = members[n-1] + 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	if slots <= 0 {
+		slots = DefaultSlots
+	}
+	rt := &RendezvousTable{
+		owners:  make([]int32, slots*capacity, slots*capacity),
+		working: make([]bool, capacity, capacity),
+		members: append(Membership.Membership{}, members...),
+		slots:   slots,
+	}
+	for _, b := range members {
+		rt.working[b] = true
+	}
+	for s := range rt.owners {
+		rt.owners[s] = int32(rt.owner(s))
+	}
+	return rt
+}
+
+// score is how much a bucket wants a slot
+func score(bucket int, slot int) uint64 {
+	return ObjectHasher.PlaceUInt64S(uint64(slot), uint64(bucket))
+}
+
+// better tells whether bucket a with score sa beats bucket b with score sb.
+// Ties go to the lower bucket, so the winner never depends on the order
+// buckets are scored in.
+func better(a int, sa uint64, b int, sb uint64) bool {
+	return sa > sb || (sa == sb && a < b)
+}
+
+// reduce maps a hash evenly onto 0 to n-1
+func reduce(h uint64, n int) int {
+	hi, _ := bits.Mul64(h, uint64(n))
+	return int(hi)
+}
+
+// candidate returns the jth bucket a slot draws
+func (rt *RendezvousTable) candidate(slot int, j int) int {
+	return reduce(ObjectHasher.PlaceUInt64S(uint64(slot), candidateSeed+uint64(j)), len(rt.working))
+}
+
+// owner works out which bucket a slot goes to, or -1 if none are working
+func (rt *RendezvousTable) owner(slot int) int {
+	best, bestScore := -1, uint64(0)
+	for j := 0; j < candidates; j++ {
+		b := rt.candidate(slot, j)
+		if !rt.working[b] {
+			continue
+		}
+		if sc := score(b, slot); best < 0 || better(b, sc, best, bestScore) {
+			best, bestScore = b, sc
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+	for _, b := range rt.members {
+		if sc := score(b, slot); best < 0 || better(b, sc, best, bestScore) {
+			best, bestScore = b, sc
+		}
+	}
+	return best
+}
+
+// MapBucket returns the target bucket for a given object hash, or -1 if no
+// buckets are working
+func (rt *RendezvousTable) MapBucket(location uint64) int {
+	return int(rt.owners[reduce(location, len(rt.owners))])
+}
+
+// MapBatch maps each location to the same position in out, which has to be
+// at least as long as locations
+func (rt *RendezvousTable) MapBatch(locations []uint64, out []int) {
+	owners := rt.owners
+	for ix, location := range locations {
+		out[ix] = int(owners[reduce(location, len(owners))])
+	}
+}
+
+// Add puts a bucket from the capacity to work. Only the slots it wins move,
+// and they all move to it. Finding them means drawing every slot's
+// candidates again, so it takes as long as building the table. It is false
+// if the bucket is already working or outside the capacity.
+func (rt *RendezvousTable) Add(bucket int) bool {
+	if bucket < 0 || bucket >= len(rt.working) || rt.working[bucket] {
+		return false
+	}
+	rt.working[bucket] = true
+	rt.members = rt.members.With(bucket)
+	for s, o := range rt.owners {
+		current := int(o)
+		if current < 0 {
+			rt.owners[s] = int32(bucket)
+			continue
+		}
+		isCandidate, currentIsCandidate := false, false
+		for j := 0; j < candidates; j++ {
+			c := rt.candidate(s, j)
+			isCandidate = isCandidate || c == bucket
+			currentIsCandidate = currentIsCandidate || c == current
+		}
+		// a candidate beats any bucket that only won because the slot had no
+		// working candidates, and otherwise the scores decide
+		if (isCandidate && !currentIsCandidate) ||
+			(isCandidate == currentIsCandidate && better(bucket, score(bucket, s), current, score(current, s))) {
+			rt.owners[s] = int32(bucket)
+		}
+	}
+	return true
+}
+
+// Remove takes a working bucket out of service. Only keys that were mapped to
+// it move. It is false if the bucket was not working.
+func (rt *RendezvousTable) Remove(bucket int) bool {
+	if bucket < 0 || bucket >= len(rt.working) || !rt.working[bucket] {
+		return false
+	}
+	rt.working[bucket] = false
+	rt.members = rt.members.Without(bucket)
+	for s, o := range rt.owners {
+		if int(o) == bucket {
+			rt.owners[s] = int32(rt.owner(s))
+		}
+	}
+	return true
+}
+
+// Working returns the number of working buckets
+func (rt *RendezvousTable) Working() int {
+	return len(rt.members)
+}
+
+// Members returns the working buckets
+func (rt *RendezvousTable) Members() Membership.Membership {
+	return append(Membership.Membership{}, rt.members...)
+}
+
+// ExpectedMoveRate returns the rate (0-1) at which members are expected to
+// move. A slot stays when its winner over both memberships is in both, and
+// each slot carries the same share of the keys.
+func (rt *RendezvousTable) ExpectedMoveRate(from, to Membership.Membership) float64 {
+	return Membership.JaccardMoveRate(from, to)
+}
+
+// Name tells you who we are
+func (rt *RendezvousTable) Name() string {
+	return fmt.Sprintf("RendezvousTable[%d/%d, %d slots]", len(rt.members), len(rt.working), rt.slots)
+}
+
+// SnapshotKind identifies RendezvousTable snapshots
+const SnapshotKind = "RendezvousTable"
+
+const snapshotVersion = 1
+
+type tableState struct {
+	Capacity int                   `json:"capacity"`
+	Slots    int                   `json:"slots"`
+	Members  Membership.Membership `json:"members"`
+}
+
+// restore rebuilds a RendezvousTable from its capacity, slots and working
+// buckets. The table only depends on those, so it comes out the same as the
+// one that was saved.
+func (rt *RendezvousTable) restore(state tableState) error {
+	if state.Capacity > Snapshot.MaxBuckets {
+		return fmt.Errorf("snapshot capacity %d is over %d", state.Capacity, Snapshot.MaxBuckets)
+	}
+	if state.Capacity < 1 || len(state.Members) > state.Capacity {
+		return fmt.Errorf("snapshot has %d of %d buckets working", len(state.Members), state.Capacity)
+	}
+	if state.Slots < 1 || state.Slots > maxTable/state.Capacity {
+		return fmt.Errorf("snapshot has %d slots for each of %d buckets, which is none or over %d in all", state.Slots, state.Capacity, maxTable)
+	}
+	for ix, b := range state.Members {
+		if b < 0 || b >= state.Capacity || (ix > 0 && b <= state.Members[ix-1]) {
+			return fmt.Errorf("snapshot member %d is bucket %d, out of order or outside the capacity", ix, b)
+		}
+	}
+	*rt = *NewWithMembership(state.Members, state.Capacity, state.Slots)
+	return nil
+}
+
+// MarshalBinary encodes the RendezvousTable as a versioned snapshot
+func (rt *RendezvousTable) MarshalBinary() ([]byte, error) {
+	e := Snapshot.NewEncoder(SnapshotKind, snapshotVersion)
+	e.Int(len(rt.working))
+	e.Int(rt.slots)
+	e.Uint64(uint64(len(rt.members)))
+	for _, b := range rt.members {
+		e.Int(b)
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the RendezvousTable with the one in a snapshot
+func (rt *RendezvousTable) UnmarshalBinary(data []byte) error {
+	d, err := Snapshot.NewDecoder(data, SnapshotKind, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	state := tableState{Capacity: d.Int(), Slots: d.Int()}
+	state.Members = make(Membership.Membership, d.Len(1))
+	for ix := range state.Members {
+		state.Members[ix] = d.Int()
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	return rt.restore(state)
+}
+
+// MarshalJSON encodes the RendezvousTable as a versioned snapshot
+func (rt *RendezvousTable) MarshalJSON() ([]byte, error) {
+	return Snapshot.MarshalJSON(SnapshotKind, snapshotVersion, tableState{len(rt.working), rt.slots, rt.members})
+}
+
+// UnmarshalJSON replaces the RendezvousTable with the one in a snapshot
+func (rt *RendezvousTable) UnmarshalJSON(data []byte) error {
+	state := tableState{}
+	if _, err := Snapshot.UnmarshalJSON(data, SnapshotKind, snapshotVersion, &state); err != nil {
+		return err
+	}
+	return rt.restore(state)
+}
@@ -0,0 +1,244 @@
+package RendezvousHashingWithTable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/RendezvousHashing"
+)
+
+func TestMapBucketRange(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		MapperTest.Range(t, New(size, 2*size, 0), size)
+	}
+}
+
+// TestRendezvous checks slots against plain rendezvous hashing of the slot
+// number, where a slot has drawn every bucket as a candidate
+func TestRendezvous(t *testing.T) {
+	for _, size := range []int{2, 3, 5} {
+		rt := New(size, size, 0)
+		rhg := RendezvousHashing.New(size)
+		checked := 0
+		for s := range rt.owners {
+			drawn := map[int]bool{}
+			for j := 0; j < candidates; j++ {
+				drawn[rt.candidate(s, j)] = true
+			}
+			if len(drawn) < size {
+				continue
+			}
+			checked++
+			if int(rt.owners[s]) != rhg.MapBucket(uint64(s)) {
+				t.Fatalf("size %d: slot %d went to %d, rendezvous hashing picks %d", size, s, rt.owners[s], rhg.MapBucket(uint64(s)))
+			}
+		}
+		if checked < len(rt.owners)/2 {
+			t.Errorf("size %d: only %d of %d slots drew every bucket", size, checked, len(rt.owners))
+		}
+	}
+}
+
+// TestScore pins the score to xxhash of the slot seeded with the bucket
+func TestScore(t *testing.T) {
+	b := make([]byte, 8)
+	for _, slot := range []int{0, 1, 12345} {
+		binary.LittleEndian.PutUint64(b, uint64(slot))
+		for _, bucket := range []int{0, 1, 99} {
+			if score(bucket, slot) != xxhash.Checksum64S(b, uint64(bucket)) {
+				t.Fatalf("bucket %d, slot %d: score %x, expected %x", bucket, slot, score(bucket, slot), xxhash.Checksum64S(b, uint64(bucket)))
+			}
+		}
+	}
+}
+
+// TestMinimalDisruption adds and removes buckets at random, checking that
+// only the keys of a removed bucket move, that keys only move to an added
+// one, and that the table is the same as one built with the buckets left
+func TestMinimalDisruption(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	locs := MapperTest.Locations(5000)
+	for _, capacity := range []int{8, 100} {
+		rt := New(capacity/2, capacity, 0)
+		before := MapperTest.MapAll(rt, locs)
+		for step := 0; step < 40; step++ {
+			bucket := rnd.Intn(capacity)
+			adding := !rt.working[bucket]
+			if adding && !rt.Add(bucket) || !adding && (rt.Working() == 1 || !rt.Remove(bucket)) {
+				continue
+			}
+			after := MapperTest.MapAll(rt, locs)
+			for ix := range locs {
+				if before[ix] == after[ix] {
+					continue
+				}
+				if adding && after[ix] != bucket || !adding && before[ix] != bucket {
+					t.Fatalf("capacity %d: %s %d moved %x from %d to %d", capacity, map[bool]string{true: "adding", false: "removing"}[adding], bucket, locs[ix], before[ix], after[ix])
+				}
+			}
+			fresh := NewWithMembership(rt.Members(), capacity, 0)
+			for s := range rt.owners {
+				if rt.owners[s] != fresh.owners[s] {
+					t.Fatalf("capacity %d: slot %d went to %d, %d in a fresh table", capacity, s, rt.owners[s], fresh.owners[s])
+				}
+			}
+			before = after
+		}
+	}
+}
+
+// TestSparse works a table with so few of its capacity working that most
+// slots draw no working candidates and score every working bucket instead
+func TestSparse(t *testing.T) {
+	rt := NewWithMembership(Membership.New(3, 500), 1000, 0)
+	locs := MapperTest.Locations(5000)
+	seen := map[int]int{}
+	for _, location := range locs {
+		seen[rt.MapBucket(location)]++
+	}
+	if len(seen) != 2 || seen[3] < 2000 || seen[500] < 2000 {
+		t.Errorf("keys spread as %v", seen)
+	}
+	rt.Add(700)
+	before := MapperTest.MapAll(rt, locs)
+	rt.Remove(3)
+	rt.Remove(500)
+	rt.Remove(700)
+	if rt.MapBucket(locs[0]) != -1 || rt.Remove(700) {
+		t.Errorf("table with nothing working mapped to %d", rt.MapBucket(locs[0]))
+	}
+	rt.Add(500)
+	rt.Add(3)
+	rt.Add(700)
+	for ix, b := range MapperTest.MapAll(rt, locs) {
+		if b != before[ix] {
+			t.Fatalf("%x mapped to %d after emptying and refilling the table, was %d", locs[ix], b, before[ix])
+		}
+	}
+}
+
+func TestBounds(t *testing.T) {
+	rt := New(4, 8, 0)
+	if rt.Add(8) || rt.Add(-1) || rt.Add(2) || rt.Remove(5) || rt.Remove(8) {
+		t.Errorf("accepted a bucket out of the capacity, or in the wrong state")
+	}
+	if rt := NewWithMembership(Membership.New(1, 20), 4, 0); len(rt.working) != 21 {
+		t.Errorf("capacity %d does not fit bucket 20", len(rt.working))
+	}
+}
+
+// TestBalance checks that the fullest bucket has no more slots over average
+// than the fullest of n even draws of m slots a working bucket would:
+// sqrt(2 ln(n)/m)
+func TestBalance(t *testing.T) {
+	for _, c := range [][2]int{{10, 20}, {100, 100}, {100, 200}, {1000, 2000}} {
+		for _, slots := range []int{16, 64, DefaultSlots, 1024} {
+			rt := New(c[0], c[1], slots)
+			counts := map[int]int{}
+			peak := 0
+			for _, o := range rt.owners {
+				b := int(o)
+				counts[b]++
+				if counts[b] > peak {
+					peak = counts[b]
+				}
+			}
+			n := float64(c[0])
+			m := float64(len(rt.owners)) / n
+			bound := 1 + math.Sqrt(2*math.Log(n)/m)
+			if ratio := float64(peak) / m; ratio > bound {
+				t.Errorf("%s: peak-to-average %0.3f, expected at most %0.3f", rt.Name(), ratio, bound)
+			}
+		}
+	}
+}
+
+func TestExpectedMoveRate(t *testing.T) {
+	locs := MapperTest.Locations(20000)
+	for _, size := range MapperTest.Sizes[1:] {
+		rt := New(size, 2*size, 0)
+		before := MapperTest.MapAll(rt, locs)
+		from := rt.Members()
+		rt.Remove(size / 2)
+		rt.Add(size)
+		moved := 0
+		for ix, b := range MapperTest.MapAll(rt, locs) {
+			if b != before[ix] {
+				moved++
+			}
+		}
+		expected := rt.ExpectedMoveRate(from, rt.Members())
+		if actual := float64(moved) / float64(len(locs)); math.Abs(actual-expected) > 0.2*expected+0.005 {
+			t.Errorf("size %d: %0.4f moved, expected %0.4f", size, actual, expected)
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, size := range MapperTest.Sizes {
+		original := New(size, 2*size, 32)
+		original.Remove(size / 2)
+		MapperTest.SnapshotRoundTrip(t, original, func() MapperTest.Snapshotter { return &RendezvousTable{} })
+	}
+	bad := `{"kind": "RendezvousTable", "version": 1, "state": {"capacity": 4, "slots": 64, "members": [2, 1]}}`
+	if err := (&RendezvousTable{}).UnmarshalJSON([]byte(bad)); err == nil {
+		t.Errorf("snapshot with members out of order accepted")
+	}
+	huge := `{"kind": "RendezvousTable", "version": 1, "state": {"capacity": 1099511627776, "slots": 64, "members": [0]}}`
+	if err := (&RendezvousTable{}).UnmarshalJSON([]byte(huge)); err == nil {
+		t.Errorf("snapshot with a capacity of 1<<40 accepted")
+	}
+	huge = `{"kind": "RendezvousTable", "version": 1, "state": {"capacity": 4096, "slots": 1048576, "members": [0]}}`
+	if err := (&RendezvousTable{}).UnmarshalJSON([]byte(huge)); err == nil {
+		t.Errorf("snapshot with 1<<32 slots accepted")
+	}
+}
+
+func BenchmarkMapBucket(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range MapperTest.Sizes {
+		rt := New(size, 2*size, 0)
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rt.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+// BenchmarkScale compares lookups in the table with plain rendezvous hashing
+// as the bucket count grows. Building the table for 100k buckets takes several
+// seconds.
+func BenchmarkScale(b *testing.B) {
+	locs := MapperTest.Locations(1024)
+	for _, size := range []int{1000, 10000, 100000} {
+		rt := New(size, 2*size, 0)
+		rhg := RendezvousHashing.New(size)
+		b.Run(fmt.Sprintf("buckets=%d/rendezvous", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rhg.MapBucket(locs[i&1023])
+			}
+		})
+		b.Run(fmt.Sprintf("buckets=%d/table", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rt.MapBucket(locs[i&1023])
+			}
+		})
+	}
+}
+
+func BenchmarkNew(b *testing.B) {
+	for _, size := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("buckets=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				New(size, 2*size, 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package RingIndex
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// maxBits caps the table at 4M slots, 16MiB, which is already more than a
+// ring of 100k buckets with 200 replicas each needs to get down to a handful
+// of places per slot
+const maxBits = 22
+
+// Index finds the first of a sorted list of places at or after a location,
+// which is what every ring lookup comes down to. It keeps the places in a
+// slice of their own, so a search only pulls in the 8 bytes it compares, and
+// a table over the top bits of a location narrows the search to the places
+// sharing them before it starts. Hashes are spread evenly, so that is one or
+// two places, and a lookup is a table read and a compare or two rather
+// than a binary search over the whole ring touching a new cache line at
+// nearly every step.
+type Index struct {
+	places []uint64
+	// starts[slot] is the first place whose top bits are slot or more, so
+	// slot's places are places[starts[slot]:starts[slot+1]]
+	starts []uint32
+	shift  uint
+}
+
+// New builds an Index over places, which have to be sorted and are copied.
+// The table has a slot for about every two places.
+func New(places []uint64) *Index {
+	return build(append([]uint64{}, places...))
+}
+
+// Build builds an Index over n sorted places, place(ix) giving the ixth.
+// Rings keep each place next to what is there, so this saves them gathering
+// the places into a slice of their own first.
+func Build(n int, place func(ix int) uint64) *Index {
+	places := make([]uint64, n, n)
+	for ix := range places {
+		places[ix] = place(ix)
+	}
+	return build(places)
+}
+
+// build makes the table over places, which the Index keeps
+func build(places []uint64) *Index {
+	tableBits := bits.Len(uint(len(places))) - 1
+	if tableBits < 0 {
+		tableBits = 0
+	} else if tableBits > maxBits {
+		tableBits = maxBits
+	}
+	shift := uint(64 - tableBits)
+	starts := make([]uint32, (1<<uint(tableBits))+1)
+	ix := 0
+	for slot := range starts {
+		for ix < len(places) && places[ix]>>shift < uint64(slot) {
+			ix++
+		}
+		starts[slot] = uint32(ix)
+	}
+	return &Index{places, starts, shift}
+}
+
+// Len is how many places there are
+func (ix *Index) Len() int {
+	return len(ix.places)
+}
+
+// Search returns the position of the first place at or after location, or
+// Len if there is none, as sort.Search would
+func (ix *Index) Search(location uint64) int {
+	slot := location >> ix.shift
+	lo, hi := int(ix.starts[slot]), int(ix.starts[slot+1])
+	// everything before lo is before location and everything from hi on is
+	// after it
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if ix.places[mid] < location {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// SearchFrom is Search for a location known to come at or after the place
+// before pos, as each one does when locations are searched in order. The
+// search starts from pos or location's slot, whichever is later, so a walk
+// through sorted locations moves steadily along the places and the table.
+func (ix *Index) SearchFrom(location uint64, pos int) int {
+	slot := location >> ix.shift
+	lo, hi := int(ix.starts[slot]), int(ix.starts[slot+1])
+	if pos > lo {
+		lo = pos
+	}
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if ix.places[mid] < location {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// Find is Search on an Index that may be nil, as it is on a ring put
+// together by hand. Without one it binary searches the n places that place
+// gives, which have to be sorted.
+func (ix *Index) Find(location uint64, n int, place func(ix int) uint64) int {
+	if ix != nil {
+		return ix.Search(location)
+	}
+	return sort.Search(n, func(i int) bool { return place(i) >= location })
+}
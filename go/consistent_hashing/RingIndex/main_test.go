@@ -0,0 +1,129 @@
+package RingIndex
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+)
+
+var sizes = []int{0, 1, 2, 7, 8, 100, 1024, 100000}
+
+func sortedPlaces(n int) []uint64 {
+	places := make([]uint64, n, n)
+	for ix := range places {
+		places[ix] = ObjectHasher.PlaceUInt64N(uint64(ix), 1)
+	}
+	sort.Slice(places, func(i, j int) bool { return places[i] < places[j] })
+	return places
+}
+
+// check compares Search with sort.Search for locations on, next to and
+// between the places, and at the ends of the space
+func check(t *testing.T, name string, places []uint64) {
+	idx := New(places)
+	if idx.Len() != len(places) {
+		t.Fatalf("%s: Len is %d, expected %d", name, idx.Len(), len(places))
+	}
+	locations := []uint64{0, 1, math.MaxUint64 - 1, math.MaxUint64}
+	for _, p := range places {
+		locations = append(locations, p-1, p, p+1)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for ix := 0; ix < 1000; ix++ {
+		locations = append(locations, rnd.Uint64())
+	}
+	for _, location := range locations {
+		expected := sort.Search(len(places), func(ix int) bool { return places[ix] >= location })
+		if actual := idx.Search(location); actual != expected {
+			t.Fatalf("%s: %x found at %d, expected %d", name, location, actual, expected)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	for _, size := range sizes {
+		check(t, fmt.Sprintf("size %d", size), sortedPlaces(size))
+	}
+}
+
+// TestSearchUneven checks places that are nothing like evenly spread, so
+// that slots are empty or hold everything
+func TestSearchUneven(t *testing.T) {
+	same := make([]uint64, 1000, 1000)
+	low := make([]uint64, 1000, 1000)
+	for ix := range same {
+		same[ix] = 0x5555555555555555
+		low[ix] = uint64(ix / 3)
+	}
+	check(t, "same", same)
+	check(t, "low", low)
+	check(t, "edges", []uint64{0, 0, 1, math.MaxUint64 - 1, math.MaxUint64, math.MaxUint64})
+}
+
+func TestCopies(t *testing.T) {
+	places := []uint64{10, 20, 30}
+	idx := New(places)
+	places[1] = 40
+	if idx.Search(15) != 1 || idx.Search(25) != 2 {
+		t.Errorf("index changed with the places it was built from")
+	}
+}
+
+// TestBuildAndFind checks that Build matches New, and that Find without an
+// Index searches the places it is given
+func TestBuildAndFind(t *testing.T) {
+	places := sortedPlaces(1000)
+	place := func(ix int) uint64 { return places[ix] }
+	built, made := Build(len(places), place), New(places)
+	var none *Index
+	for _, location := range append(sortedPlaces(100), 0, places[10], math.MaxUint64) {
+		expected := made.Search(location)
+		if built.Search(location) != expected || built.Find(location, len(places), place) != expected || none.Find(location, len(places), place) != expected {
+			t.Fatalf("%x found at %d and %d, and %d without an index, expected %d", location, built.Search(location), built.Find(location, len(places), place), none.Find(location, len(places), place), expected)
+		}
+	}
+}
+
+// TestSearchFrom checks that carrying each result over to the next of a run
+// of sorted locations finds the same places as Search
+func TestSearchFrom(t *testing.T) {
+	for _, size := range sizes {
+		idx := New(sortedPlaces(size))
+		locations := append(sortedPlaces(3000), sortedPlaces(size)...)
+		locations = append(locations, 0, 0, math.MaxUint64)
+		sort.Slice(locations, func(i, j int) bool { return locations[i] < locations[j] })
+		pos := 0
+		for _, location := range locations {
+			pos = idx.SearchFrom(location, pos)
+			if expected := idx.Search(location); pos != expected {
+				t.Fatalf("size %d: %x found at %d, expected %d", size, location, pos, expected)
+			}
+		}
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	locs := make([]uint64, 1024, 1024)
+	for ix := range locs {
+		locs[ix] = ObjectHasher.PlaceUInt64N(uint64(ix), 2)
+	}
+	for _, size := range []int{1000, 100000, 10000000} {
+		places := sortedPlaces(size)
+		idx := New(places)
+		b.Run(fmt.Sprintf("places=%d/sort.Search", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				location := locs[i&1023]
+				sort.Search(len(places), func(ix int) bool { return places[ix] >= location })
+			}
+		})
+		b.Run(fmt.Sprintf("places=%d/index", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				idx.Search(locs[i&1023])
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package Snapshot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// magic starts every binary snapshot
+var magic = [4]byte{'C', 'H', 'S', 'N'}
+
+// headerSize is the magic, the version and the length of the kind
+const headerSize = len(magic) + 2 + 1
+
+// MaxBuckets is the most buckets a snapshot may ask for. Mappers that lay
+// out every bucket up front are rebuilt from the count in the snapshot, so
+// without a cap a snapshot a few bytes long could ask for terabytes.
+const MaxBuckets = 1 << 24
+
+// ErrChecksum means a snapshot was damaged somewhere between being encoded
+// and decoded
+var ErrChecksum = errors.New("snapshot checksum does not match")
+
+// Encoder builds a binary snapshot. It is laid out as the magic, a
+// little-endian uint16 version, the kind as a length-prefixed string, the
+// fields in the order the mapper wrote them, and a CRC-32 of everything
+// before it. Integers are varints, so small tables stay small.
+type Encoder struct {
+	buf []byte
+}
+
+// NewEncoder starts a snapshot of the given kind and version
+func NewEncoder(kind string, version uint16) *Encoder {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, magic[:]...)
+	buf = append(buf, byte(version), byte(version>>8))
+	buf = append(buf, byte(len(kind)))
+	buf = append(buf, kind[:len(kind)&0xff]...)
+	return &Encoder{buf}
+}
+
+// Uint64 adds an unsigned integer
+func (e *Encoder) Uint64(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// Int adds a signed integer
+func (e *Encoder) Int(v int) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutVarint(b[:], int64(v))]...)
+}
+
+// Float64 adds a float, bit for bit
+func (e *Encoder) Float64(v float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+// String adds a length-prefixed string
+func (e *Encoder) String(s string) {
+	e.Uint64(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// Bytes finishes the snapshot with its checksum and returns it
+func (e *Encoder) Bytes() []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], crc32.ChecksumIEEE(e.buf))
+	return append(e.buf, b[:]...)
+}
+
+// Decoder reads the fields of a binary snapshot back in the order they were
+// written. The first error sticks, after which every read returns zero, so a
+// mapper can read all of its fields and check Finish once.
+type Decoder struct {
+	data    []byte
+	Version uint16
+	err     error
+}
+
+// Peek returns the kind and version of a binary snapshot without checking
+// the rest of it
+func Peek(data []byte) (string, uint16, error) {
+	if len(data) < headerSize || [4]byte{data[0], data[1], data[2], data[3]} != magic {
+		return "", 0, errors.New("not a snapshot")
+	}
+	version := binary.LittleEndian.Uint16(data[len(magic):])
+	kindLen := int(data[headerSize-1])
+	if len(data) < headerSize+kindLen {
+		return "", 0, errors.New("snapshot header is truncated")
+	}
+	return string(data[headerSize : headerSize+kindLen]), version, nil
+}
+
+// NewDecoder checks a binary snapshot's checksum, kind and version and
+// returns a Decoder positioned at its first field. Versions newer than
+// maxVersion are refused, older ones are left to the caller to handle.
+func NewDecoder(data []byte, kind string, maxVersion uint16) (*Decoder, error) {
+	actual, version, err := Peek(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize+len(actual)+4 {
+		return nil, errors.New("snapshot is truncated")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, ErrChecksum
+	}
+	if actual != kind {
+		return nil, fmt.Errorf("snapshot is a %s, not a %s", actual, kind)
+	}
+	if version == 0 || version > maxVersion {
+		return nil, fmt.Errorf("%s snapshot version %d is not supported, only up to %d", kind, version, maxVersion)
+	}
+	return &Decoder{body[headerSize+len(actual):], version, nil}, nil
+}
+
+func (d *Decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+		d.data = nil
+	}
+}
+
+// Uint64 reads an unsigned integer
+func (d *Decoder) Uint64() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(errors.New("snapshot has a bad or missing integer"))
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// Int reads a signed integer
+func (d *Decoder) Int() int {
+	v, n := binary.Varint(d.data)
+	if n <= 0 || v != int64(int(v)) {
+		d.fail(errors.New("snapshot has a bad or missing integer"))
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+// Float64 reads a float
+func (d *Decoder) Float64() float64 {
+	if len(d.data) < 8 {
+		d.fail(errors.New("snapshot is missing a float"))
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return v
+}
+
+// String reads a length-prefixed string
+func (d *Decoder) String() string {
+	n := d.Uint64()
+	if n > uint64(len(d.data)) {
+		d.fail(errors.New("snapshot has a truncated string"))
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+// Len reads the length of a list whose items each take at least minBytes.
+// Lengths that could not fit in what is left are refused, so a damaged
+// snapshot cannot ask for a huge allocation.
+func (d *Decoder) Len(minBytes int) int {
+	n := d.Uint64()
+	if minBytes < 1 {
+		minBytes = 1
+	}
+	if n > uint64(len(d.data)/minBytes) {
+		d.fail(errors.New("snapshot has a list longer than its data"))
+		return 0
+	}
+	return int(n)
+}
+
+// Fail records a problem the caller found with the decoded values
+func (d *Decoder) Fail(format string, args ...interface{}) {
+	d.fail(fmt.Errorf(format, args...))
+}
+
+// Finish returns the first error seen, or an error if there is data left over
+func (d *Decoder) Finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("snapshot has %d bytes left over", len(d.data))
+	}
+	return d.err
+}
+
+// envelope wraps the JSON form of a mapper with its kind and version
+type envelope struct {
+	Kind    string          `json:"kind"`
+	Version uint16          `json:"version"`
+	State   json.RawMessage `json:"state"`
+}
+
+// MarshalJSON encodes a mapper's state with its kind and version
+func MarshalJSON(kind string, version uint16, state interface{}) ([]byte, error) {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{kind, version, raw})
+}
+
+// PeekJSON returns the kind and version of a JSON snapshot
+func PeekJSON(data []byte) (string, uint16, error) {
+	env := envelope{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return "", 0, err
+	}
+	return env.Kind, env.Version, nil
+}
+
+// UnmarshalJSON checks a JSON snapshot's kind and version and decodes its
+// state into state, returning the version
+func UnmarshalJSON(data []byte, kind string, maxVersion uint16, state interface{}) (uint16, error) {
+	env := envelope{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return 0, err
+	}
+	if env.Kind != kind {
+		return 0, fmt.Errorf("snapshot is a %s, not a %s", env.Kind, kind)
+	}
+	if env.Version == 0 || env.Version > maxVersion {
+		return 0, fmt.Errorf("%s snapshot version %d is not supported, only up to %d", kind, env.Version, maxVersion)
+	}
+	return env.Version, json.Unmarshal(env.State, state)
+}
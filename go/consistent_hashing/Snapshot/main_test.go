@@ -0,0 +1,120 @@
+package Snapshot
+
+import (
+	"math"
+	"testing"
+)
+
+func encoded() []byte {
+	e := NewEncoder("Test", 2)
+	e.Uint64(math.MaxUint64)
+	e.Int(-12345)
+	e.Float64(math.Pi)
+	e.String("hello")
+	return e.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := encoded()
+	if kind, version, err := Peek(data); kind != "Test" || version != 2 || err != nil {
+		t.Fatalf("peeked %q %d %v", kind, version, err)
+	}
+	d, err := NewDecoder(data, "Test", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version != 2 {
+		t.Errorf("version %d", d.Version)
+	}
+	if v := d.Uint64(); v != math.MaxUint64 {
+		t.Errorf("uint64 %d", v)
+	}
+	if v := d.Int(); v != -12345 {
+		t.Errorf("int %d", v)
+	}
+	if v := d.Float64(); v != math.Pi {
+		t.Errorf("float64 %f", v)
+	}
+	if v := d.String(); v != "hello" {
+		t.Errorf("string %q", v)
+	}
+	if err := d.Finish(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	data := encoded()
+	if _, err := NewDecoder(data, "Other", 2); err == nil {
+		t.Errorf("wrong kind accepted")
+	}
+	if _, err := NewDecoder(data, "Test", 1); err == nil {
+		t.Errorf("newer version accepted")
+	}
+	if _, err := NewDecoder(data[:len(data)-1], "Test", 2); err == nil {
+		t.Errorf("truncated snapshot accepted")
+	}
+	if _, err := NewDecoder([]byte("nope"), "Test", 2); err == nil {
+		t.Errorf("garbage accepted")
+	}
+	for ix := range data {
+		damaged := append([]byte{}, data...)
+		damaged[ix] ^= 0x10
+		if _, err := NewDecoder(damaged, "Test", 2); err == nil {
+			t.Errorf("flipping a bit in byte %d went unnoticed", ix)
+		}
+	}
+}
+
+func TestStickyErrors(t *testing.T) {
+	e := NewEncoder("Test", 1)
+	e.Uint64(1 << 40)
+	d, err := NewDecoder(e.Bytes(), "Test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Len(1); n != 0 {
+		t.Errorf("list of %d accepted with no data for it", n)
+	}
+	if v := d.Uint64(); v != 0 {
+		t.Errorf("read %d after an error", v)
+	}
+	if d.Finish() == nil {
+		t.Errorf("error lost")
+	}
+
+	e = NewEncoder("Test", 1)
+	e.Uint64(1)
+	e.Uint64(2)
+	d, _ = NewDecoder(e.Bytes(), "Test", 1)
+	d.Uint64()
+	if d.Finish() == nil {
+		t.Errorf("left over data accepted")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type state struct {
+		Buckets int `json:"buckets"`
+	}
+	data, err := MarshalJSON("Test", 3, state{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"kind":"Test","version":3,"state":{"buckets":7}}` {
+		t.Errorf("encoded %s", data)
+	}
+	if kind, version, err := PeekJSON(data); kind != "Test" || version != 3 || err != nil {
+		t.Errorf("peeked %q %d %v", kind, version, err)
+	}
+	s := state{}
+	if version, err := UnmarshalJSON(data, "Test", 3, &s); version != 3 || err != nil || s.Buckets != 7 {
+		t.Errorf("decoded %+v %d %v", s, version, err)
+	}
+	if _, err := UnmarshalJSON(data, "Other", 3, &s); err == nil {
+		t.Errorf("wrong kind accepted")
+	}
+	if _, err := UnmarshalJSON(data, "Test", 2, &s); err == nil {
+		t.Errorf("newer version accepted")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/KeyGenerator"
+	"github.com/dangermike/hashing/go/consistent_hashing/MultiPointHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/PowerOfChoices"
+)
+
+// balanceChoices are the candidate counts simulated for PowerOfChoices
+var balanceChoices = []int{2, 3}
+
+// balanceTries are the probe counts simulated for MultiPointHashRing, which
+// trades a ring search per probe for a more even load
+var balanceTries = []uint{1, 2, 3, 5, 8, 13, 21, 34}
+
+// mainBalance places every key once and reports the fullest bucket against
+// the average, first for each single-choice mapper, then for PowerOfChoices,
+// which sees the loads as they build up, and last for multi-probe rings with
+// more and more probes
+func mainBalance() {
+	maxLen := 1024
+	minLen := 8
+	replicas := 200
+
+	keys := KeyGenerator.New(d0, *depth)
+	locations := make([]uint64, batchSize, batchSize)
+	fmt.Printf("%d keys\n", keys.Len())
+
+	for i := maxLen; i >= minLen; i /= 2 {
+		for _, build := range targets(i, replicas) {
+			m := build(i)
+			counter := PowerOfChoices.NewCounter(i)
+			keys.Reset()
+			for n := keys.NextPlaces(locations); n > 0; n = keys.NextPlaces(locations) {
+				for _, location := range locations[:n] {
+					counter.Add(m.MapBucket(location))
+				}
+			}
+			printBalance(m.Name(), counter)
+		}
+		for _, choices := range balanceChoices {
+			counter := PowerOfChoices.NewCounter(i)
+			m := PowerOfChoices.New(i, choices, counter)
+			keys.Reset()
+			for n := keys.NextPlaces(locations); n > 0; n = keys.NextPlaces(locations) {
+				for _, location := range locations[:n] {
+					counter.Add(m.MapBucket(location))
+				}
+			}
+			printBalance(m.Name(), counter)
+		}
+		for _, tries := range balanceTries {
+			m := MultiPointHashing.New(i, tries)
+			counter := PowerOfChoices.NewCounter(i)
+			keys.Reset()
+			for n := keys.NextPlaces(locations); n > 0; n = keys.NextPlaces(locations) {
+				for _, location := range locations[:n] {
+					counter.Add(m.MapBucket(location))
+				}
+			}
+			printBalance(m.Name(), counter)
+		}
+	}
+}
+
+func printBalance(name string, counter *PowerOfChoices.Counter) {
+	fmt.Printf(
+		"%s: max %d, mean %0.1f, peak-to-average %0.3f\n",
+		name,
+		counter.Max(),
+		counter.Mean(),
+		float64(counter.Max())/counter.Mean(),
+	)
+}
@@ -0,0 +1,307 @@
+// placementdiff lists the keys that change buckets between two mapper
+// configurations and how many go from each bucket to each other one.
+//
+//	placementdiff [flags] FROM TO
+//
+// FROM and TO are each either a snapshot file, binary or JSON, or a spec
+// like jump:100 or ring:100,200. See specs for the rest. CRUSH maps and
+// partition assignments need more than numbers to describe, so they can only
+// be compared from snapshots.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/AnchorHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/ConsistentHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/CrushPlacement"
+	"github.com/dangermike/hashing/go/consistent_hashing/DxHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/FlipHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MaglevHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/MementoHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/ModHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/MultiPointHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/PartitionAssignment"
+	"github.com/dangermike/hashing/go/consistent_hashing/PlacementDiff"
+	"github.com/dangermike/hashing/go/consistent_hashing/PowerOfChoices"
+	"github.com/dangermike/hashing/go/consistent_hashing/RendezvousHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/RendezvousHashingWithSkeleton"
+	"github.com/dangermike/hashing/go/consistent_hashing/RendezvousHashingWithTable"
+	"github.com/dangermike/hashing/go/consistent_hashing/Snapshot"
+)
+
+var (
+	keyFile = flag.String("keys", "", "file of keys, one per line, or - for stdin; if empty, -count keys named key-0, key-1, ... are used")
+	count   = flag.Int("count", 1000000, "number of generated keys when -keys is not given")
+	moves   = flag.String("moves", "", "file to write each moved key to as key, old bucket and new bucket, or - for stdout")
+	dense   = flag.Bool("dense", false, "print the whole transfer matrix rather than only the pairs of buckets keys move between")
+)
+
+type mapper interface {
+	MapBucket(location uint64) int
+	Name() string
+}
+
+// snapshot is a mapper that can be restored from a snapshot
+type snapshot interface {
+	mapper
+	UnmarshalBinary(data []byte) error
+	UnmarshalJSON(data []byte) error
+}
+
+// kinds makes an empty mapper for each kind of snapshot
+var kinds = map[string]func() snapshot{
+	AnchorHashing.SnapshotKind:                 func() snapshot { return &AnchorHashing.AnchorHash{} },
+	ConsistentHashing.SnapshotKind:             func() snapshot { return &ConsistentHashing.ConsistentHashRing{} },
+	CrushPlacement.SnapshotKind:                func() snapshot { return &CrushPlacement.CrushMap{} },
+	DxHashing.SnapshotKind:                     func() snapshot { return &DxHashing.DxHash{} },
+	FlipHashing.SnapshotKind:                   func() snapshot { return &FlipHashing.FlipHash{} },
+	JumpHash.SnapshotKind:                      func() snapshot { return &JumpHash.JumpHash{} },
+	MaglevHashing.SnapshotKind:                 func() snapshot { return &MaglevHashing.MaglevHasher{} },
+	MementoHash.SnapshotKind:                   func() snapshot { return &MementoHash.MementoHash{} },
+	ModHashing.SnapshotKind:                    func() snapshot { return &ModHashing.ModHasher{} },
+	MultiPointHashing.SnapshotKind:             func() snapshot { return &MultiPointHashing.MultiPointHashRing{} },
+	PartitionAssignment.SnapshotKind:           func() snapshot { return &PartitionAssignment.Assignment{} },
+	PowerOfChoices.SnapshotKind:                func() snapshot { return &PowerOfChoices.ChoiceHash{} },
+	RendezvousHashing.SnapshotKind:             func() snapshot { return &RendezvousHashing.RendezvousHashGroup{} },
+	RendezvousHashingWithSkeleton.SnapshotKind: func() snapshot { return &RendezvousHashingWithSkeleton.RendezvousHashGroup{} },
+	RendezvousHashingWithTable.SnapshotKind:    func() snapshot { return &RendezvousHashingWithTable.RendezvousTable{} },
+}
+
+// spec builds a mapper from a bucket count and the rest of its arguments.
+// Missing arguments take the defaults the benchmark uses.
+type spec struct {
+	usage string
+	build func(args []int) mapper
+}
+
+// arg returns args[ix], or def if there are not that many
+func arg(args []int, ix int, def int) int {
+	if ix < len(args) {
+		return args[ix]
+	}
+	return def
+}
+
+var specs = map[string]spec{
+	"jump":       {"jump:buckets", func(a []int) mapper { return JumpHash.New(a[0]) }},
+	"flip":       {"flip:buckets", func(a []int) mapper { return FlipHashing.New(a[0]) }},
+	"rendezvous": {"rendezvous:buckets", func(a []int) mapper { return RendezvousHashing.New(a[0]) }},
+	"mod":        {"mod:buckets", func(a []int) mapper { return ModHashing.New(a[0]) }},
+	"lemire":     {"lemire:buckets", func(a []int) mapper { return ModHashing.NewWithMode(a[0], ModHashing.Lemire) }},
+	"mask":       {"mask:buckets", func(a []int) mapper { return ModHashing.NewWithMode(a[0], ModHashing.Mask) }},
+	"memento":    {"memento:buckets", func(a []int) mapper { return MementoHash.New(a[0]) }},
+	"ring":       {"ring:buckets[,replicas=200]", func(a []int) mapper { return ConsistentHashing.New(a[0], arg(a, 1, 200)) }},
+	"multipoint": {"multipoint:buckets[,tries=10]", func(a []int) mapper { return MultiPointHashing.New(a[0], uint(arg(a, 1, 10))) }},
+	"maglev":     {"maglev:buckets[,sizeclass=buckets]", func(a []int) mapper { return MaglevHashing.New(a[0], arg(a, 1, a[0])) }},
+	"anchor":     {"anchor:buckets[,capacity=2*buckets]", func(a []int) mapper { return AnchorHashing.New(a[0], arg(a, 1, 2*a[0])) }},
+	"dx":         {"dx:buckets[,capacity=2*buckets]", func(a []int) mapper { return DxHashing.New(a[0], arg(a, 1, 2*a[0])) }},
+	"rendezvoustable": {"rendezvoustable:buckets[,capacity=2*buckets,slots=256]", func(a []int) mapper {
+		return RendezvousHashingWithTable.New(a[0], arg(a, 1, 2*a[0]), arg(a, 2, RendezvousHashingWithTable.DefaultSlots))
+	}},
+	"skeleton": {"skeleton:buckets[,m=4,f=3]", func(a []int) mapper {
+		return RendezvousHashingWithSkeleton.New(a[0], arg(a, 1, 4), arg(a, 2, 3))
+	}},
+}
+
+// parseSpec builds a mapper from a spec like ring:100,200
+func parseSpec(s string) (mapper, error) {
+	name, rest := s, ""
+	if ix := strings.IndexByte(s, ':'); ix >= 0 {
+		name, rest = s[:ix], s[ix+1:]
+	}
+	sp, ok := specs[name]
+	if !ok {
+		return nil, fmt.Errorf("%q is neither a file nor a known mapper", s)
+	}
+	args := []int{}
+	for _, field := range strings.Split(rest, ",") {
+		v, err := strconv.Atoi(field)
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("%q does not match %s", s, sp.usage)
+		}
+		args = append(args, v)
+	}
+	return sp.build(args), nil
+}
+
+// load reads a snapshot, telling JSON from binary by its first byte
+func load(path string) (mapper, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	isJSON := len(bytes.TrimSpace(data)) > 0 && bytes.TrimSpace(data)[0] == '{'
+	var kind string
+	if isJSON {
+		kind, _, err = Snapshot.PeekJSON(data)
+	} else {
+		kind, _, err = Snapshot.Peek(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	newMapper, ok := kinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown kind %q", path, kind)
+	}
+	m := newMapper()
+	if isJSON {
+		err = m.UnmarshalJSON(data)
+	} else {
+		err = m.UnmarshalBinary(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// open treats an argument as a snapshot if there is a file by that name and
+// as a spec otherwise
+func open(s string) (mapper, error) {
+	if _, err := os.Stat(s); err == nil {
+		return load(s)
+	}
+	return parseSpec(s)
+}
+
+// numbered generates keys named key-0, key-1, ...
+type numbered struct {
+	next, count int
+}
+
+func (n *numbered) Next(batch []string) int {
+	written := 0
+	for ; written < len(batch) && n.next < n.count; written, n.next = written+1, n.next+1 {
+		batch[written] = "key-" + strconv.Itoa(n.next)
+	}
+	return written
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] FROM TO\n\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "FROM and TO are snapshot files or one of:\n")
+	names := []string{}
+	for _, sp := range specs {
+		names = append(names, sp.usage)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", name)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0), flag.Arg(1)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(fromArg, toArg string) error {
+	from, err := open(fromArg)
+	if err != nil {
+		return err
+	}
+	to, err := open(toArg)
+	if err != nil {
+		return err
+	}
+
+	var keys PlacementDiff.KeySource = &numbered{count: *count}
+	var lines *PlacementDiff.LineSource
+	if *keyFile == "-" {
+		lines = PlacementDiff.NewLineSource(os.Stdin)
+	} else if *keyFile != "" {
+		f, err := os.Open(*keyFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		lines = PlacementDiff.NewLineSource(f)
+	}
+	if lines != nil {
+		keys = lines
+	}
+
+	var emit func(PlacementDiff.Move) error
+	var bw *bufio.Writer
+	if *moves != "" {
+		var w io.Writer = os.Stdout
+		if *moves != "-" {
+			f, err := os.Create(*moves)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		bw = bufio.NewWriter(w)
+		emit = func(mv PlacementDiff.Move) error {
+			_, err := fmt.Fprintf(bw, "%s\t%d\t%d\n", mv.Key, mv.From, mv.To)
+			return err
+		}
+	}
+
+	m, err := PlacementDiff.Compare(from, to, keys, emit)
+	if err != nil {
+		return err
+	}
+	if bw != nil {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	if lines != nil && lines.Err != nil {
+		return lines.Err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if m.Keys == 0 {
+		// -count 0 or an empty keys file, with nothing to take a share of
+		fmt.Fprintf(out, "# %s -> %s: no keys compared\n", from.Name(), to.Name())
+		return nil
+	}
+	fmt.Fprintf(out, "# %s -> %s: %d of %d keys moved (%0.2f%%)\n", from.Name(), to.Name(), m.Moved, m.Keys, 100*float64(m.Moved)/float64(m.Keys))
+	if *dense {
+		buckets := m.Buckets()
+		fmt.Fprint(out, "from\\to")
+		for _, b := range buckets {
+			fmt.Fprintf(out, "\t%d", b)
+		}
+		fmt.Fprintln(out)
+		for _, a := range buckets {
+			fmt.Fprintf(out, "%d", a)
+			for _, b := range buckets {
+				fmt.Fprintf(out, "\t%d", m.Count(a, b))
+			}
+			fmt.Fprintln(out)
+		}
+		return nil
+	}
+	fmt.Fprintln(out, "from\tto\tkeys")
+	for _, tr := range m.Transfers() {
+		fmt.Fprintf(out, "%d\t%d\t%d\n", tr.From, tr.To, tr.Keys)
+	}
+	return nil
+}
@@ -1,18 +1,29 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"math"
-	"reflect"
 	"time"
 
+	"github.com/dangermike/hashing/go/consistent_hashing/AnchorHashing"
 	"github.com/dangermike/hashing/go/consistent_hashing/ConsistentHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/CrushPlacement"
+	"github.com/dangermike/hashing/go/consistent_hashing/DxHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/FlipHashing"
 	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/KeyGenerator"
+	"github.com/dangermike/hashing/go/consistent_hashing/Latency"
 	"github.com/dangermike/hashing/go/consistent_hashing/MaglevHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/MementoHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MemoryAccounting"
+	"github.com/dangermike/hashing/go/consistent_hashing/ModHashing"
 	"github.com/dangermike/hashing/go/consistent_hashing/MultiPointHashing"
-	"github.com/dangermike/hashing/go/consistent_hashing/ObjectHasher"
+	"github.com/dangermike/hashing/go/consistent_hashing/PartitionAssignment"
 	"github.com/dangermike/hashing/go/consistent_hashing/RendezvousHashing"
 	"github.com/dangermike/hashing/go/consistent_hashing/RendezvousHashingWithSkeleton"
+	"github.com/dangermike/hashing/go/consistent_hashing/RendezvousHashingWithTable"
 )
 
 // var d0 = []string{
@@ -39,25 +50,6 @@ var d0 = []string{
 	"medical", "tightfisted",
 }
 
-func data(depth int) <-chan string {
-	ch := make(chan string)
-	go func() {
-		defer close(ch)
-		if depth > 0 {
-			for _, d := range d0 {
-				for e := range data(depth - 1) {
-					ch <- d + "-" + e
-				}
-			}
-		} else {
-			for _, d := range d0 {
-				ch <- d
-			}
-		}
-	}()
-	return ch
-}
-
 func uniformity(v []int) float64 {
 	// https://stats.stackexchange.com/a/92056
 	total := float64(0)
@@ -87,6 +79,15 @@ func sexyTime(t time.Duration) string {
 	return fmt.Sprintf("%dns", t.Nanoseconds())
 }
 
+// sexyNanos is sexyTime for fractional nanoseconds, which per-lookup
+// latencies frequently are
+func sexyNanos(ns float64) string {
+	if ns < 1000 {
+		return fmt.Sprintf("%0.1fns", ns)
+	}
+	return sexyTime(time.Duration(ns))
+}
+
 func sexyHertz(hz float64) string {
 	symbols := []string{"Hz", "KHz", "MHz", "GHz", "THz"}
 	for i := 0; i < len(symbols); i++ {
@@ -98,79 +99,198 @@ func sexyHertz(hz float64) string {
 	return fmt.Sprintf("%0.2fHz", hz)
 }
 
+// latencyUnit says what each recorded latency is: a single lookup, or the
+// average of a sample of them
+func latencyUnit(sample int) string {
+	if sample == 1 {
+		return "single lookups"
+	}
+	return fmt.Sprintf("%d-lookup averages", sample)
+}
+
+// batchSize is how many keys are generated and placed between timer reads
+const batchSize = 4096
+
+var (
+	depth      = flag.Int("depth", 2, "number of extra words joined onto each key; each level multiplies the key count by 100")
+	sampleSize = flag.Int("sample", 16, "lookups per timer read; each lookup in a sample is charged the sample's average, so percentiles are of sample averages, and -sample 1 times single lookups")
+	parallel   = flag.Bool("parallel", false, "measure aggregate throughput from 1 up to GOMAXPROCS goroutines instead of single-threaded latency")
+	balance    = flag.Bool("balance", false, "simulate placing every key once and compare peak-to-average load, including power-of-choices placement")
+)
+
 type mapper interface {
 	MapBucket(location uint64) int
-	ExpectedMoveRate(otherSize int) float64
+	MapBatch(locations []uint64, out []int)
+	ExpectedMoveRate(from, to Membership.Membership) float64
 	Name() string
 }
 
+// partitions is how many partitions keys are split into before those are
+// placed on buckets. Kafka and Cassandra clusters tend to have a few per node.
+const partitions = 4096
+
+// crushTopology spreads buckets over 2 regions of 2 zones of 4 racks, dealing
+// them out across the racks like cards so growing the count fills every rack.
+// Racks, zones and regions only appear once they have a host.
+func crushTopology(buckets int) *CrushPlacement.Node {
+	root := &CrushPlacement.Node{Name: "root", Type: "root"}
+	child := func(parent *CrushPlacement.Node, name, typ string) *CrushPlacement.Node {
+		for _, c := range parent.Children {
+			if c.Name == name {
+				return c
+			}
+		}
+		c := &CrushPlacement.Node{Name: name, Type: typ}
+		parent.Children = append(parent.Children, c)
+		return c
+	}
+	for b := 0; b < buckets; b++ {
+		k := b % 16
+		region := child(root, fmt.Sprintf("region-%d", k/8), "region")
+		zone := child(region, fmt.Sprintf("zone-%d-%d", k/8, k/4%2), "zone")
+		rack := child(zone, fmt.Sprintf("rack-%d-%d-%d", k/8, k/4%2, k%4), "rack")
+		rack.Children = append(rack.Children, &CrushPlacement.Node{Name: fmt.Sprintf("host-%d", b), Type: CrushPlacement.DeviceType, Bucket: b, Weight: 1})
+	}
+	return root
+}
+
+// newCrush places 3 replicas of each key in distinct racks of crushTopology
+func newCrush(buckets int) mapper {
+	cm, err := CrushPlacement.New(crushTopology(buckets), CrushPlacement.Rule{Replicas: 3, FailureDomain: "rack"})
+	if err != nil {
+		panic(err)
+	}
+	return cm
+}
+
+// targets are the mappers compared at each size, as constructors taking a
+// bucket count. Each is built with i buckets and compared against itself
+// built with i+1.
+func targets(i int, replicas int) []func(buckets int) mapper {
+	return []func(buckets int) mapper{
+		func(buckets int) mapper { return JumpHash.New(buckets) },
+		func(buckets int) mapper { return MaglevHashing.New(buckets, i+1) },
+		func(buckets int) mapper { return MultiPointHashing.New(buckets, 10) },
+		func(buckets int) mapper { return ConsistentHashing.New(buckets, replicas) },
+		func(buckets int) mapper { return RendezvousHashing.New(buckets) },
+		func(buckets int) mapper { return RendezvousHashingWithSkeleton.New(buckets, 4, 3) },
+		// few slots build fast and small, many even out the load
+		func(buckets int) mapper { return RendezvousHashingWithTable.New(buckets, 2*i, 64) },
+		func(buckets int) mapper { return RendezvousHashingWithTable.New(buckets, 2*i, 1024) },
+		func(buckets int) mapper { return AnchorHashing.New(buckets, 2*i) },
+		func(buckets int) mapper { return MementoHash.New(buckets) },
+		func(buckets int) mapper { return DxHashing.New(buckets, 2*i) },
+		func(buckets int) mapper { return FlipHashing.New(buckets) },
+		newCrush,
+		func(buckets int) mapper { return ModHashing.New(buckets) },
+		func(buckets int) mapper { return ModHashing.NewWithMode(buckets, ModHashing.Lemire) },
+		func(buckets int) mapper { return ModHashing.NewWithMode(buckets, ModHashing.Mask) },
+		func(buckets int) mapper {
+			return PartitionAssignment.New(partitions, ConsistentHashing.New(buckets, replicas))
+		},
+		// func(buckets int) mapper { return RendezvousHashingWithSkeleton.New(buckets, buckets, buckets) },
+	}
+}
+
 func main() {
+	flag.Parse()
+	if *parallel {
+		mainParallel()
+		return
+	}
+	if *balance {
+		mainBalance()
+		return
+	}
+	if *sampleSize < 1 {
+		*sampleSize = 1
+	}
+	timerOverhead := Latency.CalibrateTimer(10001)
+	fmt.Printf("timer overhead %s, %d lookups per sample\n", sexyTime(timerOverhead), *sampleSize)
+
 	maxLen := 1024
 	minLen := 8
 	replicas := 200
 
+	keys := KeyGenerator.New(d0, *depth)
+	locations := make([]uint64, batchSize, batchSize)
+	placed := make([]int, batchSize, batchSize)
+	batched := make([]int, batchSize, batchSize)
+
 	for i := maxLen; i >= minLen; i /= 2 {
-		targets := [][2]mapper{
-			[2]mapper{
-				JumpHash.New(i),
-				JumpHash.New(i + 1),
-			},
-			[2]mapper{
-				MaglevHashing.New(i, i+1),
-				MaglevHashing.New(i+1, i+1),
-			},
-			[2]mapper{
-				MultiPointHashing.New(i, 10),
-				MultiPointHashing.New(i+1, 10),
-			},
-			[2]mapper{
-				ConsistentHashing.New(i, replicas),
-				ConsistentHashing.New(i+1, replicas),
-			},
-			[2]mapper{
-				RendezvousHashing.New(i),
-				RendezvousHashing.New(i + 1),
-			},
-			[2]mapper{
-				RendezvousHashingWithSkeleton.New(i, 4, 3),
-				RendezvousHashingWithSkeleton.New(i+1, 4, 3),
-			},
-			// [2]mapper{
-			// 	RendezvousHashingWithSkeleton.New(i, i, i),
-			// 	RendezvousHashingWithSkeleton.New(i+1, i+1, i+1),
-			// },
-		}
+		for _, build := range targets(i, replicas) {
+			var mappers [2]mapper
+			estimate, measured := MemoryAccounting.Measure(func() interface{} {
+				mappers[0] = build(i)
+				return mappers[0]
+			})
+			mappers[1] = build(i + 1)
 
-		for _, mappers := range targets {
 			buckets := make([]int, i, i)
 			cnt := 0
 			moved := int64(0)
 			duration := time.Duration(0)
+			batchDuration := time.Duration(0)
+			latency := Latency.New()
+
+			keys.Reset()
+			for n := keys.NextPlaces(locations); n > 0; n = keys.NextPlaces(locations) {
+				// each sample is recorded as its average, so with more than one
+				// lookup a sample a slow lookup is smoothed over the others and
+				// the percentiles below are percentiles of averages
+				for lo := 0; lo < n; lo += *sampleSize {
+					hi := lo + *sampleSize
+					if hi > n {
+						hi = n
+					}
+					start := time.Now()
+					for ix := lo; ix < hi; ix++ {
+						placed[ix] = mappers[0].MapBucket(locations[ix])
+					}
+					elapsed := time.Now().Sub(start) - timerOverhead
+					if elapsed < 0 {
+						elapsed = 0
+					}
+					duration += elapsed
+					latency.RecordN(float64(elapsed.Nanoseconds())/float64(hi-lo), uint64(hi-lo))
+				}
 
-			for d := range data(2) {
 				start := time.Now()
-				location := ObjectHasher.PlaceString(d)
-				bucket := mappers[0].MapBucket(location)
-				duration += time.Now().Sub(start)
-				bucket2 := mappers[1].MapBucket(location)
-				buckets[bucket]++
-				cnt++
-				if bucket != bucket2 {
-					moved++
+				mappers[0].MapBatch(locations[:n], batched)
+				batchDuration += time.Now().Sub(start)
+
+				for ix, location := range locations[:n] {
+					bucket := placed[ix]
+					buckets[bucket]++
+					cnt++
+					if bucket != mappers[1].MapBucket(location) {
+						moved++
+					}
 				}
 			}
 
 			fmt.Printf(
-				"%s: %d total in %s (%s); %d (%0.2f%%, %0.2f%% theoretical) moved; %0.3f uniformity; %d bytes\n",
+				"%s: %d total in %s (%s); %d (%0.2f%%, %0.2f%% theoretical) moved; %0.3f uniformity; %d bytes (%d measured)\n",
 				mappers[0].Name(),
 				cnt,
 				sexyTime(duration),
 				sexyHertz(float64(cnt)/(duration.Seconds())),
 				moved,
 				float64(moved)*100.0/float64(cnt),
-				100.0*mappers[0].ExpectedMoveRate(i+1),
+				100.0*mappers[0].ExpectedMoveRate(Membership.Range(i), Membership.Range(i+1)),
 				(1.0-uniformity(buckets))*100.0,
-				Sizeof(mappers[0]),
+				estimate,
+				measured,
+			)
+			fmt.Printf(
+				"    latency (%s) p50 %s, p90 %s, p99 %s, p999 %s, max %s; batched %s\n",
+				latencyUnit(*sampleSize),
+				sexyNanos(latency.Quantile(0.5)),
+				sexyNanos(latency.Quantile(0.9)),
+				sexyNanos(latency.Quantile(0.99)),
+				sexyNanos(latency.Quantile(0.999)),
+				sexyNanos(latency.Max()),
+				sexyHertz(float64(cnt)/batchDuration.Seconds()),
 			)
 			// for i := 0; i < len(buckets); i++ {
 			// 	if i > 0 {
@@ -181,94 +301,6 @@ func main() {
 
 			// fmt.Println()
 		}
+		runRemoval(i, keys, locations)
 	}
 }
-
-var (
-	sliceSize  = uint64(reflect.TypeOf(reflect.SliceHeader{}).Size())
-	stringSize = uint64(reflect.TypeOf(reflect.StringHeader{}).Size())
-)
-
-func isNativeType(k reflect.Kind) bool {
-	switch k {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
-		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
-		return true
-	}
-	return false
-}
-
-func sizeofInternal(val reflect.Value, fromStruct bool, depth int) (sz uint64) {
-	if depth++; depth > 1000 {
-		panic("sizeOf recursed more than 1000 times.")
-	}
-
-	typ := val.Type()
-
-	if !fromStruct {
-		sz = uint64(typ.Size())
-	}
-
-	switch val.Kind() {
-	case reflect.Ptr:
-		if val.IsNil() {
-			break
-		}
-		sz += sizeofInternal(val.Elem(), false, depth)
-
-	case reflect.Struct:
-		for i := 0; i < val.NumField(); i++ {
-			sz += sizeofInternal(val.Field(i), true, depth)
-		}
-
-	case reflect.Array:
-		if isNativeType(typ.Elem().Kind()) {
-			break
-		}
-		sz = 0
-		for i := 0; i < val.Len(); i++ {
-			sz += sizeofInternal(val.Index(i), false, depth)
-		}
-	case reflect.Slice:
-		if !fromStruct {
-			sz = sliceSize
-		}
-		el := typ.Elem()
-		if isNativeType(el.Kind()) {
-			sz += uint64(val.Len()) * uint64(el.Size())
-			break
-		}
-		for i := 0; i < val.Len(); i++ {
-			sz += sizeofInternal(val.Index(i), false, depth)
-		}
-	case reflect.Map:
-		if val.IsNil() {
-			break
-		}
-		kel, vel := typ.Key(), typ.Elem()
-		if isNativeType(kel.Kind()) && isNativeType(vel.Kind()) {
-			sz += uint64(kel.Size()+vel.Size()) * uint64(val.Len())
-			break
-		}
-		keys := val.MapKeys()
-		for i := 0; i < len(keys); i++ {
-			sz += sizeofInternal(keys[i], false, depth) + sizeofInternal(val.MapIndex(keys[i]), false, depth)
-		}
-	case reflect.String:
-		if !fromStruct {
-			sz = stringSize
-		}
-		sz += uint64(val.Len())
-	}
-	return
-}
-
-// Sizeof returns the estimated memory usage of object(s) not just the size of the type.
-// On 64bit Sizeof("test") == 12 (8 = sizeof(StringHeader) + 4 bytes).
-func Sizeof(objs ...interface{}) (sz uint64) {
-	for i := range objs {
-		sz += sizeofInternal(reflect.ValueOf(objs[i]), false, 0)
-	}
-	return
-}
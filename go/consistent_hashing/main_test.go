@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/ConsistentHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MapperTest"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/PlacementHandle"
+)
+
+// TestMapBatch checks every mapper compared here, the ones the removal
+// comparison builds, and the modes and wrappers that are not compared, with
+// MapperTest.Batch. Mappers with a batch path of their own test it further
+// in their packages.
+func TestMapBatch(t *testing.T) {
+	locs := MapperTest.Locations(5000)
+	for _, size := range MapperTest.Sizes {
+		for _, build := range targets(size, 200) {
+			MapperTest.Batch(t, build(size), locs)
+		}
+		if size > 1 {
+			for _, build := range removalTargets(size) {
+				for _, m := range build(size, size/2) {
+					MapperTest.Batch(t, m, locs)
+				}
+			}
+		}
+		for _, mode := range []JumpHash.Mode{JumpHash.Guava, JumpHash.Integer} {
+			MapperTest.Batch(t, JumpHash.NewWithMode(size, mode), locs)
+		}
+		h := PlacementHandle.New(Membership.Range(size), func(members Membership.Membership) PlacementHandle.Mapper {
+			return ConsistentHashing.NewWithMembership(members, 10)
+		})
+		MapperTest.Batch(t, h, locs)
+		if size > 1 {
+			h.Remove(size / 2)
+			MapperTest.Batch(t, h, locs)
+		}
+	}
+}
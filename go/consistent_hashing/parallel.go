@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/KeyGenerator"
+)
+
+// maxParallelKeys caps how many locations are held in memory for the
+// parallel run. Workers loop over the same locations, so deeper key sets only
+// cost memory without changing what is measured.
+const maxParallelKeys = 1 << 20
+
+// scalingThreshold is the parallel efficiency (speedup divided by workers)
+// below which a mapper is flagged as not scaling
+const scalingThreshold = 0.5
+
+// allocThreshold is the allocations per lookup above which a mapper is
+// flagged as allocating
+const allocThreshold = 0.01
+
+func mainParallel() {
+	maxLen := 1024
+	minLen := 8
+	replicas := 200
+
+	keys := KeyGenerator.New(d0, *depth)
+	cnt := keys.Len()
+	if cnt > maxParallelKeys {
+		cnt = maxParallelKeys
+	}
+	locations := make([]uint64, cnt, cnt)
+	cnt = keys.NextPlaces(locations)
+	locations = locations[:cnt]
+
+	fmt.Printf("%d keys per worker, workers %v\n", cnt, workerCounts(runtime.GOMAXPROCS(0)))
+	if runtime.NumCPU() < runtime.GOMAXPROCS(0) {
+		fmt.Printf("GOMAXPROCS %d exceeds %d CPUs, scaling results will be pessimistic\n", runtime.GOMAXPROCS(0), runtime.NumCPU())
+	}
+	for i := maxLen; i >= minLen; i /= 2 {
+		for _, build := range targets(i, replicas) {
+			runParallel(build(i), locations)
+		}
+	}
+}
+
+// workerCounts is 1, 2, 4, ... up to and always including maxWorkers
+func workerCounts(maxWorkers int) []int {
+	counts := []int{}
+	for w := 1; w < maxWorkers; w *= 2 {
+		counts = append(counts, w)
+	}
+	return append(counts, maxWorkers)
+}
+
+// runParallel prints the scalability curve of m: aggregate lookups per second
+// at each worker count, and the speedup relative to a single worker. Mappers
+// that allocate, scale poorly, or give different answers under concurrency
+// are flagged at the end of the line.
+func runParallel(m mapper, locations []uint64) {
+	expected := make([]int, len(locations), len(locations))
+	for ix, location := range locations {
+		expected[ix] = m.MapBucket(location)
+	}
+
+	curve := []string{}
+	warnings := []string{}
+	base := 0.0
+	worstEfficiency := 1.0
+	worstAllocs := 0.0
+	mismatches := 0
+	for _, workers := range workerCounts(runtime.GOMAXPROCS(0)) {
+		hz, allocs, bad := parallelThroughput(m, locations, expected, workers)
+		if workers == 1 {
+			base = hz
+		}
+		speedup := hz / base
+		if efficiency := speedup / float64(workers); efficiency < worstEfficiency {
+			worstEfficiency = efficiency
+		}
+		if allocs > worstAllocs {
+			worstAllocs = allocs
+		}
+		mismatches += bad
+		curve = append(curve, fmt.Sprintf("%dw %s (%0.2fx)", workers, sexyHertz(hz), speedup))
+	}
+
+	if worstAllocs > allocThreshold {
+		warnings = append(warnings, fmt.Sprintf("allocates %0.2f/lookup", worstAllocs))
+	}
+	if worstEfficiency < scalingThreshold {
+		warnings = append(warnings, fmt.Sprintf("poor scaling (%0.0f%% efficient)", worstEfficiency*100))
+	}
+	if mismatches > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d lookups disagreed with the serial answer, shared mutable state?", mismatches))
+	}
+
+	fmt.Printf("%s: %s", m.Name(), strings.Join(curve, ", "))
+	if len(warnings) > 0 {
+		fmt.Printf("; WARNING %s", strings.Join(warnings, "; "))
+	}
+	fmt.Println()
+}
+
+// parallelThroughput has each of workers goroutines map every location,
+// starting at staggered offsets so they are not reading the same cache lines
+// in lockstep. It returns the aggregate lookups per second, allocations per
+// lookup and the number of lookups that did not match expected.
+func parallelThroughput(m mapper, locations []uint64, expected []int, workers int) (float64, float64, int) {
+	var wg sync.WaitGroup
+	var memBefore, memAfter runtime.MemStats
+	bad := make([]int, workers, workers)
+	ready := make(chan struct{})
+
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			offset := w * len(locations) / workers
+			<-ready
+			for ix := range locations {
+				jx := (ix + offset) % len(locations)
+				if m.MapBucket(locations[jx]) != expected[jx] {
+					bad[w]++
+				}
+			}
+		}(w)
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&memBefore)
+	start := time.Now()
+	close(ready)
+	wg.Wait()
+	duration := time.Now().Sub(start)
+	runtime.ReadMemStats(&memAfter)
+
+	lookups := float64(workers * len(locations))
+	mismatches := 0
+	for _, b := range bad {
+		mismatches += b
+	}
+	return lookups / duration.Seconds(), float64(memAfter.Mallocs-memBefore.Mallocs) / lookups, mismatches
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dangermike/hashing/go/consistent_hashing/AnchorHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/DxHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/JumpHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/KeyGenerator"
+	"github.com/dangermike/hashing/go/consistent_hashing/MaglevHashing"
+	"github.com/dangermike/hashing/go/consistent_hashing/Membership"
+	"github.com/dangermike/hashing/go/consistent_hashing/MementoHash"
+	"github.com/dangermike/hashing/go/consistent_hashing/MemoryAccounting"
+)
+
+// renumbered stands in for removing a bucket from the middle of a mapper that
+// can only shrink from the top. It is built with one bucket fewer and every
+// bucket from the removed one up is shifted along by one, which is what a
+// caller of such a mapper has to do in practice.
+type renumbered struct {
+	mapper
+	removed int
+}
+
+func (r renumbered) MapBucket(location uint64) int {
+	b := r.mapper.MapBucket(location)
+	if b >= r.removed {
+		b++
+	}
+	return b
+}
+
+// MapBatch batches through the mapper and then renumbers, since the batch
+// would otherwise come from the mapper underneath and skip the renumbering
+func (r renumbered) MapBatch(locations []uint64, out []int) {
+	r.mapper.MapBatch(locations, out)
+	for ix, b := range out[:len(locations)] {
+		if b >= r.removed {
+			out[ix] = b + 1
+		}
+	}
+}
+
+func (r renumbered) Name() string {
+	return fmt.Sprintf("%s-renumbered", r.mapper.Name())
+}
+
+// removalTargets are the mappers compared when a bucket is removed from the
+// middle. Each returns a mapper with i buckets, and the same mapper with
+// removed taken out.
+func removalTargets(i int) []func(buckets int, removed int) [2]mapper {
+	return []func(buckets int, removed int) [2]mapper{
+		func(buckets int, removed int) [2]mapper {
+			return [2]mapper{JumpHash.New(buckets), renumbered{JumpHash.New(buckets - 1), removed}}
+		},
+		func(buckets int, removed int) [2]mapper {
+			after := MaglevHashing.NewWithMembership(Membership.Range(buckets).Without(removed), i)
+			return [2]mapper{MaglevHashing.New(buckets, i), after}
+		},
+		func(buckets int, removed int) [2]mapper {
+			after := AnchorHashing.New(buckets, 2*i)
+			after.Remove(removed)
+			return [2]mapper{AnchorHashing.New(buckets, 2*i), after}
+		},
+		func(buckets int, removed int) [2]mapper {
+			after := MementoHash.New(buckets)
+			after.Remove(removed)
+			return [2]mapper{MementoHash.New(buckets), after}
+		},
+		func(buckets int, removed int) [2]mapper {
+			after := DxHashing.New(buckets, 2*i)
+			after.Remove(removed)
+			return [2]mapper{DxHashing.New(buckets, 2*i), after}
+		},
+	}
+}
+
+// runRemoval takes the middle bucket out of each removal target and reports
+// how many keys moved against what the mapper predicts, how many of those
+// were not on the removed bucket, and how fast lookups are afterwards
+func runRemoval(i int, keys *KeyGenerator.Iterator, locations []uint64) {
+	removed := i / 2
+	from := Membership.Range(i)
+	to := from.Without(removed)
+	fmt.Printf("removing bucket %d of %d\n", removed, i)
+	for _, build := range removalTargets(i) {
+		mappers := build(i, removed)
+		cnt := 0
+		moved := 0
+		strays := 0
+		duration := time.Duration(0)
+
+		keys.Reset()
+		for n := keys.NextPlaces(locations); n > 0; n = keys.NextPlaces(locations) {
+			start := time.Now()
+			for _, location := range locations[:n] {
+				mappers[1].MapBucket(location)
+			}
+			duration += time.Now().Sub(start)
+
+			for _, location := range locations[:n] {
+				bucket, bucket2 := mappers[0].MapBucket(location), mappers[1].MapBucket(location)
+				cnt++
+				if bucket != bucket2 {
+					moved++
+					if bucket != removed {
+						strays++
+					}
+				}
+			}
+		}
+
+		fmt.Printf(
+			"    %s: %d (%0.2f%%, %0.2f%% predicted, %0.2f%% minimum) moved, %d from surviving buckets; %s lookups after removal; %d bytes\n",
+			mappers[1].Name(),
+			moved,
+			float64(moved)*100.0/float64(cnt),
+			100.0*mappers[0].ExpectedMoveRate(from, to),
+			100.0*Membership.MinimalMoveRate(from, to),
+			strays,
+			sexyHertz(float64(cnt)/duration.Seconds()),
+			MemoryAccounting.Sizeof(mappers[1]),
+		)
+	}
+}